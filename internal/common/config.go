@@ -10,22 +10,93 @@ import (
 const (
 	defaultInitTimeout    = 10 * time.Second
 	defaultRequestTimeout = 1 * time.Minute
+	defaultMediaTimeout   = 1 * time.Minute
+	defaultProcessTimeout = 90 * time.Second
 	defaultPingInterval   = 30 * time.Second
+	defaultOutgoingMaxAge = 24 * time.Hour
+	defaultMaxFileSize    = 100
+	defaultMaxTextLength  = 4000
+	defaultMaxMessageSize = 16
+	defaultRobotPing      = 1 * time.Minute
+	defaultPortRange      = 100
+	defaultOutboxAttempts = 10
+	defaultOutboxTTL      = 1 * time.Hour
+	defaultMaxRequests    = 16
+	defaultVersionTries   = 3
+	defaultDedupCacheSize = 256
+	defaultMediaDebounce  = 10 * time.Second
 )
 
 type Configure struct {
 	Wechat struct {
-		Version        string        `yaml:"version"`
-		ListenPort     int32         `yaml:"listen_port"`
-		InitTimeout    time.Duration `yaml:"init_timeout"`
-		RequestTimeout time.Duration `yaml:"request_timeout"`
-		Workdir        string        `yaml:"-"`
+		Version             string            `yaml:"version"`
+		SetVersionAttempts  int               `yaml:"set_version_attempts"`
+		Drivers             map[string]string `yaml:"drivers"`
+		ListenPort          int32             `yaml:"listen_port"`
+		PortRangeEnd        int32             `yaml:"port_range_end"`
+		MaxClients          int               `yaml:"max_clients"`
+		InitTimeout         time.Duration     `yaml:"init_timeout"`
+		RequestTimeout      time.Duration     `yaml:"request_timeout"`
+		MediaTimeout        time.Duration     `yaml:"media_timeout"`
+		ProcessTimeout      time.Duration     `yaml:"process_timeout"`
+		OutgoingMaxAge      time.Duration     `yaml:"outgoing_max_age"`
+		Timezone            string            `yaml:"timezone"`
+		NameEncoding        string            `yaml:"name_encoding"`
+		DataDir             string            `yaml:"data_dir"`
+		MaxFileSize         int64             `yaml:"max_file_size"`
+		MaxMessageSize      int               `yaml:"max_message_size"`
+		MaxTextLength       int               `yaml:"max_text_length"`
+		TruncateText        bool              `yaml:"truncate_text"`
+		StripControlChars   bool              `yaml:"strip_control_chars"`
+		VerboseNotices      bool              `yaml:"verbose_notices"`
+		UnknownAppAsText    bool              `yaml:"unknown_app_as_text"`
+		SuppressSelfEcho    bool              `yaml:"suppress_self_echo"`
+		SelfEchoPrefix      string            `yaml:"self_echo_prefix"`
+		IgnoreTypes         []string          `yaml:"ignore_types"`
+		DedupCacheSize      int               `yaml:"dedup_cache_size"`
+		MediaDebounce       time.Duration     `yaml:"media_debounce"`
+		PingInterval        time.Duration     `yaml:"ping_interval"`
+		SelfRefreshInterval time.Duration     `yaml:"self_refresh_interval"`
+		AccountLabels       map[string]string `yaml:"account_labels"`
+		Proxy               string            `yaml:"proxy"`
+		UserAgent           string            `yaml:"user_agent"`
+		Headers             map[string]string `yaml:"headers"`
+		RestoreSessions     bool              `yaml:"restore_sessions"`
+		Mock                bool              `yaml:"mock"`
+		Workdir             string            `yaml:"-"`
+
+		Outbox struct {
+			Enabled     bool          `yaml:"enabled"`
+			MaxAttempts int           `yaml:"max_attempts"`
+			TTL         time.Duration `yaml:"ttl"`
+		} `yaml:"outbox"`
+
+		Retention struct {
+			Interval time.Duration `yaml:"interval"`
+			MaxAge   time.Duration `yaml:"max_age"`
+			MaxSize  int64         `yaml:"max_size"`
+		} `yaml:"retention"`
+
+		MediaStore struct {
+			Type string `yaml:"type"`
+			S3   struct {
+				Endpoint  string `yaml:"endpoint"`
+				Bucket    string `yaml:"bucket"`
+				AccessKey string `yaml:"access_key"`
+				SecretKey string `yaml:"secret_key"`
+			} `yaml:"s3"`
+		} `yaml:"media_store"`
 	} `yaml:"wechat"`
 
 	Service struct {
-		Addr         string        `yaml:"addr"`
-		Secret       string        `yaml:"secret"`
-		PingInterval time.Duration `yaml:"ping_interval"`
+		Addr                  string        `yaml:"addr"`
+		Secret                string        `yaml:"secret"`
+		PingInterval          time.Duration `yaml:"ping_interval"`
+		CACert                string        `yaml:"ca_cert"`
+		InsecureSkipVerify    bool          `yaml:"insecure_skip_verify"`
+		MetricsAddr           string        `yaml:"metrics_addr"`
+		MaxConcurrentRequests int           `yaml:"max_concurrent_requests"`
+		Admins                []string      `yaml:"admins"`
 	} `yaml:"service"`
 
 	Log struct {
@@ -40,12 +111,29 @@ func LoadConfig(path string) (*Configure, error) {
 	}
 
 	config := &Configure{}
+	config.Wechat.SetVersionAttempts = defaultVersionTries
+	config.Wechat.DedupCacheSize = defaultDedupCacheSize
+	config.Wechat.MediaDebounce = defaultMediaDebounce
 	config.Wechat.InitTimeout = defaultInitTimeout
 	config.Wechat.RequestTimeout = defaultRequestTimeout
+	config.Wechat.MediaTimeout = defaultMediaTimeout
+	config.Wechat.ProcessTimeout = defaultProcessTimeout
+	config.Wechat.OutgoingMaxAge = defaultOutgoingMaxAge
+	config.Wechat.MaxFileSize = defaultMaxFileSize
+	config.Wechat.MaxTextLength = defaultMaxTextLength
+	config.Wechat.MaxMessageSize = defaultMaxMessageSize
+	config.Wechat.PingInterval = defaultRobotPing
+	config.Wechat.Outbox.MaxAttempts = defaultOutboxAttempts
+	config.Wechat.Outbox.TTL = defaultOutboxTTL
 	config.Service.PingInterval = defaultPingInterval
+	config.Service.MaxConcurrentRequests = defaultMaxRequests
 	if err := yaml.Unmarshal(file, &config); err != nil {
 		return nil, err
 	}
 
+	if config.Wechat.PortRangeEnd == 0 {
+		config.Wechat.PortRangeEnd = config.Wechat.ListenPort + defaultPortRange
+	}
+
 	return config, nil
 }
@@ -0,0 +1,48 @@
+package common
+
+import "errors"
+
+type ErrorCode string
+
+const (
+	CodeProcessFailed    ErrorCode = "PROCESS_FAILED"
+	CodeClientNotFound   ErrorCode = "CLIENT_NOT_FOUND"
+	CodeNotLoggedIn      ErrorCode = "NOT_LOGGED_IN"
+	CodeNotFound         ErrorCode = "NOT_FOUND"
+	CodeNotFriend        ErrorCode = "NOT_FRIEND"
+	CodeMutedGroup       ErrorCode = "MUTED_GROUP"
+	CodeRateLimited      ErrorCode = "RATE_LIMITED"
+	CodeRobotUnavailable ErrorCode = "ROBOT_UNAVAILABLE"
+
+	CodeTransferUnavailable ErrorCode = "TRANSFER_UNAVAILABLE"
+	CodeNotSupported        ErrorCode = "NOT_SUPPORTED"
+	CodeMaxClients          ErrorCode = "MAX_CLIENTS"
+	CodeForbidden           ErrorCode = "FORBIDDEN"
+)
+
+// CodedError carries the code reported to bridge.
+type CodedError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *CodedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CodedError) Unwrap() error {
+	return e.Err
+}
+
+func WithCode(code ErrorCode, err error) error {
+	return &CodedError{Code: code, Err: err}
+}
+
+// GetErrorCode returns the code of the outermost coded error in chain.
+func GetErrorCode(err error) ErrorCode {
+	var coded *CodedError
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	return CodeProcessFailed
+}
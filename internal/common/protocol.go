@@ -31,16 +31,18 @@ type ErrorResponse struct {
 }
 
 type Event struct {
-	ID        string     `json:"id"`
-	ThreadID  string     `json:"thread_id,omitempty"`
-	Timestamp int64      `json:"timestamp"`
-	From      User       `json:"from"`
-	Chat      Chat       `json:"chat"`
-	Type      EventType  `json:"type"`
-	Content   string     `json:"content,omitempty"`
-	Mentions  []string   `json:"mentions,omitempty"`
-	Reply     *ReplyInfo `json:"reply,omitempty"`
-	Data      any        `json:"data,omitempty"`
+	ID           string     `json:"id"`
+	ThreadID     string     `json:"thread_id,omitempty"`
+	Timestamp    int64      `json:"timestamp"`
+	From         User       `json:"from"`
+	Chat         Chat       `json:"chat"`
+	IsSelf       bool       `json:"is_self,omitempty"`
+	Type         EventType  `json:"type"`
+	Content      string     `json:"content,omitempty"`
+	Mentions     []string   `json:"mentions,omitempty"`
+	MentionsSelf bool       `json:"mentions_self,omitempty"`
+	Reply        *ReplyInfo `json:"reply,omitempty"`
+	Data         any        `json:"data,omitempty"`
 }
 
 type User struct {
@@ -67,11 +69,36 @@ type AppData struct {
 	Description string `json:"desc,omitempty"`
 	Source      string `json:"source,omitempty"`
 	URL         string `json:"url,omitempty"`
+	Thumb       string `json:"thumb,omitempty"`
+
+	// WeChat channels (视频号) identifiers, bridge can build the link from them
+	ObjectID string `json:"object_id,omitempty"`
+	NonceID  string `json:"nonce_id,omitempty"`
+	LiveID   string `json:"live_id,omitempty"`
+
+	MiniProgram *MiniProgramData `json:"mini_program,omitempty"`
+
+	// official account pushes several articles in one message
+	Articles []*ArticleData `json:"articles,omitempty"`
 
 	Content string               `json:"raw,omitempty"`
 	Blobs   map[string]*BlobData `json:"blobs,omitempty"`
 }
 
+type MiniProgramData struct {
+	Username string `json:"username,omitempty"`
+	AppID    string `json:"appid,omitempty"`
+	PagePath string `json:"pagepath,omitempty"`
+	Icon     string `json:"icon,omitempty"`
+}
+
+type ArticleData struct {
+	Title  string `json:"title"`
+	Digest string `json:"digest,omitempty"`
+	URL    string `json:"url,omitempty"`
+	Cover  string `json:"cover,omitempty"`
+}
+
 type LocationData struct {
 	Name      string  `json:"name,omitempty"`
 	Address   string  `json:"address,omitempty"`
@@ -79,10 +106,59 @@ type LocationData struct {
 	Latitude  float64 `json:"latitude"`
 }
 
+type QRCodeData struct {
+	PNG       []byte `json:"png"`
+	UUID      string `json:"uuid,omitempty"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type DeliveryData struct {
+	RequestID string `json:"request_id"`
+	MsgID     string `json:"msg_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type LogoutData struct {
+	Reason string `json:"reason"`
+	Forced bool   `json:"forced"`
+}
+
+// WeChat may only report an aggregated count for a reaction,
+// in that case Reactor is left empty.
+type ReactionData struct {
+	MsgID   string `json:"msg_id"`
+	Reactor string `json:"reactor,omitempty"`
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count,omitempty"`
+}
+
+// ids are required to accept the transfer
+type TransferData struct {
+	TransferID    string `json:"transfer_id"`
+	TransactionID string `json:"transaction_id"`
+	Amount        string `json:"amount,omitempty"`
+	Memo          string `json:"memo,omitempty"`
+	// 1: waiting to be accepted, 3: accepted, 4: refunded
+	Status int `json:"status"`
+}
+
+// group owner is asked to approve members invited by Inviter
+type InviteApprovalData struct {
+	Inviter  string   `json:"inviter"`
+	Invitees []string `json:"invitees"`
+	Ticket   string   `json:"ticket"`
+}
+
 type BlobData struct {
 	Name   string `json:"name,omitempty"`
 	Mime   string `json:"mime,omitempty"`
 	Binary []byte `json:"binary"`
+	// agent downloads it when Binary is empty
+	URL string `json:"url,omitempty"`
+
+	Width     int       `json:"width,omitempty"`
+	Height    int       `json:"height,omitempty"`
+	Thumbnail *BlobData `json:"thumbnail,omitempty"`
 }
 
 func (o *Message) UnmarshalJSON(data []byte) error {
@@ -130,7 +206,7 @@ func (o *Request) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		o.Data = event
-	case ReqGetUserInfo, ReqGetGroupInfo, ReqGetGroupMembers, ReqGetGroupMemberNickname:
+	case ReqGetUserInfo, ReqGetGroupInfo, ReqGetGroupMembers, ReqGetGroupMemberNickname, ReqGetMessage, ReqGetContactType, ReqGetGroupMemberDetail, ReqDownloadMedia, ReqAcceptTransfer, ReqGetFavorites, ReqGetChatroomName, ReqGetGroupMemberNicknames:
 		var params []string
 		if err := json.Unmarshal(rawMsg, &params); err != nil {
 			return err
@@ -163,7 +239,7 @@ func (o *Response) UnmarshalJSON(data []byte) error {
 		}
 		o.Data = event
 	case RespLoginQR:
-		var code []byte
+		var code *QRCodeData
 		if err := json.Unmarshal(rawMsg, &code); err != nil {
 			return err
 		}
@@ -192,13 +268,13 @@ func (o *Response) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		o.Data = members
-	case RespGetGroupMemberNickname:
+	case RespGetGroupMemberNickname, RespGetChatroomName:
 		var nickname string
 		if err := json.Unmarshal(rawMsg, &nickname); err != nil {
 			return err
 		}
 		o.Data = nickname
-	case RespGetFriendList:
+	case RespGetFriendList, RespGetOfficialAccountList:
 		var friends []*UserInfo
 		if err := json.Unmarshal(rawMsg, &friends); err != nil {
 			return err
@@ -210,6 +286,54 @@ func (o *Response) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		o.Data = groups
+	case RespGetMessage:
+		var info *MessageInfo
+		if err := json.Unmarshal(rawMsg, &info); err != nil {
+			return err
+		}
+		o.Data = info
+	case RespDownloadMedia:
+		var blob *BlobData
+		if err := json.Unmarshal(rawMsg, &blob); err != nil {
+			return err
+		}
+		o.Data = blob
+	case RespGetFavorites:
+		var items []*FavoriteItem
+		if err := json.Unmarshal(rawMsg, &items); err != nil {
+			return err
+		}
+		o.Data = items
+	case RespGetGroupMemberDetail:
+		var members []*GroupMember
+		if err := json.Unmarshal(rawMsg, &members); err != nil {
+			return err
+		}
+		o.Data = members
+	case RespGetGroupMemberNicknames:
+		var names map[string]string
+		if err := json.Unmarshal(rawMsg, &names); err != nil {
+			return err
+		}
+		o.Data = names
+	case RespDisconnectAll:
+		var count int
+		if err := json.Unmarshal(rawMsg, &count); err != nil {
+			return err
+		}
+		o.Data = count
+	case RespGetContactType:
+		var contactType ContactType
+		if err := json.Unmarshal(rawMsg, &contactType); err != nil {
+			return err
+		}
+		o.Data = contactType
+	case RespSyncAll:
+		var data *SyncData
+		if err := json.Unmarshal(rawMsg, &data); err != nil {
+			return err
+		}
+		o.Data = data
 	default:
 	}
 
@@ -251,11 +375,61 @@ func (o *Event) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		o.Data = app
+	case EventDelivery:
+		var delivery *DeliveryData
+		if err := json.Unmarshal(rawMsg, &delivery); err != nil {
+			return err
+		}
+		o.Data = delivery
+	case EventReaction:
+		var reaction *ReactionData
+		if err := json.Unmarshal(rawMsg, &reaction); err != nil {
+			return err
+		}
+		o.Data = reaction
+	case EventLogout:
+		var logout *LogoutData
+		if err := json.Unmarshal(rawMsg, &logout); err != nil {
+			return err
+		}
+		o.Data = logout
+	case EventProfile:
+		var info *UserInfo
+		if err := json.Unmarshal(rawMsg, &info); err != nil {
+			return err
+		}
+		o.Data = info
+	case EventTransfer:
+		var transfer *TransferData
+		if err := json.Unmarshal(rawMsg, &transfer); err != nil {
+			return err
+		}
+		o.Data = transfer
+	case EventInviteApproval:
+		var approval *InviteApprovalData
+		if err := json.Unmarshal(rawMsg, &approval); err != nil {
+			return err
+		}
+		o.Data = approval
+	case EventTopic:
+		var info *GroupInfo
+		if err := json.Unmarshal(rawMsg, &info); err != nil {
+			return err
+		}
+		o.Data = info
+	default:
+		// events without data, keep it re-marshalable
+		if len(rawMsg) == 0 {
+			o.Data = nil
+		}
 	}
 
 	return nil
 }
 
+// chat ID for notes to self, messages are sent to WeChat's file transfer helper
+const NotesToSelf = "filehelper"
+
 const (
 	MsgRequest MessageType = iota
 	MsgResponse
@@ -274,6 +448,18 @@ const (
 	ReqGetGroupMemberNickname
 	ReqGetFriendList
 	ReqGetGroupList
+	ReqGetMessage
+	ReqSyncAll
+	ReqGetOfficialAccountList
+	ReqLogout
+	ReqGetContactType
+	ReqGetGroupMemberDetail
+	ReqDownloadMedia
+	ReqAcceptTransfer
+	ReqGetFavorites
+	ReqGetChatroomName
+	ReqDisconnectAll
+	ReqGetGroupMemberNicknames
 )
 
 const (
@@ -289,6 +475,18 @@ const (
 	RespGetGroupMemberNickname
 	RespGetFriendList
 	RespGetGroupList
+	RespGetMessage
+	RespSyncAll
+	RespGetOfficialAccountList
+	RespLogout
+	RespGetContactType
+	RespGetGroupMemberDetail
+	RespDownloadMedia
+	RespAcceptTransfer
+	RespGetFavorites
+	RespGetChatroomName
+	RespDisconnectAll
+	RespGetGroupMemberNicknames
 )
 
 const (
@@ -296,6 +494,15 @@ const (
 	ChatGroup
 )
 
+const (
+	ContactFriend ContactType = iota
+	ContactStranger
+	ContactBlocked
+	ContactOfficial
+	ContactSystem
+	ContactGroup
+)
+
 const (
 	EventText EventType = iota
 	EventPhoto
@@ -309,6 +516,13 @@ const (
 	EventRevoke
 	EventVoIP
 	EventSystem
+	EventDelivery
+	EventReaction
+	EventLogout
+	EventProfile
+	EventTransfer
+	EventInviteApproval
+	EventTopic
 )
 
 type MessageType int
@@ -352,6 +566,30 @@ func (t RequestType) String() string {
 		return "get_friend_list"
 	case ReqGetGroupList:
 		return "get_group_list"
+	case ReqGetMessage:
+		return "get_message"
+	case ReqSyncAll:
+		return "sync_all"
+	case ReqGetOfficialAccountList:
+		return "get_official_account_list"
+	case ReqLogout:
+		return "logout"
+	case ReqGetContactType:
+		return "get_contact_type"
+	case ReqGetGroupMemberDetail:
+		return "get_group_member_detail"
+	case ReqDownloadMedia:
+		return "download_media"
+	case ReqAcceptTransfer:
+		return "accept_transfer"
+	case ReqGetFavorites:
+		return "get_favorites"
+	case ReqGetChatroomName:
+		return "get_chatroom_name"
+	case ReqDisconnectAll:
+		return "disconnect_all"
+	case ReqGetGroupMemberNicknames:
+		return "get_group_member_nicknames"
 	default:
 		return "unknown"
 	}
@@ -385,6 +623,30 @@ func (t ResponseType) String() string {
 		return "get_friend_list"
 	case RespGetGroupList:
 		return "get_group_list"
+	case RespGetMessage:
+		return "get_message"
+	case RespSyncAll:
+		return "sync_all"
+	case RespGetOfficialAccountList:
+		return "get_official_account_list"
+	case RespLogout:
+		return "logout"
+	case RespGetContactType:
+		return "get_contact_type"
+	case RespGetGroupMemberDetail:
+		return "get_group_member_detail"
+	case RespDownloadMedia:
+		return "download_media"
+	case RespAcceptTransfer:
+		return "accept_transfer"
+	case RespGetFavorites:
+		return "get_favorites"
+	case RespGetChatroomName:
+		return "get_chatroom_name"
+	case RespDisconnectAll:
+		return "disconnect_all"
+	case RespGetGroupMemberNicknames:
+		return "get_group_member_nicknames"
 	default:
 		return "unknown"
 	}
@@ -403,6 +665,27 @@ func (t ChatType) String() string {
 	}
 }
 
+type ContactType int
+
+func (t ContactType) String() string {
+	switch t {
+	case ContactFriend:
+		return "friend"
+	case ContactStranger:
+		return "stranger"
+	case ContactBlocked:
+		return "blocked"
+	case ContactOfficial:
+		return "official"
+	case ContactSystem:
+		return "system"
+	case ContactGroup:
+		return "group"
+	default:
+		return "unknown"
+	}
+}
+
 type EventType int
 
 func (t EventType) String() string {
@@ -431,24 +714,84 @@ func (t EventType) String() string {
 		return "voip"
 	case EventSystem:
 		return "system"
+	case EventDelivery:
+		return "delivery"
+	case EventReaction:
+		return "reaction"
+	case EventLogout:
+		return "logout"
+	case EventProfile:
+		return "profile"
+	case EventTransfer:
+		return "transfer"
+	case EventInviteApproval:
+		return "invite_approval"
+	case EventTopic:
+		return "topic"
 	default:
 		return "unknown"
 	}
 }
 
 type UserInfo struct {
-	ID     string `json:"id"`
-	Name   string `json:"name"`
-	Avatar string `json:"avatar,omitempty"`
-	Remark string `json:"remark,omitempty"`
+	ID        string `json:"id"`
+	Alias     string `json:"alias,omitempty"`
+	Name      string `json:"name"`
+	Avatar    string `json:"avatar,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Remark    string `json:"remark,omitempty"`
 }
 
 type GroupInfo struct {
-	ID      string   `json:"id"`
-	Name    string   `json:"name"`
-	Avatar  string   `json:"avatar,omitempty"`
-	Notice  string   `json:"notice,omitempty"`
-	Members []string `json:"members"`
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Avatar       string   `json:"avatar,omitempty"`
+	Notice       string   `json:"notice,omitempty"`
+	NoticeEditor string   `json:"notice_editor,omitempty"`
+	NoticeTime   int64    `json:"notice_time,omitempty"`
+	Owner        string   `json:"owner,omitempty"`
+	Members      []string `json:"members"`
+}
+
+// admins are not recorded in WeChat's local database, so only owner is flagged
+type GroupMember struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name,omitempty"`
+	// admins are reported as plain members
+	IsOwner bool `json:"is_owner,omitempty"`
+}
+
+// media of favorite is on WeChat CDN, located by CDNURL and decrypted with CDNKey
+type FavoriteItem struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	Timestamp   int64  `json:"ts"`
+	From        string `json:"from,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"desc,omitempty"`
+	URL         string `json:"url,omitempty"`
+	FileName    string `json:"file_name,omitempty"`
+	FileSize    int64  `json:"file_size,omitempty"`
+	CDNURL      string `json:"cdn_url,omitempty"`
+	CDNKey      string `json:"cdn_key,omitempty"`
+	MD5         string `json:"md5,omitempty"`
+}
+
+type SyncData struct {
+	Friends []*UserInfo  `json:"friends"`
+	Groups  []*GroupInfo `json:"groups"`
+}
+
+type MessageInfo struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Chat      string `json:"chat"`
+	From      string `json:"from"`
+	IsSelf    bool   `json:"is_self"`
+	Type      int    `json:"type"`
+	Content   string `json:"content,omitempty"`
+	FilePath  string `json:"filepath,omitempty"`
+	Thumbnail string `json:"thumb_path,omitempty"`
 }
 
 func (er *ErrorResponse) Error() string {
@@ -0,0 +1,111 @@
+package wechat
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/duo/matrix-wechat-agent/internal/common"
+
+	"github.com/gorilla/websocket"
+)
+
+const checkTimeout = 10 * time.Second
+
+// Check diagnoses config, driver and bridge connection without starting the agent,
+// every step is reported to w, false if any of them failed.
+func Check(config *common.Configure, w io.Writer) bool {
+	ok := true
+	report := func(name string, err error) {
+		if err != nil {
+			ok = false
+			fmt.Fprintf(w, "[FAIL] %s: %v\n", name, err)
+		} else {
+			fmt.Fprintf(w, "[ OK ] %s\n", name)
+		}
+	}
+
+	report("config", checkConfig(config))
+	report(fmt.Sprintf("listen port %d", config.Wechat.ListenPort), checkListenPort(config.Wechat.ListenPort))
+
+	if config.Wechat.Mock {
+		fmt.Fprintln(w, "[SKIP] driver: mock mode is enabled")
+	} else {
+		report("driver", checkDriver(config))
+	}
+
+	report(fmt.Sprintf("bridge %s", config.Service.Addr), checkBridge(config))
+
+	return ok
+}
+
+func checkConfig(config *common.Configure) error {
+	switch {
+	case !versionRegex.MatchString(config.Wechat.Version):
+		return fmt.Errorf("invalid wechat version %q, expect x.y.z.w", config.Wechat.Version)
+	case config.Wechat.ListenPort <= 0:
+		return fmt.Errorf("listen_port is required")
+	case config.Wechat.PortRangeEnd <= config.Wechat.ListenPort:
+		return fmt.Errorf("port_range_end must be greater than listen_port")
+	case len(config.Service.Addr) == 0:
+		return fmt.Errorf("service addr is required")
+	case len(config.Service.Secret) == 0:
+		return fmt.Errorf("service secret is required")
+	}
+
+	if _, _, err := parseIgnoreTypes(config.Wechat.IgnoreTypes); err != nil {
+		return err
+	}
+	if len(config.Wechat.Timezone) > 0 {
+		if _, err := time.LoadLocation(config.Wechat.Timezone); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkListenPort(port int32) error {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+func checkDriver(config *common.Configure) error {
+	release, err := LoadDriver(config)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, err = newDriver(config)
+	return err
+}
+
+func checkBridge(config *common.Configure) error {
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		return err
+	}
+
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: checkTimeout,
+		TLSClientConfig:  tlsConfig,
+	}
+	conn, resp, err := dialer.Dial(config.Service.Addr, http.Header{
+		"Authorization": []string{fmt.Sprintf("Basic %s", config.Service.Secret)},
+	})
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%w (HTTP %d)", err, resp.StatusCode)
+		}
+		return err
+	}
+
+	return conn.Close()
+}
@@ -2,14 +2,20 @@ package wechat
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/duo/matrix-wechat-agent/internal/common"
+
 	"github.com/shirou/gopsutil/v3/process"
 	"github.com/tidwall/gjson"
 
@@ -36,11 +42,48 @@ const (
 	WECHAT_SET_VERSION                  = 35
 	WECHAT_MSG_FORWARD_MESSAGE          = 40
 	WECHAT_GET_QROCDE_IMAGE             = 41
+	WECHAT_MSG_SEND_XML                 = 43
 	WECHAT_LOGOUT                       = 44
+	WECHAT_TRANSFER_ACCEPT              = 45
+	WECHAT_MSG_SEND_EMOTION             = 46
 
 	DB_MICRO_MSG      = "MicroMsg.db"
 	DB_OPENIM_CONTACT = "OpenIMContact.db"
 	DB_MEDIA_MSG      = "MediaMSG0.db"
+	DB_MSG            = "MSG%d.db"
+	DB_FAVORITE       = "Favorite.db"
+
+	// bits of Contact.Type
+	CONTACT_TYPE_FRIEND    = 1 << 0
+	CONTACT_TYPE_BLACKLIST = 1 << 3
+
+	// message BytesExtra keys
+	EXTRA_SENDER    = 1
+	EXTRA_THUMBNAIL = 3
+	EXTRA_FILE_PATH = 4
+)
+
+// timeout is set from config by manager
+var robotClient = &http.Client{}
+
+var (
+	ErrClientNotFound = common.WithCode(common.CodeClientNotFound, errors.New("client not found"))
+	ErrNotLoggedIn    = common.WithCode(common.CodeNotLoggedIn, errors.New("user not logged"))
+
+	ErrNotFriend   = common.WithCode(common.CodeNotFriend, errors.New("not a friend"))
+	ErrMutedGroup  = common.WithCode(common.CodeMutedGroup, errors.New("muted in group"))
+	ErrRateLimited = common.WithCode(common.CodeRateLimited, errors.New("rate limited"))
+
+	ErrMessageNotFound = common.WithCode(common.CodeNotFound, errors.New("message not found"))
+
+	ErrRobotUnavailable = common.WithCode(common.CodeRobotUnavailable, errors.New("robot unavailable"))
+	ErrEmptyResponse    = errors.New("robot returns empty response")
+
+	ErrTransferUnavailable = common.WithCode(common.CodeTransferUnavailable, errors.New("transfer already accepted or expired"))
+
+	ErrNotSupported = common.WithCode(common.CodeNotSupported, errors.New("not supported by robot"))
+
+	ErrMaxClients = common.WithCode(common.CodeMaxClients, errors.New("max accounts reached"))
 )
 
 type Client struct {
@@ -48,9 +91,20 @@ type Client struct {
 	port   int32
 	pid    uintptr
 	proc   *process.Process
+	mock   *mockRobot
+
+	// set when user signs out on purpose, cleared by next QR login
+	loggedOut atomic.Bool
+	// login status observed by last ping
+	wasLogin atomic.Bool
+	// wxid of logged in user, cached by GetSelf
+	selfID atomic.Value
 }
 
 func (c *Client) IsAlive() bool {
+	if c.mock != nil {
+		return true
+	}
 	status, err := c.proc.IsRunning()
 	if err != nil {
 		return false
@@ -58,7 +112,28 @@ func (c *Client) IsAlive() bool {
 	return status
 }
 
+// kill spawned WeChat without talking to robot, which may not be listening yet
+func (c *Client) kill() error {
+	if c.proc == nil {
+		p, err := os.FindProcess(int(c.pid))
+		if err != nil {
+			return err
+		}
+		return p.Kill()
+	}
+
+	if children, err := c.proc.Children(); err == nil {
+		for _, v := range children {
+			v.Kill()
+		}
+	}
+	return c.proc.Kill()
+}
+
 func (c *Client) Dispose() error {
+	if c.mock != nil {
+		return c.mock.Close()
+	}
 	if c.proc == nil {
 		return nil
 	}
@@ -95,27 +170,36 @@ func (c *Client) HookMsg(savePath string) error {
 		return err
 	}
 
-	_, err = post(
+	ret, err := post(
 		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_MSG_START_HOOK),
 		[]byte(fmt.Sprintf(`{"port":%d}`, c.listen)),
 	)
 	if err != nil {
 		return err
 	}
-	_, err = post(
+	if err := checkResult(ret); err != nil {
+		return err
+	}
+	ret, err = post(
 		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_MSG_START_IMAGE_HOOK),
 		path,
 	)
 	if err != nil {
 		return err
 	}
-	_, err = post(
+	if err := checkResult(ret); err != nil {
+		return err
+	}
+	ret, err = post(
 		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_MSG_START_VOICE_HOOK),
 		path,
 	)
 	if err != nil {
 		return err
 	}
+	if err := checkResult(ret); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -128,15 +212,21 @@ func (c *Client) SetVersion(version string) error {
 		return err
 	}
 
-	_, err = post(
+	ret, err := post(
 		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_SET_VERSION),
 		data,
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return checkResult(ret)
 }
 
-func (c *Client) LoginWtihQRCode() ([]byte, error) {
+func (c *Client) LoginWtihQRCode() (*common.QRCodeData, error) {
+	c.loggedOut.Store(false)
+	c.selfID.Store("")
+
 	// FIXME: skip the first qr code
 	time.Sleep(3 * time.Second)
 
@@ -151,43 +241,103 @@ func (c *Client) LoginWtihQRCode() ([]byte, error) {
 	var resp WxGetQRCodeResp
 	err = json.Unmarshal(ret, &resp)
 	if err != nil {
-		return ret, nil
+		return normalizeQRCode(ret)
 	} else {
 		return nil, fmt.Errorf("%v", resp.Message)
 	}
 }
 
 func (c *Client) Logout() error {
-	_, err := post(
+	ret, err := post(
 		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_LOGOUT),
 		[]byte("{}"),
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return checkResult(ret)
+}
+
+func (c *Client) AcceptTransfer(wxid, transferid, transcationid string) error {
+	data, err := json.Marshal(map[string]string{
+		"wxid":          wxid,
+		"transferid":    transferid,
+		"transcationid": transcationid,
+	})
+	if err != nil {
+		return err
+	}
+
+	ret, err := post(
+		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_TRANSFER_ACCEPT),
+		data,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := checkResult(ret); err != nil {
+		if containsAny(err.Error(), "已收", "过期", "退还", "accepted", "expired") {
+			return fmt.Errorf("%w: %v", ErrTransferUnavailable, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// call API which older robot may lack, it either rejects the type or
+// answers without result
+func (c *Client) postOptional(api int, data []byte) ([]byte, error) {
+	ret, err := post(fmt.Sprintf(CLIENT_API_URL, c.port, api), data)
+	if err != nil {
+		if errors.Is(err, ErrRobotUnavailable) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrNotSupported, err)
+	}
+
+	if !gjson.ValidBytes(ret) || len(gjson.GetBytes(ret, "result").String()) == 0 {
+		return nil, fmt.Errorf("%w: API %d", ErrNotSupported, api)
+	}
+
+	return ret, nil
 }
 
 func (c *Client) IsLogin() bool {
+	err := c.checkLogin()
+	if err != nil && !errors.Is(err, ErrNotLoggedIn) && !errors.Is(err, ErrRobotUnavailable) {
+		log.Warnf("Failed to check login status: %v", err)
+	}
+
+	return err == nil
+}
+
+// ErrNotLoggedIn only if robot tells so, robot failures are reported as is
+func (c *Client) checkLogin() error {
 	ret, err := post(
 		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_IS_LOGIN),
 		[]byte("{}"),
 	)
 	if err != nil {
-		return false
+		return err
 	}
 
 	var resp WxIsLoginResp
-	err = json.Unmarshal(ret, &resp)
-	if err != nil || resp.Result != "OK" {
-		log.Warnln("Failed to parse is_login response", err)
-		return false
+	if err := decodeResult("is_login", ret, &resp); err != nil {
+		return err
+	}
+	if resp.IsLogin != 1 {
+		return ErrNotLoggedIn
 	}
 
-	return resp.IsLogin == 1
+	return nil
 }
 
 func (c *Client) GetSelf() (*WxUserInfo, error) {
-	if !c.IsLogin() {
-		return nil, fmt.Errorf("user not logged")
+	if err := c.checkLogin(); err != nil {
+		return nil, err
 	}
 
 	ret, err := post(
@@ -199,48 +349,63 @@ func (c *Client) GetSelf() (*WxUserInfo, error) {
 	}
 
 	var resp WxGetSelfResp
-	err = json.Unmarshal(ret, &resp)
-	if err != nil || resp.Result != "OK" {
-		log.Warnln("Failed to parse get_self response", err)
+	if err := decodeResult("get_self", ret, &resp); err != nil {
 		return nil, err
 	}
+	// robot answers with empty info while login is still in progress
+	if len(resp.Data.ID) == 0 {
+		return nil, ErrNotLoggedIn
+	}
+	c.selfID.Store(resp.Data.ID)
 
 	return &resp.Data, nil
 }
 
-func (c *Client) GetUserInfo(wxid string) (*WxUserInfo, error) {
-	if !c.IsLogin() {
-		return nil, fmt.Errorf("user not logged")
+// SelfID returns wxid of logged in user, empty if unknown
+func (c *Client) SelfID() string {
+	if id, ok := c.selfID.Load().(string); ok && len(id) > 0 {
+		return id
+	}
+	if info, err := c.GetSelf(); err == nil && info != nil {
+		return info.ID
 	}
+	return ""
+}
 
-	var handle int64
-	var sql string
-	var err error
+func (c *Client) GetUserInfo(wxid string) (*WxUserInfo, error) {
+	if err := c.checkLogin(); err != nil {
+		return nil, err
+	}
 
 	if strings.HasSuffix(wxid, "@openim") {
-		handle, err = c.getDbHandleByName(DB_OPENIM_CONTACT)
-		if err != nil {
-			return nil, err
-		}
-
-		sql = fmt.Sprintf(`
+		return c.queryUserInfo(DB_OPENIM_CONTACT, fmt.Sprintf(`
 			SELECT UserName, NickName, BigHeadImgUrl, SmallHeadImgUrl, Remark
 			FROM OpenIMContact
-			WHERE UserName="%s"
-		`, wxid)
-	} else {
-		handle, err = c.getDbHandleByName(DB_MICRO_MSG)
-		if err != nil {
-			return nil, err
-		}
+			WHERE UserName=%s
+		`, sqlString(wxid)), wxid)
+	}
 
-		sql = fmt.Sprintf(`
-			SELECT c.UserName, c.NickName, i.bigHeadImgUrl, i.smallHeadImgUrl, c.Remark
-			FROM Contact AS c
-			LEFT JOIN ContactHeadImgUrl AS i
-				ON c.UserName = i.usrName
-			WHERE c.UserName="%s"
-		`, wxid)
+	// alias is chosen by user and may equal another user's name,
+	// so it is only tried if no user has the name
+	query := `
+		SELECT c.UserName, c.NickName, i.bigHeadImgUrl, i.smallHeadImgUrl, c.Remark, c.Alias
+		FROM Contact AS c
+		LEFT JOIN ContactHeadImgUrl AS i
+			ON c.UserName = i.usrName
+		WHERE c.%s=%s
+	`
+	info, err := c.queryUserInfo(DB_MICRO_MSG, fmt.Sprintf(query, "UserName", sqlString(wxid)), wxid)
+	if common.GetErrorCode(err) == common.CodeNotFound {
+		return c.queryUserInfo(DB_MICRO_MSG, fmt.Sprintf(query, "Alias", sqlString(wxid)), wxid)
+	}
+
+	return info, err
+}
+
+func (c *Client) queryUserInfo(db string, sql string, wxid string) (*WxUserInfo, error) {
+	handle, err := c.getDbHandleByName(db)
+	if err != nil {
+		return nil, err
 	}
 
 	jsonSql, err := json.Marshal(map[string]interface{}{
@@ -260,14 +425,15 @@ func (c *Client) GetUserInfo(wxid string) (*WxUserInfo, error) {
 	}
 
 	if gjson.GetBytes(ret, "data.#").Int() <= 1 {
-		return nil, fmt.Errorf("user %s not found", wxid)
+		return nil, common.WithCode(common.CodeNotFound, fmt.Errorf("user %s not found", wxid))
 	}
 
 	info := &WxUserInfo{
 		ID:        gjson.GetBytes(ret, "data.1.0").String(),
-		Nickname:  gjson.GetBytes(ret, "data.1.1").String(),
+		Nickname:  decodeName(gjson.GetBytes(ret, "data.1.1").String()),
 		BigAvatar: gjson.GetBytes(ret, "data.1.2").String(),
-		Remark:    gjson.GetBytes(ret, "data.1.4").String(),
+		Remark:    decodeName(gjson.GetBytes(ret, "data.1.4").String()),
+		Alias:     gjson.GetBytes(ret, "data.1.5").String(),
 	}
 	if len(info.BigAvatar) == 0 {
 		info.BigAvatar = gjson.GetBytes(ret, "data.1.3").String()
@@ -276,9 +442,43 @@ func (c *Client) GetUserInfo(wxid string) (*WxUserInfo, error) {
 	return info, nil
 }
 
+// only the name, GetGroupInfo is heavier as it also loads avatar and notice
+func (c *Client) GetChatroomName(chatroom string) (string, error) {
+	if err := c.checkLogin(); err != nil {
+		return "", err
+	}
+
+	handle, err := c.getDbHandleByName(DB_MICRO_MSG)
+	if err != nil {
+		return "", err
+	}
+
+	jsonSql, err := json.Marshal(map[string]interface{}{
+		"db_handle": handle,
+		"sql":       fmt.Sprintf(`SELECT NickName FROM Contact WHERE UserName=%s`, sqlString(chatroom)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	ret, err := post(
+		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_DATABASE_QUERY),
+		jsonSql,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if gjson.GetBytes(ret, "data.#").Int() <= 1 {
+		return "", common.WithCode(common.CodeNotFound, fmt.Errorf("group %s not found", chatroom))
+	}
+
+	return decodeName(gjson.GetBytes(ret, "data.1.0").String()), nil
+}
+
 func (c *Client) GetGroupInfo(wxid string) (*WxGroupInfo, error) {
-	if !c.IsLogin() {
-		return nil, fmt.Errorf("user not logged")
+	if err := c.checkLogin(); err != nil {
+		return nil, err
 	}
 
 	handle, err := c.getDbHandleByName(DB_MICRO_MSG)
@@ -291,8 +491,8 @@ func (c *Client) GetGroupInfo(wxid string) (*WxGroupInfo, error) {
 		FROM Contact AS c
 		LEFT JOIN ContactHeadImgUrl AS i
 			ON c.UserName = i.usrName
-		WHERE c.UserName="%s"
-	`, wxid)
+		WHERE c.UserName=%s
+	`, sqlString(wxid))
 
 	jsonSql, err := json.Marshal(map[string]interface{}{
 		"db_handle": handle,
@@ -311,19 +511,25 @@ func (c *Client) GetGroupInfo(wxid string) (*WxGroupInfo, error) {
 	}
 
 	if gjson.GetBytes(ret, "data.#").Int() <= 1 {
-		return nil, fmt.Errorf("group %s not found", wxid)
+		return nil, common.WithCode(common.CodeNotFound, fmt.Errorf("group %s not found", wxid))
 	}
 
 	info := &WxGroupInfo{
 		ID:        gjson.GetBytes(ret, "data.1.0").String(),
-		Name:      gjson.GetBytes(ret, "data.1.1").String(),
+		Name:      decodeName(gjson.GetBytes(ret, "data.1.1").String()),
 		BigAvatar: gjson.GetBytes(ret, "data.1.2").String(),
 	}
 	if len(info.BigAvatar) == 0 {
 		info.BigAvatar = gjson.GetBytes(ret, "data.1.3").String()
 	}
 
-	sql = fmt.Sprintf(`SELECT Announcement FROM ChatRoomInfo WHERE ChatRoomName="%s"`, wxid)
+	sql = fmt.Sprintf(`
+		SELECT i.Announcement, i.AnnouncementEditor, i.AnnouncementPublishTime, r.Reserved2
+		FROM ChatRoom AS r
+		LEFT JOIN ChatRoomInfo AS i
+			ON r.ChatRoomName = i.ChatRoomName
+		WHERE r.ChatRoomName=%s
+	`, sqlString(wxid))
 	jsonSql, err = json.Marshal(map[string]interface{}{
 		"db_handle": handle,
 		"sql":       sql,
@@ -342,14 +548,17 @@ func (c *Client) GetGroupInfo(wxid string) (*WxGroupInfo, error) {
 
 	if gjson.GetBytes(ret, "data.#").Int() > 1 {
 		info.Notice = gjson.GetBytes(ret, "data.1.0").String()
+		info.NoticeEditor = gjson.GetBytes(ret, "data.1.1").String()
+		info.NoticeTime = gjson.GetBytes(ret, "data.1.2").Int()
+		info.Owner = gjson.GetBytes(ret, "data.1.3").String()
 	}
 
 	return info, nil
 }
 
 func (c *Client) GetGroupMembers(wxid string) ([]string, error) {
-	if !c.IsLogin() {
-		return nil, fmt.Errorf("user not logged")
+	if err := c.checkLogin(); err != nil {
+		return nil, err
 	}
 
 	ret, err := post(
@@ -361,18 +570,67 @@ func (c *Client) GetGroupMembers(wxid string) ([]string, error) {
 	}
 
 	var resp WxGetGroupMembersResp
-	err = json.Unmarshal(ret, &resp)
-	if err != nil || resp.Result != "OK" {
-		log.Warnln("Failed to parse get_group_members response", err)
+	if err := decodeResult("get_group_members", ret, &resp); err != nil {
 		return nil, err
 	}
 
 	return strings.Split(resp.Members, "^G"), nil
 }
 
+func (c *Client) GetChatroomMemberDetail(chatroom string) ([]*common.GroupMember, error) {
+	handle, err := c.getDbHandleByName(DB_MICRO_MSG)
+	if err != nil {
+		return nil, err
+	}
+
+	sql := fmt.Sprintf(`
+		SELECT UserNameList, Reserved2, RoomData
+		FROM ChatRoom
+		WHERE ChatRoomName=%s
+	`, sqlString(chatroom))
+
+	jsonSql, err := json.Marshal(map[string]interface{}{
+		"db_handle": handle,
+		"sql":       sql,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := post(
+		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_DATABASE_QUERY),
+		jsonSql,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if gjson.GetBytes(ret, "data.#").Int() <= 1 {
+		return nil, common.WithCode(common.CodeNotFound, fmt.Errorf("group %s not found", chatroom))
+	}
+
+	owner := gjson.GetBytes(ret, "data.1.1").String()
+	roomData, _ := base64.StdEncoding.DecodeString(gjson.GetBytes(ret, "data.1.2").String())
+	displayNames := parseRoomData(roomData)
+
+	var members []*common.GroupMember
+	for _, wxid := range strings.Split(gjson.GetBytes(ret, "data.1.0").String(), "^G") {
+		if len(wxid) == 0 {
+			continue
+		}
+		members = append(members, &common.GroupMember{
+			ID:          wxid,
+			DisplayName: displayNames[wxid],
+			IsOwner:     wxid == owner,
+		})
+	}
+
+	return members, nil
+}
+
 func (c *Client) GetGroupMemberNickname(group, wxid string) (string, error) {
-	if !c.IsLogin() {
-		return "", fmt.Errorf("user not logged")
+	if err := c.checkLogin(); err != nil {
+		return "", err
 	}
 
 	ret, err := post(
@@ -386,9 +644,109 @@ func (c *Client) GetGroupMemberNickname(group, wxid string) (string, error) {
 	return gjson.GetBytes(ret, "nickname").String(), nil
 }
 
+// resolve in-group nicknames in bulk, per-member lookups are only used
+// when database isn't available
+func (c *Client) GetChatroomMemberNicknames(chatroom string, wxids []string) (map[string]string, error) {
+	if err := c.checkLogin(); err != nil {
+		return nil, err
+	}
+
+	names, err := c.queryChatroomMemberNicknames(chatroom, wxids)
+	if err == nil {
+		return names, nil
+	}
+	if common.GetErrorCode(err) == common.CodeNotFound {
+		return nil, err
+	}
+
+	names = map[string]string{}
+	for _, wxid := range wxids {
+		name, err := c.GetGroupMemberNickname(chatroom, wxid)
+		if err != nil {
+			return nil, err
+		}
+		names[wxid] = name
+	}
+
+	return names, nil
+}
+
+// display names are kept in RoomData, members without one use their nickname
+func (c *Client) queryChatroomMemberNicknames(chatroom string, wxids []string) (map[string]string, error) {
+	handle, err := c.getDbHandleByName(DB_MICRO_MSG)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonSql, err := json.Marshal(map[string]interface{}{
+		"db_handle": handle,
+		"sql":       fmt.Sprintf(`SELECT RoomData FROM ChatRoom WHERE ChatRoomName=%s`, sqlString(chatroom)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := post(
+		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_DATABASE_QUERY),
+		jsonSql,
+	)
+	if err != nil {
+		return nil, err
+	}
+	// a failed query isn't a missing group, fall back to per-member lookups
+	if err := checkResult(ret); err != nil {
+		return nil, err
+	}
+
+	if gjson.GetBytes(ret, "data.#").Int() <= 1 {
+		return nil, common.WithCode(common.CodeNotFound, fmt.Errorf("group %s not found", chatroom))
+	}
+
+	roomData, _ := base64.StdEncoding.DecodeString(gjson.GetBytes(ret, "data.1.0").String())
+	displayNames := parseRoomData(roomData)
+
+	names := map[string]string{}
+	var missing []string
+	for _, wxid := range wxids {
+		if name := displayNames[wxid]; len(name) > 0 {
+			names[wxid] = name
+		} else {
+			missing = append(missing, sqlString(wxid))
+		}
+	}
+	if len(missing) == 0 {
+		return names, nil
+	}
+
+	jsonSql, err = json.Marshal(map[string]interface{}{
+		"db_handle": handle,
+		"sql":       fmt.Sprintf(`SELECT UserName, NickName FROM Contact WHERE UserName IN (%s)`, strings.Join(missing, ",")),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err = post(
+		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_DATABASE_QUERY),
+		jsonSql,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, row := range gjson.GetBytes(ret, "data").Array() {
+		if i == 0 {
+			continue
+		}
+		names[row.Get("0").String()] = decodeName(row.Get("1").String())
+	}
+
+	return names, nil
+}
+
 func (c *Client) GetFriendList() ([]*WxUserInfo, error) {
-	if !c.IsLogin() {
-		return nil, fmt.Errorf("user not logged")
+	if err := c.checkLogin(); err != nil {
+		return nil, err
 	}
 
 	contacts, err := c.GetContacts()
@@ -398,18 +756,8 @@ func (c *Client) GetFriendList() ([]*WxUserInfo, error) {
 
 	var friends []*WxUserInfo
 	for _, c := range contacts {
-		if !strings.HasSuffix(c[0], "@chatroom") {
-			info := &WxUserInfo{
-				ID:        c[0],
-				Nickname:  c[1],
-				BigAvatar: c[2],
-				Remark:    c[4],
-			}
-			if len(info.BigAvatar) == 0 {
-				info.BigAvatar = c[3]
-			}
-
-			friends = append(friends, info)
+		if getContactCategory(c) == common.ContactFriend {
+			friends = append(friends, contactToUserInfo(c))
 		}
 	}
 
@@ -417,17 +765,7 @@ func (c *Client) GetFriendList() ([]*WxUserInfo, error) {
 	if err == nil {
 		for _, c := range openIMContacts {
 			if !strings.HasSuffix(c[0], "@chatroom") {
-				info := &WxUserInfo{
-					ID:        c[0],
-					Nickname:  c[1],
-					BigAvatar: c[2],
-					Remark:    c[4],
-				}
-				if len(info.BigAvatar) == 0 {
-					info.BigAvatar = c[3]
-				}
-
-				friends = append(friends, info)
+				friends = append(friends, contactToUserInfo(c))
 			}
 		}
 	}
@@ -435,9 +773,29 @@ func (c *Client) GetFriendList() ([]*WxUserInfo, error) {
 	return friends, nil
 }
 
+func (c *Client) GetOfficialAccountList() ([]*WxUserInfo, error) {
+	if err := c.checkLogin(); err != nil {
+		return nil, err
+	}
+
+	contacts, err := c.GetContacts()
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []*WxUserInfo
+	for _, c := range contacts {
+		if getContactCategory(c) == common.ContactOfficial {
+			accounts = append(accounts, contactToUserInfo(c))
+		}
+	}
+
+	return accounts, nil
+}
+
 func (c *Client) GetGroupList() ([]*WxGroupInfo, error) {
-	if !c.IsLogin() {
-		return nil, fmt.Errorf("user not logged")
+	if err := c.checkLogin(); err != nil {
+		return nil, err
 	}
 
 	contacts, err := c.GetContacts()
@@ -465,8 +823,8 @@ func (c *Client) GetGroupList() ([]*WxGroupInfo, error) {
 }
 
 func (c *Client) GetVoice(msgID uint64) ([]byte, error) {
-	if !c.IsLogin() {
-		return nil, fmt.Errorf("user not logged")
+	if err := c.checkLogin(); err != nil {
+		return nil, err
 	}
 
 	var sql string
@@ -501,76 +859,277 @@ func (c *Client) GetVoice(msgID uint64) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(gjson.GetBytes(ret, "data.1.0").String())
 }
 
-func (c *Client) SendText(target string, content string) error {
+// latest favorites first
+func (c *Client) GetFavorites(limit int) ([]*common.FavoriteItem, error) {
+	if err := c.checkLogin(); err != nil {
+		return nil, err
+	}
+
+	handle, err := c.getDbHandleByName(DB_FAVORITE)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonSql, err := json.Marshal(map[string]interface{}{
+		"db_handle": handle,
+		"sql": fmt.Sprintf(`
+			SELECT CAST(LocalId AS TEXT), CAST(Type AS TEXT), CAST(UpdateTime AS TEXT), FromUser, XmlBuf
+			FROM FavItems
+			ORDER BY UpdateTime DESC
+			LIMIT %d
+		`, limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := post(
+		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_DATABASE_QUERY),
+		jsonSql,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []*common.FavoriteItem{}
+	if gjson.GetBytes(ret, "data.#").Int() <= 1 {
+		return items, nil
+	}
+
+	var result WxFavoriteResp
+	if err := decodeResult("get_favorites", ret, &result); err != nil {
+		return nil, err
+	}
+
+	for _, row := range result.Data[1:] {
+		if item := parseFavorite(row); item != nil {
+			items = append(items, item)
+		}
+	}
+
+	return items, nil
+}
+
+func (c *Client) GetMessageByID(msgID uint64) (*WechatMessage, error) {
+	if err := c.checkLogin(); err != nil {
+		return nil, err
+	}
+
+	sql := fmt.Sprintf(`
+		SELECT MsgSvrID, CreateTime, StrTalker, IsSender, Type, StrContent, BytesExtra
+		FROM MSG
+		WHERE MsgSvrID=%d
+	`, msgID)
+
+	// messages are split into MSG0.db, MSG1.db, ...
+	for i := 0; ; i++ {
+		handle, err := c.getDbHandleByName(fmt.Sprintf(DB_MSG, i))
+		if err != nil {
+			break
+		}
+
+		jsonSql, err := json.Marshal(map[string]interface{}{
+			"db_handle": handle,
+			"sql":       sql,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		ret, err := post(
+			fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_DATABASE_QUERY),
+			jsonSql,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if gjson.GetBytes(ret, "data.#").Int() <= 1 {
+			continue
+		}
+
+		msg := &WechatMessage{
+			PID:       int(c.pid),
+			MsgID:     msgID,
+			Timestamp: gjson.GetBytes(ret, "data.1.1").Int(),
+			Sender:    gjson.GetBytes(ret, "data.1.2").String(),
+			WxID:      gjson.GetBytes(ret, "data.1.2").String(),
+			IsSendMsg: int8(gjson.GetBytes(ret, "data.1.3").Int()),
+			MsgType:   int(gjson.GetBytes(ret, "data.1.4").Int()),
+			Message:   gjson.GetBytes(ret, "data.1.5").String(),
+		}
+
+		extra, err := base64.StdEncoding.DecodeString(gjson.GetBytes(ret, "data.1.6").String())
+		if err == nil {
+			info := parseBytesExtra(extra)
+			if sender, ok := info[EXTRA_SENDER]; ok && strings.HasSuffix(msg.Sender, "@chatroom") {
+				msg.WxID = sender
+			}
+			msg.Thumbnail = info[EXTRA_THUMBNAIL]
+			msg.FilePath = info[EXTRA_FILE_PATH]
+		}
+
+		return msg, nil
+	}
+
+	return nil, fmt.Errorf("%w: %d", ErrMessageNotFound, msgID)
+}
+
+func (c *Client) SendText(target string, content string) (uint64, error) {
 	data, err := json.Marshal(map[string]string{
 		"wxid": target,
 		"msg":  content,
 	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = post(
+	ret, err := post(
 		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_MSG_SEND_TEXT),
 		data,
 	)
+	if err != nil {
+		return 0, err
+	}
 
-	return err
+	return sendResult(ret)
 }
 
-func (c *Client) SendAtText(target string, content string, mentions []string) error {
+// robot prepends @nickname of mentions to content if autoNickname is set
+func (c *Client) SendAtText(target string, content string, mentions []string, autoNickname bool) (uint64, error) {
 	wxids := strings.Join(mentions, ",")
+	auto := 0
+	if autoNickname {
+		auto = 1
+	}
 	data, err := json.Marshal(map[string]interface{}{
 		"chatroom_id":   target,
 		"msg":           content,
 		"wxids":         wxids,
-		"auto_nickname": 0,
+		"auto_nickname": auto,
 	})
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = post(
+	ret, err := post(
 		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_MSG_SEND_AT),
 		data,
 	)
+	if err != nil {
+		return 0, err
+	}
 
-	return err
+	return sendResult(ret)
 }
 
-func (c *Client) SendImage(target string, path string) error {
+func (c *Client) SendImage(target string, path string) (uint64, error) {
 	data, err := json.Marshal(map[string]string{
 		"receiver": target,
 		"img_path": path,
 	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = post(
+	ret, err := post(
 		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_MSG_SEND_IMAGE),
 		data,
 	)
+	if err != nil {
+		return 0, err
+	}
 
-	return err
+	return sendResult(ret)
 }
 
-func (c *Client) SendFile(target string, path string) error {
+// send animated image as custom emoticon, robot uploads it to emoticon store by md5
+func (c *Client) SendEmoticon(target string, path string) (uint64, error) {
+	data, err := json.Marshal(map[string]string{
+		"wxid":     target,
+		"img_path": path,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ret, err := c.postOptional(WECHAT_MSG_SEND_EMOTION, data)
+	if err != nil {
+		return 0, err
+	}
+
+	return sendResult(ret)
+}
+
+func (c *Client) SendFile(target string, path string) (uint64, error) {
 	data, err := json.Marshal(map[string]string{
 		"receiver":  target,
 		"file_path": path,
 	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = post(
+	ret, err := post(
 		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_MSG_SEND_FILE),
 		data,
 	)
+	if err != nil {
+		return 0, err
+	}
+
+	return sendResult(ret)
+}
+
+// send a shareable link card
+func (c *Client) SendAppMessage(target string, app *common.AppData) (uint64, error) {
+	xml := fmt.Sprintf(
+		`<appmsg appid="" sdkver="0"><title>%s</title><des>%s</des><type>5</type><url>%s</url><thumburl>%s</thumburl></appmsg>`,
+		escapeXML(app.Title), escapeXML(app.Description), escapeXML(app.URL), escapeXML(app.Thumb),
+	)
+
+	data, err := json.Marshal(map[string]string{
+		"wxid":     target,
+		"xml":      xml,
+		"img_path": "",
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ret, err := post(
+		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_MSG_SEND_XML),
+		data,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return sendResult(ret)
+}
+
+// quote a message, referType is the type of quoted message, mentions are
+// wxids to notify in group
+func (c *Client) SendReply(target string, content string, reply *common.ReplyInfo, referType int, mentions []string) (uint64, error) {
+	data, err := json.Marshal(map[string]string{
+		"wxid":     target,
+		"xml":      buildReplyXML(target, content, reply, referType, mentions),
+		"img_path": "",
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ret, err := post(
+		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_MSG_SEND_XML),
+		data,
+	)
+	if err != nil {
+		return 0, err
+	}
 
-	return err
+	return sendResult(ret)
 }
 
 func (c *Client) ForwardMessage(target string, msgid uint64) error {
@@ -582,22 +1141,25 @@ func (c *Client) ForwardMessage(target string, msgid uint64) error {
 		return err
 	}
 
-	_, err = post(
+	ret, err := post(
 		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_MSG_FORWARD_MESSAGE),
 		data,
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return checkResult(ret)
 }
 
-func (c *Client) GetOpenIMContacts() ([][5]string, error) {
+func (c *Client) GetOpenIMContacts() ([][8]string, error) {
 	handle, err := c.getDbHandleByName(DB_OPENIM_CONTACT)
 	if err != nil {
 		return nil, err
 	}
 
 	sql := `
-		SELECT UserName, NickName, BigHeadImgUrl, SmallHeadImgUrl, Remark
+		SELECT UserName, NickName, BigHeadImgUrl, SmallHeadImgUrl, Remark, '', '3', '0'
 		FROM OpenIMContact
 	`
 
@@ -618,31 +1180,58 @@ func (c *Client) GetOpenIMContacts() ([][5]string, error) {
 	}
 
 	if gjson.GetBytes(ret, "data.#").Int() <= 1 {
-		return [][5]string{}, nil
+		return [][8]string{}, nil
 	}
 
 	var result WxContactResp
-	err = json.Unmarshal(ret, &result)
-	if err != nil || result.Result != "OK" {
-		log.Warnln("Failed to parse get contacts response", err)
+	if err := decodeResult("get_contacts", ret, &result); err != nil {
 		return nil, err
 	}
+	decodeContactNames(ret, result.Data)
 
 	return result.Data[1:], nil
 }
 
-func (c *Client) GetContacts() ([][5]string, error) {
+func (c *Client) GetContacts() ([][8]string, error) {
+	return c.queryContacts("")
+}
+
+func (c *Client) GetContactType(wxid string) (common.ContactType, error) {
+	if err := c.checkLogin(); err != nil {
+		return 0, err
+	}
+
+	if isSystemContact(wxid) {
+		return common.ContactSystem, nil
+	}
+	if strings.HasSuffix(wxid, "@openim") {
+		return common.ContactFriend, nil
+	}
+
+	contacts, err := c.queryContacts(fmt.Sprintf(`WHERE c.UserName=%s`, sqlString(wxid)))
+	if err != nil {
+		return 0, err
+	}
+	if len(contacts) == 0 {
+		return common.ContactStranger, nil
+	}
+
+	return getContactCategory(contacts[0]), nil
+}
+
+func (c *Client) queryContacts(where string) ([][8]string, error) {
 	handle, err := c.getDbHandleByName(DB_MICRO_MSG)
 	if err != nil {
 		return nil, err
 	}
 
 	sql := `
-		SELECT c.UserName, c.NickName, i.bigHeadImgUrl, i.smallHeadImgUrl, c.Remark
+		SELECT c.UserName, c.NickName, i.bigHeadImgUrl, i.smallHeadImgUrl, c.Remark, c.Alias,
+			CAST(c.Type AS TEXT), CAST(c.VerifyFlag AS TEXT)
 		FROM Contact AS c
 		LEFT JOIN ContactHeadImgUrl AS i
 			ON c.UserName = i.usrName
-	`
+	` + where
 
 	jsonSql, err := json.Marshal(map[string]interface{}{
 		"db_handle": handle,
@@ -661,22 +1250,21 @@ func (c *Client) GetContacts() ([][5]string, error) {
 	}
 
 	if gjson.GetBytes(ret, "data.#").Int() <= 1 {
-		return [][5]string{}, nil
+		return [][8]string{}, nil
 	}
 
 	var result WxContactResp
-	err = json.Unmarshal(ret, &result)
-	if err != nil || result.Result != "OK" {
-		log.Warnln("Failed to parse get contacts response", err)
+	if err := decodeResult("get_contacts", ret, &result); err != nil {
 		return nil, err
 	}
+	decodeContactNames(ret, result.Data)
 
 	return result.Data[1:], nil
 }
 
 func (c *Client) getDbHandleByName(name string) (int64, error) {
-	if !c.IsLogin() {
-		return 0, fmt.Errorf("user not logged")
+	if err := c.checkLogin(); err != nil {
+		return 0, err
 	}
 
 	ret, err := post(
@@ -697,18 +1285,143 @@ func (c *Client) getDbHandleByName(name string) (int64, error) {
 	}
 }
 
+// failure messages of robot API mapped to typed errors, matched exactly,
+// anything else is reported verbatim. The Chinese messages are those
+// ComWeChatRobot relays from WeChat 3.7.0.30 (the version in README),
+// recheck them when supporting a new WeChat version
+var resultErrors = map[string]error{
+	"not friend":   ErrNotFriend,
+	"不是好友":         ErrNotFriend,
+	"muted":        ErrMutedGroup,
+	"全员禁言":         ErrMutedGroup,
+	"rate limited": ErrRateLimited,
+	"操作过于频繁，请稍后再试": ErrRateLimited,
+}
+
+// check the result of robot API, logical failures are reported in body
+func checkResult(body []byte) error {
+	result := gjson.GetBytes(body, "result")
+	if !result.Exists() || len(result.String()) == 0 {
+		return fmt.Errorf("robot returns no result: %s", snippet(body))
+	} else if result.String() == "OK" {
+		return nil
+	}
+
+	msg := gjson.GetBytes(body, "msg").String()
+	if err, ok := resultErrors[strings.TrimSpace(msg)]; ok {
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+
+	return fmt.Errorf("robot returns %s: %s", result.String(), msg)
+}
+
+// some robot versions echo the new msgid in send response, 0 if absent
+func sendResult(body []byte) (uint64, error) {
+	if err := checkResult(body); err != nil {
+		return 0, err
+	}
+
+	return gjson.GetBytes(body, "msgid").Uint(), nil
+}
+
+// quote caller input as SQL string literal, robot only takes raw SQL
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// whether the failure may go away by retrying later
+func isTransient(err error) bool {
+	return errors.Is(err, ErrRobotUnavailable) || errors.Is(err, ErrClientNotFound)
+}
+
+func containsAny(s string, substrs ...string) bool {
+	s = strings.ToLower(s)
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ping checks the robot is responsive and reports the login status
+func (c *Client) Ping(timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ret, err := postContext(
+		ctx,
+		fmt.Sprintf(CLIENT_API_URL, c.port, WECHAT_IS_LOGIN),
+		[]byte("{}"),
+	)
+	if err != nil {
+		return false, err
+	}
+	if err := checkResult(ret); err != nil {
+		return false, err
+	}
+
+	return gjson.GetBytes(ret, "is_login").Int() == 1, nil
+}
+
 func post(url string, data []byte) ([]byte, error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	return postContext(context.Background(), url, data)
+}
+
+func postContext(ctx context.Context, url string, data []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := robotClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrRobotUnavailable, err)
 	}
 	defer resp.Body.Close()
 
-	return io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, fmt.Errorf("%w: HTTP %d: %s", ErrRobotUnavailable, resp.StatusCode, snippet(body))
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, fmt.Errorf("robot returns HTTP %d: %s", resp.StatusCode, snippet(body))
+	case len(bytes.TrimSpace(body)) == 0:
+		return nil, ErrEmptyResponse
+	}
+
+	return body, nil
+}
+
+// decode robot response, a non-JSON body (e.g. HTML error page) is reported with a snippet
+func decodeResult(api string, body []byte, v any) error {
+	if !gjson.ValidBytes(body) {
+		return fmt.Errorf("invalid %s response: %s", api, snippet(body))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid %s response: %v: %s", api, err, snippet(body))
+	}
+	return checkResult(body)
+}
+
+// encoding/json replaces invalid UTF-8, so names are taken from the raw body
+func decodeContactNames(body []byte, contacts [][8]string) {
+	for i := range contacts {
+		row := gjson.GetBytes(body, fmt.Sprintf("data.%d", i))
+		contacts[i][1] = decodeName(row.Get("1").String())
+		contacts[i][4] = decodeName(row.Get("4").String())
+	}
+}
+
+func snippet(body []byte) string {
+	const maxLen = 200
+
+	text := strings.Join(strings.Fields(string(body)), " ")
+	if runes := []rune(text); len(runes) > maxLen {
+		return string(runes[:maxLen]) + "..."
+	}
+	return text
 }
@@ -0,0 +1,505 @@
+package wechat
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/duo/matrix-wechat-agent/internal/common"
+
+	"github.com/tidwall/gjson"
+)
+
+// newFakeRobot serves the robot HTTP API, login and database handles are
+// answered here, everything else by handle. nil means an empty OK result.
+func newFakeRobot(t *testing.T, handle func(api int, body []byte) any) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api, _ := strconv.Atoi(r.URL.Query().Get("type"))
+		body, _ := io.ReadAll(r.Body)
+
+		var resp any
+		switch api {
+		case WECHAT_IS_LOGIN:
+			resp = map[string]any{"result": "OK", "is_login": 1}
+		case WECHAT_DATABASE_GET_HANDLES:
+			resp = map[string]any{
+				"result": "OK",
+				"data": []map[string]any{
+					{"db_name": DB_MICRO_MSG, "handle": 1},
+					{"db_name": DB_OPENIM_CONTACT, "handle": 2},
+					{"db_name": DB_MEDIA_MSG, "handle": 3},
+					{"db_name": fmt.Sprintf(DB_MSG, 0), "handle": 4},
+				},
+			}
+		default:
+			if handle != nil {
+				resp = handle(api, body)
+			}
+			if resp == nil {
+				resp = map[string]any{"result": "OK"}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	return &Client{port: int32(port)}
+}
+
+// rows of a database query, header row is prepended
+func queryResult(rows ...[]string) map[string]any {
+	return map[string]any{"result": "OK", "data": append([][]string{{"header"}}, rows...)}
+}
+
+func TestCheckResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+		is      error
+	}{
+		{"ok", `{"result":"OK","msg":1}`, false, nil},
+		{"empty result", `{"result":"","msg":"success"}`, true, nil},
+		{"missing result", `{"msg":"success"}`, true, nil},
+		{"not json", `<html>502 Bad Gateway</html>`, true, nil},
+		{"error", `{"result":"ERROR","msg":"unknown failure"}`, true, nil},
+		{"不是好友", `{"result":"ERROR","msg":"不是好友"}`, true, ErrNotFriend},
+		{"not friend", `{"result":"ERROR","msg":"not friend"}`, true, ErrNotFriend},
+		{"全员禁言", `{"result":"ERROR","msg":"全员禁言"}`, true, ErrMutedGroup},
+		{"muted", `{"result":"ERROR","msg":"muted"}`, true, ErrMutedGroup},
+		{"操作过于频繁", `{"result":"ERROR","msg":"操作过于频繁，请稍后再试"}`, true, ErrRateLimited},
+		{"rate limited", `{"result":"ERROR","msg":"rate limited"}`, true, ErrRateLimited},
+		{"padded", `{"result":"ERROR","msg":" 不是好友\n"}`, true, ErrNotFriend},
+		{"friend in unrelated message", `{"result":"ERROR","msg":"not friend of the group owner"}`, true, nil},
+		{"limit in unrelated message", `{"result":"ERROR","msg":"file size exceeds limit"}`, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkResult([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkResult() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, typed := range []error{ErrNotFriend, ErrMutedGroup, ErrRateLimited} {
+				if got := errors.Is(err, typed); got != (typed == tt.is) {
+					t.Errorf("errors.Is(%v, %v) = %v", err, typed, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGetUserInfoPrefersUserName(t *testing.T) {
+	var queries []string
+	contacts := [][]string{
+		{"wxid_alice", "Alice", "", "", "", "bob"},
+		{"bob", "Bob", "", "", "", "bob_2022"},
+	}
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		if api != WECHAT_DATABASE_QUERY {
+			return nil
+		}
+		sql := gjson.GetBytes(body, "sql").String()
+		queries = append(queries, sql)
+
+		var rows [][]string
+		for _, c := range contacts {
+			if strings.Contains(sql, "c.UserName="+sqlString(c[0])) || strings.Contains(sql, "c.Alias="+sqlString(c[5])) {
+				rows = append(rows, c)
+			}
+		}
+		return queryResult(rows...)
+	})
+
+	tests := []struct {
+		wxid    string
+		want    string
+		queries int
+	}{
+		// alias of Alice equals the name of Bob
+		{"bob", "Bob", 1},
+		{"bob_2022", "Bob", 2},
+		{"wxid_alice", "Alice", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wxid, func(t *testing.T) {
+			queries = nil
+			info, err := client.GetUserInfo(tt.wxid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Nickname != tt.want {
+				t.Errorf("GetUserInfo(%s) = %s, want %s", tt.wxid, info.Nickname, tt.want)
+			}
+			if len(queries) != tt.queries {
+				t.Errorf("%d queries, want %d", len(queries), tt.queries)
+			}
+		})
+	}
+
+	if _, err := client.GetUserInfo("nobody"); common.GetErrorCode(err) != common.CodeNotFound {
+		t.Errorf("GetUserInfo() of unknown user error = %v, want not found", err)
+	}
+}
+
+func TestGetUserInfoEscapesInput(t *testing.T) {
+	var sql string
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		if api == WECHAT_DATABASE_QUERY {
+			sql = gjson.GetBytes(body, "sql").String()
+		}
+		return queryResult()
+	})
+
+	client.GetUserInfo(`x' OR '1'='1`)
+	if !strings.Contains(sql, `c.Alias='x'' OR ''1''=''1'`) {
+		t.Errorf("input not escaped in %s", sql)
+	}
+}
+
+func TestGetContactType(t *testing.T) {
+	// UserName, NickName, big and small avatar, Remark, Alias, Type, VerifyFlag
+	contacts := [][]string{
+		{"wxid_friend", "Friend", "", "", "", "", "3", "0"},
+		{"wxid_stranger", "Stranger", "", "", "", "", "0", "0"},
+		{"wxid_blocked", "Blocked", "", "", "", "", "11", "0"},
+		{"gh_3dfda90e39d6", "Official", "", "", "", "", "3", "24"},
+	}
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		if api != WECHAT_DATABASE_QUERY {
+			return nil
+		}
+		sql := gjson.GetBytes(body, "sql").String()
+		for _, c := range contacts {
+			if strings.Contains(sql, "c.UserName="+sqlString(c[0])) {
+				return queryResult(c)
+			}
+		}
+		return queryResult()
+	})
+
+	tests := []struct {
+		wxid string
+		want common.ContactType
+	}{
+		{"wxid_friend", common.ContactFriend},
+		{"wxid_stranger", common.ContactStranger},
+		{"wxid_unknown", common.ContactStranger},
+		{"wxid_blocked", common.ContactBlocked},
+		{"gh_3dfda90e39d6", common.ContactOfficial},
+		{"filehelper", common.ContactSystem},
+		{"bob@openim", common.ContactFriend},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wxid, func(t *testing.T) {
+			got, err := client.GetContactType(tt.wxid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("GetContactType(%s) = %v, want %v", tt.wxid, got, tt.want)
+			}
+		})
+	}
+}
+
+// length-delimited protobuf field
+func protoBytes(num int, data []byte) []byte {
+	field := binary.AppendUvarint(nil, uint64(num<<3|2))
+	field = binary.AppendUvarint(field, uint64(len(data)))
+	return append(field, data...)
+}
+
+// ChatRoom.RoomData with member state (field 3) the agent doesn't use
+func roomData(members ...[2]string) []byte {
+	var data []byte
+	for _, m := range members {
+		member := protoBytes(1, []byte(m[0]))
+		if len(m[1]) > 0 {
+			member = append(member, protoBytes(2, []byte(m[1]))...)
+		}
+		member = append(member, 3<<3, 0)
+		data = append(data, protoBytes(1, member)...)
+	}
+	return append(data, 5<<3, 0xf4, 0x03)
+}
+
+func TestParseRoomData(t *testing.T) {
+	data := roomData([2]string{"wxid_alice", "群主"}, [2]string{"wxid_bob", ""}, [2]string{"wxid_carol", "Carol 🐱"})
+	want := map[string]string{"wxid_alice": "群主", "wxid_carol": "Carol 🐱"}
+	if got := parseRoomData(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRoomData() = %v, want %v", got, want)
+	}
+	if got := parseRoomData([]byte{0x0a, 0xff}); len(got) != 0 {
+		t.Errorf("parseRoomData() of truncated data = %v, want empty", got)
+	}
+}
+
+func TestGetChatroomMemberDetail(t *testing.T) {
+	data := base64.StdEncoding.EncodeToString(roomData([2]string{"wxid_alice", "群主"}, [2]string{"wxid_bob", ""}))
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		if api != WECHAT_DATABASE_QUERY {
+			return nil
+		}
+		if strings.Contains(gjson.GetBytes(body, "sql").String(), "ChatRoomName='24503927881@chatroom'") {
+			return queryResult([]string{"wxid_alice^Gwxid_bob^G", "wxid_alice", data})
+		}
+		return queryResult()
+	})
+
+	members, err := client.GetChatroomMemberDetail("24503927881@chatroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*common.GroupMember{
+		{ID: "wxid_alice", DisplayName: "群主", IsOwner: true},
+		{ID: "wxid_bob"},
+	}
+	if !reflect.DeepEqual(members, want) {
+		t.Errorf("GetChatroomMemberDetail() = %+v, want %+v", members, want)
+	}
+
+	if _, err := client.GetChatroomMemberDetail("404@chatroom"); common.GetErrorCode(err) != common.CodeNotFound {
+		t.Errorf("GetChatroomMemberDetail() of unknown group error = %v, want not found", err)
+	}
+}
+
+func TestSendResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    map[string]any
+		want    uint64
+		wantErr bool
+	}{
+		{"msgid", map[string]any{"result": "OK", "msgid": uint64(6846829281516485302)}, 6846829281516485302, false},
+		{"msgid as string", map[string]any{"result": "OK", "msgid": "6846829281516485302"}, 6846829281516485302, false},
+		{"without msgid", map[string]any{"result": "OK"}, 0, false},
+		{"failed", map[string]any{"result": "ERROR", "msg": "unknown failure", "msgid": 1}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeRobot(t, func(api int, body []byte) any {
+				if api == WECHAT_MSG_SEND_TEXT {
+					return tt.resp
+				}
+				return nil
+			})
+
+			got, err := client.SendText("wxid_bob", "hi")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SendText() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("SendText() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// robot answering every API with the given status and raw body
+func newRawRobot(t *testing.T, status int, body string) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	return &Client{port: int32(server.Listener.Addr().(*net.TCPAddr).Port)}
+}
+
+func TestDecodeResultSnippet(t *testing.T) {
+	long := "<html><body>" + strings.Repeat("a", 300) + "</body></html>"
+
+	tests := []struct {
+		name   string
+		body   string
+		prefix string
+		suffix string
+	}{
+		{"html", "<html>\n  <head><title>502 Bad Gateway</title></head>\n</html>", "invalid is_login response: ", "<html> <head><title>502 Bad Gateway</title></head> </html>"},
+		{"truncated", long, "invalid is_login response: ", long[:200] + "..."},
+		{"wrong type", `{"result":"OK","is_login":"yes"}`, "invalid is_login response: json: ", `{"result":"OK","is_login":"yes"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newRawRobot(t, http.StatusOK, tt.body).checkLogin()
+			if err == nil || !strings.HasPrefix(err.Error(), tt.prefix) || !strings.HasSuffix(err.Error(), ": "+tt.suffix) {
+				t.Errorf("checkLogin() error = %v, want %s...%s", err, tt.prefix, tt.suffix)
+			}
+		})
+	}
+}
+
+func TestPostClassifiesResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantErr     error
+		transient   bool
+		wantSnippet string
+	}{
+		{"ok", http.StatusOK, `{"result":"OK"}`, nil, false, ""},
+		{"server error", http.StatusBadGateway, "<html>502 Bad Gateway</html>", ErrRobotUnavailable, true, "<html>502 Bad Gateway</html>"},
+		{"client error", http.StatusNotFound, "no such api", nil, false, "no such api"},
+		{"empty", http.StatusOK, "", ErrEmptyResponse, false, ""},
+		{"blank", http.StatusOK, " \r\n", ErrEmptyResponse, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newRawRobot(t, tt.status, tt.body)
+			body, err := post(fmt.Sprintf(CLIENT_API_URL, client.port, WECHAT_IS_LOGIN), []byte("{}"))
+
+			if tt.status == http.StatusOK && tt.wantErr == nil {
+				if err != nil || string(body) != tt.body {
+					t.Fatalf("post() = %q, %v, want %q", body, err, tt.body)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("post() = %q, want error", body)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("post() error = %v, want %v", err, tt.wantErr)
+			}
+			if isTransient(err) != tt.transient {
+				t.Errorf("isTransient(%v) = %v, want %v", err, !tt.transient, tt.transient)
+			}
+			if !strings.Contains(err.Error(), tt.wantSnippet) {
+				t.Errorf("post() error = %v, want body %q", err, tt.wantSnippet)
+			}
+		})
+	}
+}
+
+func TestGetChatroomName(t *testing.T) {
+	var queries int
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		if api != WECHAT_DATABASE_QUERY {
+			return nil
+		}
+		queries++
+		sql := gjson.GetBytes(body, "sql").String()
+		switch {
+		case strings.Contains(sql, "UserName='24503927881@chatroom'"):
+			return queryResult([]string{"Gophers 🐹"})
+		case strings.Contains(sql, "UserName='18800000000@chatroom'"):
+			// group never renamed
+			return queryResult([]string{""})
+		}
+		return queryResult()
+	})
+
+	tests := []struct {
+		chatroom string
+		want     string
+		code     common.ErrorCode
+	}{
+		{"24503927881@chatroom", "Gophers 🐹", ""},
+		{"18800000000@chatroom", "", ""},
+		{"404@chatroom", "", common.CodeNotFound},
+		{"x' OR '1'='1", "", common.CodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.chatroom, func(t *testing.T) {
+			queries = 0
+			got, err := client.GetChatroomName(tt.chatroom)
+			if len(tt.code) > 0 {
+				if common.GetErrorCode(err) != tt.code {
+					t.Fatalf("GetChatroomName() error = %v, want %s", err, tt.code)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("GetChatroomName() = %q, want %q", got, tt.want)
+			}
+			// only the name is looked up, not the member list
+			if queries != 1 {
+				t.Errorf("%d queries, want 1", queries)
+			}
+		})
+	}
+}
+
+func TestGetChatroomMemberNicknames(t *testing.T) {
+	data := base64.StdEncoding.EncodeToString(roomData([2]string{"wxid_alice", "群主"}, [2]string{"wxid_bob", ""}))
+	tests := []struct {
+		name      string
+		dbDown    bool
+		wxids     []string
+		want      map[string]string
+		code      common.ErrorCode
+		contactIN string
+		fallbacks int
+	}{
+		{"display names only", false, []string{"wxid_alice"}, map[string]string{"wxid_alice": "群主"}, "", "", 0},
+		{"nicknames in one query", false, []string{"wxid_alice", "wxid_bob", "wxid_carol"},
+			map[string]string{"wxid_alice": "群主", "wxid_bob": "Bob", "wxid_carol": "Carol"}, "", "'wxid_bob','wxid_carol'", 0},
+		{"unknown group", false, []string{"wxid_alice"}, nil, common.CodeNotFound, "", 0},
+		{"database unavailable", true, []string{"wxid_alice", "wxid_bob"},
+			map[string]string{"wxid_alice": "nick:wxid_alice", "wxid_bob": "nick:wxid_bob"}, "", "", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var contactIN string
+			var fallbacks int
+			client := newFakeRobot(t, func(api int, body []byte) any {
+				switch api {
+				case WECHAT_CHATROOM_GET_MEMBER_NICKNAME:
+					fallbacks++
+					return map[string]any{"result": "OK", "nickname": "nick:" + gjson.GetBytes(body, "wxid").String()}
+				case WECHAT_DATABASE_QUERY:
+					if tt.dbDown {
+						return map[string]any{"result": "ERROR", "msg": "database is locked"}
+					}
+					sql := gjson.GetBytes(body, "sql").String()
+					if strings.HasPrefix(sql, "SELECT RoomData") {
+						if tt.code == common.CodeNotFound {
+							return queryResult()
+						}
+						return queryResult([]string{data})
+					}
+					contactIN = sql[strings.Index(sql, "(")+1 : strings.LastIndex(sql, ")")]
+					return queryResult([]string{"wxid_bob", "Bob"}, []string{"wxid_carol", "Carol"})
+				}
+				return nil
+			})
+
+			got, err := client.GetChatroomMemberNicknames("24503927881@chatroom", tt.wxids)
+			if len(tt.code) > 0 {
+				if common.GetErrorCode(err) != tt.code {
+					t.Fatalf("GetChatroomMemberNicknames() error = %v, want %s", err, tt.code)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetChatroomMemberNicknames() = %v, want %v", got, tt.want)
+			}
+			if contactIN != tt.contactIN {
+				t.Errorf("contact lookup of (%s), want (%s)", contactIN, tt.contactIN)
+			}
+			if fallbacks != tt.fallbacks {
+				t.Errorf("%d per-member lookups, want %d", fallbacks, tt.fallbacks)
+			}
+		})
+	}
+}
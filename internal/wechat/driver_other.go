@@ -0,0 +1,35 @@
+//go:build !windows
+
+package wechat
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/duo/matrix-wechat-agent/internal/common"
+)
+
+// only mock mode works off Windows
+var ErrUnsupportedPlatform = errors.New("unsupported platform, WeChat driver requires Windows")
+
+type driver struct{}
+
+func LoadDriver(config *common.Configure) (func(), error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func newDriver(config *common.Configure) (*driver, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func (d *driver) NewWechat() (uintptr, error) {
+	return 0, ErrUnsupportedPlatform
+}
+
+func (d *driver) StartListen(pid uintptr, port int32) error {
+	return ErrUnsupportedPlatform
+}
+
+func getWechatDocdir() string {
+	return filepath.Join(getDocDir(), "WeChat Files")
+}
@@ -0,0 +1,113 @@
+//go:build windows
+
+package wechat
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/duo/matrix-wechat-agent/internal/common"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/registry"
+)
+
+// functions exported by wxDriver DLL
+type driver struct {
+	newWechat   uintptr
+	startListen uintptr
+	stopListen  uintptr
+}
+
+// LoadDriver keeps the driver DLL loaded until the returned function is called.
+func LoadDriver(config *common.Configure) (func(), error) {
+	path, err := driverPath(config)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := syscall.LoadLibrary(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { syscall.FreeLibrary(handle) }, nil
+}
+
+func driverPath(config *common.Configure) (string, error) {
+	if path, ok := config.Wechat.Drivers[config.Wechat.Version]; ok {
+		if !pathExists(path) {
+			return "", fmt.Errorf("driver %s for WeChat %s not found", path, config.Wechat.Version)
+		}
+		return path, nil
+	} else if runtime.GOARCH == "amd64" {
+		return "wxDriver64.dll", nil
+	} else {
+		return "wxDriver.dll", nil
+	}
+}
+
+func newDriver(config *common.Configure) (*driver, error) {
+	path, err := driverPath(config)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := syscall.LoadLibrary(path)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.FreeLibrary(handle)
+
+	d := &driver{}
+	if d.newWechat, err = syscall.GetProcAddress(handle, "new_wechat"); err != nil {
+		return nil, err
+	}
+	if d.startListen, err = syscall.GetProcAddress(handle, "start_listen"); err != nil {
+		return nil, err
+	}
+	if d.stopListen, err = syscall.GetProcAddress(handle, "stop_listen"); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// NewWechat starts a WeChat process and returns its pid
+func (d *driver) NewWechat() (uintptr, error) {
+	pid, _, errno := syscall.SyscallN(d.newWechat)
+	if pid == 0 {
+		return 0, errno
+	}
+	if int(errno) != 0 {
+		log.Infoln(errno)
+	}
+
+	return pid, nil
+}
+
+// StartListen starts the robot HTTP API of the WeChat process on port
+func (d *driver) StartListen(pid uintptr, port int32) error {
+	_, _, errno := syscall.SyscallN(d.startListen, pid, uintptr(port))
+	if int(errno) != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func getWechatDocdir() string {
+	baseDir := getDocDir()
+
+	regKey, err := registry.OpenKey(registry.CURRENT_USER, "SOFTWARE\\Tencent\\WeChat", registry.QUERY_VALUE)
+	if err == nil {
+		path, _, err := regKey.GetStringValue("FileSavePath")
+		if err == nil && path != "MyDocument:" && path != "" {
+			baseDir = path
+		}
+	}
+
+	return filepath.Join(baseDir, "WeChat Files")
+}
@@ -0,0 +1,85 @@
+package wechat
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// files touched recently may still be written by WeChat or read by agent
+const janitorGracePeriod = 10 * time.Minute
+
+type workdirFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// prune media in workdir periodically
+func (m *Manager) Janitor() {
+	config := m.config.Wechat.Retention
+	if config.Interval <= 0 || (config.MaxAge <= 0 && config.MaxSize <= 0) {
+		return
+	}
+
+	for range time.Tick(config.Interval) {
+		pruneWorkdir(m.config.Wechat.Workdir, config.MaxAge, config.MaxSize*1024*1024)
+	}
+}
+
+// remove files older than maxAge, then oldest ones until total size is under maxSize
+func pruneWorkdir(dir string, maxAge time.Duration, maxSize int64) {
+	var files []*workdirFile
+	var total int64
+
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		// agent state, not media
+		if filepath.Dir(path) == dir && (d.Name() == SESSION_FILE || d.Name() == OUTBOX_FILE) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, &workdirFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	var removed int
+	for _, f := range files {
+		age := time.Since(f.modTime)
+		if age < janitorGracePeriod {
+			break
+		}
+
+		expired := maxAge > 0 && age > maxAge
+		oversize := maxSize > 0 && total > maxSize
+		if !expired && !oversize {
+			break
+		}
+
+		if err := removeFile(f.path); err != nil {
+			log.Warnf("Failed to remove %s: %v", f.path, err)
+			continue
+		}
+		total -= f.size
+		removed++
+	}
+
+	if removed > 0 {
+		log.Infof("Removed %d files from workdir, %d bytes left", removed, total)
+	}
+}
@@ -4,125 +4,413 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
-	"sync/atomic"
-	"syscall"
 	"time"
 
 	"github.com/duo/matrix-wechat-agent/internal/common"
 
 	"github.com/shirou/gopsutil/v3/process"
+	"github.com/tidwall/tinylru"
 
 	log "github.com/sirupsen/logrus"
 )
 
+var versionRegex = regexp.MustCompile(`^\d+\.\d+\.\d+\.\d+$`)
+
+// base delay of retrying accept, doubled on each failure in a row
+var acceptBackoff = 10 * time.Millisecond
+
+// delay between attempts of setting version
+var setVersionDelay = 1 * time.Second
+
+type cachedMembers struct {
+	members []*common.GroupMember
+	at      time.Time
+}
+
+const (
+	memberCacheTTL    = 5 * time.Minute
+	maxAcceptFailures = 10
+	maxPingFailures   = 3
+	syncConcurrency   = 4
+)
+
+// spawns WeChat and injects robot, implemented by driver of the platform
+type wechatDriver interface {
+	NewWechat() (uintptr, error)
+	StartListen(pid uintptr, port int32) error
+}
+
 type Manager struct {
 	config *common.Configure
 
-	funcNewWechat   uintptr
-	funcStartListen uintptr
-	funcStopListen  uintptr
+	driver wechatDriver
 
-	portSeq int32
+	store MediaStore
 
 	pids        map[int]string
 	clients     map[string]*Client
 	clientsLock sync.Mutex
 
-	mutex       common.KeyMutex
-	processFunc func(string, *WechatMessage)
+	sessions map[string]*session
+	// accounts being connected, with the robot port reserved for them
+	connecting map[string]int32
+
+	labels sync.Map
+
+	members tinylru.LRU
+
+	listener net.Listener
+
+	outbox *outbox
+
+	mutex        common.KeyMutex
+	processFunc  func(string, *WechatMessage)
+	pushFunc     func(string, *common.Event)
+	downloadFunc func(context.Context, string, *WechatMessage) *common.BlobData
 }
 
-func NewManager(config *common.Configure, f func(string, *WechatMessage)) *Manager {
-	driver := LoadDriver()
-	defer syscall.FreeLibrary(driver)
+func NewManager(
+	config *common.Configure,
+	f func(string, *WechatMessage),
+	push func(string, *common.Event),
+	download func(context.Context, string, *WechatMessage) *common.BlobData,
+) *Manager {
+	var driver wechatDriver
+	if !config.Wechat.Mock {
+		d, err := newDriver(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		driver = d
+	} else {
+		log.Warnln("Mock mode is enabled, WeChat is not used")
+	}
 
-	newWechat, err := syscall.GetProcAddress(driver, "new_wechat")
+	store, err := NewMediaStore(config)
 	if err != nil {
 		log.Fatal(err)
 	}
-	startListen, err := syscall.GetProcAddress(driver, "start_listen")
-	if err != nil {
-		log.Fatal(err)
+	sweepOutgoing(filepath.Join(config.Wechat.Workdir, MEDIA_OUTGOING_DIR), config.Wechat.OutgoingMaxAge)
+
+	sessions := map[string]*session{}
+	if config.Wechat.RestoreSessions {
+		sessions = loadSessions(filepath.Join(config.Wechat.Workdir, SESSION_FILE))
 	}
-	stopListen, err := syscall.GetProcAddress(driver, "stop_listen")
-	if err != nil {
-		log.Fatal(err)
+
+	robotClient.Timeout = config.Wechat.RequestTimeout
+
+	var outbox *outbox
+	if config.Wechat.Outbox.Enabled {
+		outbox = newOutbox(filepath.Join(config.Wechat.Workdir, OUTBOX_FILE), store)
 	}
 
 	return &Manager{
-		config:          config,
-		funcNewWechat:   newWechat,
-		funcStartListen: startListen,
-		funcStopListen:  stopListen,
-		portSeq:         config.Wechat.ListenPort,
-		pids:            make(map[int]string),
-		clients:         make(map[string]*Client),
-		mutex:           common.NewHashed(47),
-		processFunc:     f,
+		config:       config,
+		driver:       driver,
+		store:        store,
+		pids:         make(map[int]string),
+		clients:      make(map[string]*Client),
+		sessions:     sessions,
+		connecting:   make(map[string]int32),
+		mutex:        common.NewHashed(47),
+		outbox:       outbox,
+		processFunc:  f,
+		pushFunc:     push,
+		downloadFunc: download,
 	}
 }
 
+// the lock is only held to reserve and publish the client, talking to robot
+// may take long and shouldn't block other accounts
 func (m *Manager) Connect(mxid string, path string) error {
-	m.clientsLock.Lock()
-	defer m.clientsLock.Unlock()
+	if !versionRegex.MatchString(m.config.Wechat.Version) {
+		return fmt.Errorf("invalid wechat version %q, expect x.y.z.w", m.config.Wechat.Version)
+	}
 
-	client, ok := m.clients[mxid]
-	if ok && client.IsAlive() {
+	m.clientsLock.Lock()
+	if client, ok := m.clients[mxid]; ok && client.IsAlive() {
+		m.clientsLock.Unlock()
 		return nil
 	}
+	if _, ok := m.connecting[mxid]; ok {
+		m.clientsLock.Unlock()
+		return fmt.Errorf("%s is already connecting", mxid)
+	}
+	if max := m.config.Wechat.MaxClients; max > 0 && m.countAlive(mxid) >= max {
+		m.clientsLock.Unlock()
+		return fmt.Errorf("%w: %d", ErrMaxClients, max)
+	}
+	s, restore := m.sessions[mxid]
+	if restore {
+		delete(m.sessions, mxid)
+		m.connecting[mxid] = s.Port
+	} else {
+		m.connecting[mxid] = 0
+	}
+	m.clientsLock.Unlock()
+
+	defer func() {
+		m.clientsLock.Lock()
+		delete(m.connecting, mxid)
+		m.clientsLock.Unlock()
+	}()
+
+	if restore {
+		if client, err := m.reattach(mxid, s, path); err == nil {
+			m.register(mxid, client)
+			m.logger(mxid).Infof("Re-attached WeChat (pid %d, login %v)", s.PID, client.wasLogin.Load())
+			return nil
+		} else {
+			m.logger(mxid).Infof("Failed to re-attach WeChat (pid %d): %v", s.PID, err)
+		}
+	}
 
-	client = &Client{
+	m.clientsLock.Lock()
+	port, err := m.allocPort()
+	if err == nil {
+		m.connecting[mxid] = port
+	}
+	m.clientsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	client := &Client{
 		listen: m.config.Wechat.ListenPort,
-		port:   atomic.AddInt32(&m.portSeq, 1),
+		port:   port,
 	}
-	pid, _, errno := syscall.SyscallN(m.funcNewWechat)
-	if pid == 0 {
-		return errno
+	if m.config.Wechat.Mock {
+		if err := m.connectMock(client); err != nil {
+			return err
+		}
+		m.register(mxid, client)
+		return nil
 	}
-	if int(errno) != 0 {
-		log.Infoln(errno)
+
+	pid, err := m.driver.NewWechat()
+	if err != nil {
+		return err
 	}
 	client.pid = pid
 
 	p, err := process.NewProcess(int32(pid))
 	if err != nil {
+		m.kill(mxid, client)
 		return fmt.Errorf("wechat process not exists: %w", err)
 	}
 	client.proc = p
 
-	_, _, errno = syscall.SyscallN(m.funcStartListen, pid, uintptr(client.port))
-	if int(errno) != 0 {
-		client.Dispose()
-		return errno
+	if err := m.driver.StartListen(pid, client.port); err != nil {
+		m.kill(mxid, client)
+		return err
 	}
 
-	m.pids[int(pid)] = mxid
-	m.clients[mxid] = client
-
 	ctx, cancel := context.WithTimeout(context.Background(), m.config.Wechat.InitTimeout)
 	defer cancel()
 
+	// never leave a half initialized WeChat behind
+	abort := func() {
+		if err := client.Dispose(); err != nil {
+			m.kill(mxid, client)
+		}
+	}
+
 	for {
 		err = client.HookMsg(path)
 		if err == nil {
-			if err := client.SetVersion(m.config.Wechat.Version); err != nil {
-				log.Warnln("Failed to set version", err)
-			} else {
-				log.Infoln("Set wechat version to", m.config.Wechat.Version)
-			}
-			return nil
+			break
 		}
 
 		select {
 		case <-time.After(1 * time.Second):
 		case <-ctx.Done():
+			abort()
 			return err
 		}
 	}
+
+	// outdated version may trigger forced update or even ban
+	if err := m.setVersion(mxid, client); err != nil {
+		abort()
+		return err
+	}
+
+	m.register(mxid, client)
+
+	return nil
+}
+
+// publish a ready client, so messages and requests are routed to it
+func (m *Manager) register(mxid string, client *Client) {
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+
+	m.pids[int(client.pid)] = mxid
+	m.clients[mxid] = client
+	m.saveSessions()
+}
+
+func (m *Manager) setVersion(mxid string, client *Client) error {
+	attempts := m.config.Wechat.SetVersionAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	var err error
+	for i := 1; i <= attempts; i++ {
+		if err = client.SetVersion(m.config.Wechat.Version); err == nil {
+			m.logger(mxid).Infoln("Set wechat version to", m.config.Wechat.Version)
+			return nil
+		}
+		m.logger(mxid).Warnf("Failed to set version (%d/%d): %v", i, attempts, err)
+		if i < attempts {
+			time.Sleep(setVersionDelay)
+		}
+	}
+
+	return fmt.Errorf("failed to set wechat version: %w", err)
+}
+
+// pid may be reused by OS before a dead client is cleaned up, so the wxid
+// of logged in user must match, messages are dropped while it is unknown
+func (m *Manager) ownsMessage(mxid string, msg *WechatMessage) bool {
+	client := m.GetClient(mxid)
+	if client == nil || client.pid != uintptr(msg.PID) {
+		return false
+	}
+
+	self := client.SelfID()
+	return len(self) > 0 && (len(msg.Self) == 0 || self == msg.Self)
+}
+
+// kill WeChat spawned by a failed connect, so no process is orphaned
+func (m *Manager) kill(mxid string, client *Client) {
+	if err := client.kill(); err != nil {
+		m.logger(mxid).Warnf("Failed to kill WeChat (pid %d): %v", client.pid, err)
+	}
+}
+
+// alive or connecting clients other than mxid, clientsLock must be held
+func (m *Manager) countAlive(mxid string) int {
+	count := 0
+	for id, client := range m.clients {
+		if _, ok := m.connecting[id]; !ok && id != mxid && client.IsAlive() {
+			count++
+		}
+	}
+	for id := range m.connecting {
+		if id != mxid {
+			count++
+		}
+	}
+	return count
+}
+
+// find a free port for robot, ports are released once client is removed
+func (m *Manager) allocPort() (int32, error) {
+	used := map[int32]bool{}
+	for _, client := range m.clients {
+		used[client.port] = true
+	}
+	// reserved for re-attaching
+	for _, s := range m.sessions {
+		used[s.Port] = true
+	}
+	for _, port := range m.connecting {
+		used[port] = true
+	}
+
+	for port := m.config.Wechat.ListenPort + 1; port <= m.config.Wechat.PortRangeEnd; port++ {
+		if used[port] {
+			continue
+		}
+		listen, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			continue
+		}
+		listen.Close()
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("no free ports in range %d-%d", m.config.Wechat.ListenPort+1, m.config.Wechat.PortRangeEnd)
+}
+
+// serve the client by an in-process mock robot instead of real WeChat
+func (m *Manager) connectMock(client *Client) error {
+	robot, err := startMockRobot(client.port, client.listen)
+	if err != nil {
+		return err
+	}
+	client.pid = robot.pid
+	client.mock = robot
+
+	return nil
+}
+
+// re-attach to a still running WeChat process from last run
+func (m *Manager) reattach(mxid string, s *session, path string) (*Client, error) {
+	p, err := process.NewProcess(int32(s.PID))
+	if err != nil {
+		return nil, err
+	}
+	if running, err := p.IsRunning(); err != nil || !running {
+		return nil, fmt.Errorf("wechat process not running")
+	}
+
+	client := &Client{
+		listen: m.config.Wechat.ListenPort,
+		port:   s.Port,
+		pid:    s.PID,
+		proc:   p,
+	}
+	isLogin, err := client.Ping(m.config.Wechat.InitTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client.wasLogin.Store(isLogin)
+	if err := client.HookMsg(path); err != nil {
+		return nil, err
+	}
+	// cache self for routing messages, fetched on demand if it fails
+	if isLogin {
+		if _, err := client.GetSelf(); err != nil {
+			m.logger(mxid).Debugf("Failed to get self info: %v", err)
+		}
+	}
+
+	return client, nil
+}
+
+func (m *Manager) saveSessions() {
+	if !m.config.Wechat.RestoreSessions {
+		return
+	}
+
+	// called with clientsLock held, so record last known login status
+	// instead of asking robots, which may block for long
+	sessions := map[string]*session{}
+	for mxid, client := range m.clients {
+		sessions[mxid] = &session{
+			PID:     client.pid,
+			Port:    client.port,
+			IsLogin: client.wasLogin.Load(),
+		}
+	}
+
+	path := filepath.Join(m.config.Wechat.Workdir, SESSION_FILE)
+	if err := saveSessions(path, sessions); err != nil {
+		log.Warnf("Failed to save sessions: %v", err)
+	}
 }
 
 func (m *Manager) Disconnet(mxid string) (err error) {
@@ -133,10 +421,51 @@ func (m *Manager) Disconnet(mxid string) (err error) {
 		err = client.Dispose()
 		delete(m.pids, int(client.pid))
 		delete(m.clients, mxid)
+		m.labels.Delete(mxid)
+		m.saveSessions()
 	}
 	return
 }
 
+// DisconnectAll disposes every client, returns how many were disconnected.
+func (m *Manager) DisconnectAll() int {
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+
+	count := 0
+	for mxid, client := range m.clients {
+		if err := client.Dispose(); err != nil {
+			m.logger(mxid).Warnf("Failed to dispose WeChat (pid %d): %v", client.pid, err)
+		} else {
+			m.logger(mxid).Infof("Disconnected WeChat (pid %d)", client.pid)
+		}
+		delete(m.pids, int(client.pid))
+		delete(m.clients, mxid)
+		m.labels.Delete(mxid)
+		count++
+	}
+	m.saveSessions()
+
+	return count
+}
+
+// LogoutOnly signs out but keeps WeChat running for the next QR login.
+func (m *Manager) LogoutOnly(mxid string) (any, error) {
+	return m.call(mxid, func(c *Client, v ...any) (any, error) {
+		if err := c.Logout(); err != nil {
+			return nil, err
+		}
+		c.loggedOut.Store(true)
+		return nil, nil
+	})
+}
+
+func (m *Manager) AcceptTransfer(mxid, wxid, transferID, transactionID string) (any, error) {
+	return m.call(mxid, func(c *Client, v ...any) (any, error) {
+		return nil, c.AcceptTransfer(v[0].(string), v[1].(string), v[2].(string))
+	}, wxid, transferID, transactionID)
+}
+
 func (m *Manager) LoginWtihQRCode(mxid string) (any, error) {
 	return m.call(mxid, func(c *Client, v ...any) (any, error) {
 		return c.LoginWtihQRCode()
@@ -152,7 +481,11 @@ func (m *Manager) IsLogin(mxid string) (any, error) {
 func (m *Manager) GetSelf(mxid string) (any, error) {
 	return m.call(mxid, func(c *Client, v ...any) (any, error) {
 		info, err := c.GetSelf()
-		return info.toUserInfo(), err
+		if err != nil {
+			return nil, err
+		}
+		m.setLabel(mxid, info)
+		return info.toUserInfo(), nil
 	})
 }
 
@@ -170,18 +503,36 @@ func (m *Manager) GetGroupInfo(mxid string, wxid string) (any, error) {
 	}, wxid)
 }
 
+func (m *Manager) GetGroupName(mxid string, wxid string) (any, error) {
+	return m.call(mxid, func(c *Client, v ...any) (any, error) {
+		return c.GetChatroomName(v[0].(string))
+	}, wxid)
+}
+
 func (m *Manager) GetGroupMembers(mxid string, wxid string) (any, error) {
 	return m.call(mxid, func(c *Client, v ...any) (any, error) {
 		return c.GetGroupMembers(v[0].(string))
 	}, wxid)
 }
 
+func (m *Manager) GetGroupMemberDetail(mxid string, wxid string) (any, error) {
+	return m.call(mxid, func(c *Client, v ...any) (any, error) {
+		return c.GetChatroomMemberDetail(v[0].(string))
+	}, wxid)
+}
+
 func (m *Manager) GetGroupMemberNickname(mxid, group, wxid string) (any, error) {
 	return m.call(mxid, func(c *Client, v ...any) (any, error) {
 		return c.GetGroupMemberNickname(v[0].(string), v[1].(string))
 	}, group, wxid)
 }
 
+func (m *Manager) GetGroupMemberNicknames(mxid, group string, wxids []string) (any, error) {
+	return m.call(mxid, func(c *Client, v ...any) (any, error) {
+		return c.GetChatroomMemberNicknames(v[0].(string), v[1].([]string))
+	}, group, wxids)
+}
+
 func (m *Manager) GetFriendList(mxid string) (any, error) {
 	return m.call(mxid, func(c *Client, v ...any) (any, error) {
 		friends := []*common.UserInfo{}
@@ -193,6 +544,23 @@ func (m *Manager) GetFriendList(mxid string) (any, error) {
 	})
 }
 
+func (m *Manager) GetOfficialAccountList(mxid string) (any, error) {
+	return m.call(mxid, func(c *Client, v ...any) (any, error) {
+		accounts := []*common.UserInfo{}
+		info, err := c.GetOfficialAccountList()
+		for _, i := range info {
+			accounts = append(accounts, i.toUserInfo())
+		}
+		return accounts, err
+	})
+}
+
+func (m *Manager) GetContactType(mxid string, wxid string) (any, error) {
+	return m.call(mxid, func(c *Client, v ...any) (any, error) {
+		return c.GetContactType(v[0].(string))
+	}, wxid)
+}
+
 func (m *Manager) GetGroupList(mxid string) (any, error) {
 	return m.call(mxid, func(c *Client, v ...any) (any, error) {
 		groups := []*common.GroupInfo{}
@@ -204,107 +572,746 @@ func (m *Manager) GetGroupList(mxid string) (any, error) {
 	})
 }
 
+// fetch friends, groups and group members at once
+func (m *Manager) SyncAll(mxid string) (any, error) {
+	return m.call(mxid, func(c *Client, v ...any) (any, error) {
+		data := &common.SyncData{
+			Friends: []*common.UserInfo{},
+			Groups:  []*common.GroupInfo{},
+		}
+
+		friends, err := c.GetFriendList()
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range friends {
+			data.Friends = append(data.Friends, i.toUserInfo())
+		}
+
+		groups, err := c.GetGroupList()
+		if err != nil {
+			return nil, err
+		}
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, syncConcurrency)
+		for _, i := range groups {
+			group := i.toGroupInfo()
+			data.Groups = append(data.Groups, group)
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				members, err := c.GetGroupMembers(group.ID)
+				if err != nil {
+					m.logger(mxid).Warnf("Failed to get members of group %s: %v", group.ID, err)
+					return
+				}
+				group.Members = members
+			}()
+		}
+		wg.Wait()
+
+		return data, nil
+	})
+}
+
+func (m *Manager) GetFavorites(mxid string, limit int) (any, error) {
+	return m.call(mxid, func(c *Client, v ...any) (any, error) {
+		return c.GetFavorites(v[0].(int))
+	}, limit)
+}
+
+func (m *Manager) GetMessage(mxid string, msgID uint64) (any, error) {
+	return m.call(mxid, func(c *Client, v ...any) (any, error) {
+		msg, err := c.GetMessageByID(v[0].(uint64))
+		return msg.toMessageInfo(), err
+	}, msgID)
+}
+
+// DownloadMedia fetches media of a historical message on demand
+func (m *Manager) DownloadMedia(ctx context.Context, mxid string, msgID uint64) (*common.BlobData, error) {
+	ret, err := m.call(mxid, func(c *Client, v ...any) (any, error) {
+		msg, err := c.GetMessageByID(v[0].(uint64))
+		if err != nil {
+			return nil, err
+		}
+		msg.Self = c.SelfID()
+
+		blob := m.downloadFunc(ctx, mxid, msg)
+		if blob == nil {
+			return nil, common.WithCode(common.CodeNotFound, fmt.Errorf("media of message %d not found", msgID))
+		}
+		return blob, nil
+	}, msgID)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret.(*common.BlobData), nil
+}
+
 func (m *Manager) SendMessage(mxid string, event *common.Event) (*common.Event, error) {
+	// keep the order of messages in the same chat
+	if m.outbox != nil && m.outbox.pending(mxid, event.Chat.ID) {
+		return m.enqueue(mxid, event), nil
+	}
+
+	msgID, err := m.send(mxid, event)
+	if err != nil && m.outbox != nil && isTransient(err) {
+		m.logger(mxid).Warnf("Failed to send message, queue it for retrying: %v", err)
+		return m.enqueue(mxid, event), nil
+	}
+
+	// fallback to timestamp if robot doesn't return the msgid
+	id := fmt.Sprint(time.Now().UnixMilli())
+	if msgID != 0 {
+		id = fmt.Sprint(msgID)
+	}
+
+	return &common.Event{
+		ID:        id,
+		Timestamp: time.Now().UnixMilli(),
+	}, err
+}
+
+// queued message gets the outbox id, real msgid is reported by delivery event
+func (m *Manager) enqueue(mxid string, event *common.Event) *common.Event {
+	return &common.Event{
+		ID:        m.outbox.push(mxid, event),
+		Timestamp: time.Now().UnixMilli(),
+	}
+}
+
+// retry queued messages until delivered or expired
+func (m *Manager) Deliver() {
+	if m.outbox == nil {
+		return
+	}
+
+	for range time.Tick(1 * time.Second) {
+		m.deliverDue(time.Now())
+	}
+}
+
+func (m *Manager) deliverDue(now time.Time) {
+	for _, item := range m.outbox.due(now) {
+		event, err := m.outbox.event(item)
+		if err != nil {
+			m.logger(item.MXID).Warnf("Failed to load media of queued message %s: %v", item.ID, err)
+			m.outbox.remove(item.ID)
+			m.pushFunc(item.MXID, newDeliveryEvent(item, 0, err))
+			continue
+		}
+
+		msgID, err := m.send(item.MXID, event)
+		if err == nil {
+			m.outbox.remove(item.ID)
+			m.pushFunc(item.MXID, newDeliveryEvent(item, msgID, nil))
+			continue
+		}
+
+		attempts := m.outbox.retry(item.ID)
+		if !isTransient(err) ||
+			attempts >= m.config.Wechat.Outbox.MaxAttempts ||
+			time.Since(item.Created) > m.config.Wechat.Outbox.TTL {
+			m.logger(item.MXID).Warnf("Failed to deliver queued message %s after %d attempts: %v", item.ID, attempts, err)
+			m.outbox.remove(item.ID)
+			m.pushFunc(item.MXID, newDeliveryEvent(item, 0, err))
+		}
+	}
+}
+
+func newDeliveryEvent(item *outboxItem, msgID uint64, err error) *common.Event {
+	delivery := &common.DeliveryData{RequestID: item.ID}
+	if msgID != 0 {
+		delivery.MsgID = fmt.Sprint(msgID)
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	return &common.Event{
+		ID:        fmt.Sprint(time.Now().UnixMilli()),
+		Timestamp: time.Now().UnixMilli(),
+		Chat:      item.Event.Chat,
+		Type:      common.EventDelivery,
+		Data:      delivery,
+	}
+}
+
+func newLogoutEvent(forced bool) *common.Event {
+	logout := &common.LogoutData{Forced: forced}
+	if forced {
+		logout.Reason = "WeChat session was terminated by server (kicked, banned or logged in elsewhere)"
+	} else {
+		logout.Reason = "WeChat session was logged out by user"
+	}
+
+	return &common.Event{
+		ID:        fmt.Sprint(time.Now().UnixMilli()),
+		Timestamp: time.Now().UnixMilli(),
+		Type:      common.EventLogout,
+		Content:   logout.Reason,
+		Data:      logout,
+	}
+}
+
+// robot stopped responding, the client is disconnected until bridge connects again
+func newStalledEvent() *common.Event {
+	event := newLogoutEvent(true)
+	logout := event.Data.(*common.LogoutData)
+	logout.Reason = "WeChat robot stopped responding and was disconnected"
+	event.Content = logout.Reason
+
+	return event
+}
+
+func (m *Manager) send(mxid string, event *common.Event) (uint64, error) {
 	m.clientsLock.Lock()
 	client, ok := m.clients[mxid]
 	m.clientsLock.Unlock()
 
 	if !ok {
-		return nil, fmt.Errorf("client not found")
+		return 0, ErrClientNotFound
 	}
 
+	var msgID uint64
 	var err error
+	// set once the event is handed to robot, failures before are the event's own
+	var sent bool
 	target := event.Chat.ID
+	if len(target) == 0 {
+		return 0, fmt.Errorf("no chat to send %s to", event.Type)
+	}
+	// WeChat can't send to oneself, notes go to file transfer helper
+	if target == client.SelfID() {
+		target = common.NotesToSelf
+	}
+
 	switch event.Type {
 	case common.EventText:
-		if len(event.Mentions) > 0 {
-			err = client.SendAtText(target, event.Content, event.Mentions)
-		} else {
-			err = client.SendText(target, event.Content)
+		sent = true
+		content := normalizeText(event.Content, m.config.Wechat.StripControlChars)
+		chunks := splitText(content, m.config.Wechat.MaxTextLength, m.config.Wechat.TruncateText)
+		for i, chunk := range chunks {
+			var id uint64
+			var mentions []string
+			if i == 0 {
+				mentions = event.Mentions
+			}
+			if i == 0 && event.Reply != nil && len(event.Reply.ID) > 0 {
+				id, err = m.sendReply(mxid, client, target, chunk, event.Reply, mentions)
+				if err != nil {
+					m.logger(mxid).Warnf("Failed to send reply, fallback to text: %v", err)
+					id, err = m.sendText(mxid, client, target, chunk, mentions)
+				}
+			} else {
+				id, err = m.sendText(mxid, client, target, chunk, mentions)
+			}
+			if err != nil {
+				break
+			}
+			if i == 0 {
+				msgID = id
+			}
 		}
 	case common.EventPhoto, common.EventSticker, common.EventVideo:
-		path := saveBlob(m.config.Wechat.Workdir, event)
-		if len(path) > 0 {
-			err = client.SendImage(target, path)
-		} else {
-			err = fmt.Errorf("failed to download media")
-		}
+		msgID, err = m.sendBlob(mxid, event, func(path string) (uint64, error) {
+			sent = true
+			// static image loses animation, older robot can't send emoticon
+			if event.Type != common.EventVideo && isGIF(path) {
+				id, err := client.SendEmoticon(target, path)
+				if !errors.Is(err, ErrNotSupported) {
+					return id, err
+				}
+				m.logger(mxid).Debugf("Failed to send GIF as emoticon, fallback to image: %v", err)
+			}
+			return client.SendImage(target, path)
+		})
 	case common.EventFile:
-		path := saveBlob(m.config.Wechat.Workdir, event)
-		if len(path) > 0 {
-			err = client.SendFile(target, path)
-		} else {
-			err = fmt.Errorf("failed to download file")
+		msgID, err = m.sendBlob(mxid, event, func(path string) (uint64, error) {
+			if err := checkFileSize(path, m.config.Wechat.MaxFileSize); err != nil {
+				return 0, err
+			}
+			sent = true
+			return client.SendFile(target, path)
+		})
+	case common.EventApp:
+		app, ok := event.Data.(*common.AppData)
+		if !ok || app == nil {
+			err = fmt.Errorf("invalid app data")
+			break
+		}
+		if err = validateURL(app.URL); err != nil {
+			break
+		}
+		sent = true
+		msgID, err = client.SendAppMessage(target, app)
+		if err != nil {
+			m.logger(mxid).Warnf("Failed to send app message, fallback to text: %v", err)
+			msgID, err = client.SendText(target, strings.TrimSpace(app.Title+"\n"+app.URL))
 		}
 	default:
 		err = fmt.Errorf("event type not support: %s", event.Type)
 	}
 
-	return &common.Event{
-		ID:        fmt.Sprint(time.Now().UnixMilli()),
-		Timestamp: time.Now().UnixMilli(),
-	}, err
+	// robot doesn't always tell why a private message failed
+	if err != nil && sent && !isTransient(err) && !errors.Is(err, ErrNotFriend) && !strings.HasSuffix(target, "@chatroom") {
+		if contactType, e := client.GetContactType(target); e == nil {
+			switch contactType {
+			case common.ContactStranger:
+				err = fmt.Errorf("%w: %v", ErrNotFriend, err)
+			case common.ContactBlocked:
+				err = fmt.Errorf("message not delivered, %s is blocked: %w", target, err)
+			}
+		}
+	}
+
+	switch {
+	case errors.Is(err, ErrNotFriend):
+		err = fmt.Errorf("message not delivered, %s is not your friend: %w", target, err)
+	case errors.Is(err, ErrMutedGroup):
+		err = fmt.Errorf("message not delivered, you are muted in %s: %w", target, err)
+	case errors.Is(err, ErrRateLimited):
+		err = fmt.Errorf("message not delivered, sending too frequently: %w", err)
+	}
+
+	return msgID, err
+}
+
+func (m *Manager) sendText(mxid string, client *Client, target string, content string, mentions []string) (uint64, error) {
+	if len(mentions) > 0 && strings.HasSuffix(target, "@chatroom") {
+		if wxids, auto := m.resolveMentions(mxid, client, target, content, mentions); len(wxids) > 0 {
+			return client.SendAtText(target, content, wxids, auto)
+		}
+	}
+
+	return client.SendText(target, content)
+}
+
+// mentions ride along the quote as atuserlist, their names are prepended
+// like the at-message API does, unless content mentions someone itself
+func (m *Manager) sendReply(mxid string, client *Client, target string, content string, reply *common.ReplyInfo, mentions []string) (uint64, error) {
+	var wxids []string
+	if len(mentions) > 0 && strings.HasSuffix(target, "@chatroom") {
+		var auto bool
+		if wxids, auto = m.resolveMentions(mxid, client, target, content, mentions); auto {
+			var prefix strings.Builder
+			for _, wxid := range wxids {
+				name := "所有人"
+				if wxid != "notify@all" {
+					name = m.memberName(mxid, client, target, wxid)
+				}
+				prefix.WriteString("@" + name + "\u2005")
+			}
+			content = prefix.String() + content
+		}
+	}
+
+	// refermsg carries type and content of the quoted message, it is taken
+	// as text if not found, e.g. deleted already
+	quote := *reply
+	referType := 1
+	if msgID, err := strconv.ParseUint(reply.ID, 10, 64); err == nil {
+		if quoted, err := client.GetMessageByID(msgID); err == nil {
+			referType = quoted.MsgType
+			quote.Content = quoted.Message
+		} else {
+			m.logger(mxid).Debugf("Failed to get quoted message %d, quote as text: %v", msgID, err)
+		}
+	}
+
+	return client.SendReply(target, content, &quote, referType, wxids)
+}
+
+// name of a user for notices, member nickname in groups, wxid if unknown
+func (m *Manager) displayName(mxid string, chat string, wxid string) string {
+	client := m.GetClient(mxid)
+	if client == nil {
+		return wxid
+	}
+	if strings.HasSuffix(chat, "@chatroom") {
+		return m.memberName(mxid, client, chat, wxid)
+	}
+	if info, err := client.GetUserInfo(wxid); err == nil && len(info.Nickname) > 0 {
+		return info.Nickname
+	}
+
+	return wxid
+}
+
+func (m *Manager) memberName(mxid string, client *Client, group string, wxid string) string {
+	if members, err := m.groupMembers(mxid, client, group); err == nil {
+		for _, member := range members {
+			if member.ID == wxid && len(member.DisplayName) > 0 {
+				return member.DisplayName
+			}
+		}
+	}
+	if name, _ := client.GetGroupMemberNickname(group, wxid); len(name) > 0 {
+		return name
+	}
+
+	return wxid
+}
+
+// mentions may be display names from bridge, they are resolved to wxids of
+// group members, unresolved ones stay as plain @name in content
+func (m *Manager) resolveMentions(mxid string, client *Client, group string, content string, mentions []string) ([]string, bool) {
+	members, err := m.groupMembers(mxid, client, group)
+	if err != nil || len(members) == 0 {
+		m.logger(mxid).Debugf("Failed to get members of group %s, mentions are sent as is: %v", group, err)
+		return mentions, false
+	}
+
+	ids := map[string]struct{}{}
+	names := map[string]string{}
+	for _, member := range members {
+		ids[member.ID] = struct{}{}
+		if len(member.DisplayName) > 0 {
+			names[member.DisplayName] = member.ID
+		}
+	}
+
+	var wxids []string
+	for _, mention := range mentions {
+		if _, ok := ids[mention]; ok || mention == "notify@all" {
+			wxids = append(wxids, mention)
+		} else if id, ok := names[strings.TrimPrefix(mention, "@")]; ok {
+			wxids = append(wxids, id)
+		}
+	}
+
+	// let robot render @nickname if content doesn't mention anyone itself
+	return wxids, !strings.Contains(content, "@")
+}
+
+// group members are cached shortly, mentions usually come in bursts
+func (m *Manager) groupMembers(mxid string, client *Client, group string) ([]*common.GroupMember, error) {
+	key := mxid + "/" + group
+	if v, ok := m.members.Get(key); ok {
+		if cached := v.(*cachedMembers); time.Since(cached.at) < memberCacheTTL {
+			return cached.members, nil
+		}
+	}
+
+	members, err := client.GetChatroomMemberDetail(group)
+	if err != nil {
+		return nil, err
+	}
+	m.members.Set(key, &cachedMembers{members, time.Now()})
+
+	return members, nil
+}
+
+// save event media into store and fetch it just in time for sending
+func (m *Manager) sendBlob(mxid string, event *common.Event, send func(string) (uint64, error)) (uint64, error) {
+	key, err := saveBlob(m.store, mxid, event, m.config.Wechat.MaxFileSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save media: %w", err)
+	}
+
+	path, err := m.store.Fetch(key)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := m.store.Release(path); err != nil {
+			m.logger(mxid).Warnf("Failed to release media %s: %v", path, err)
+		}
+	}()
+
+	return send(path)
 }
 
 func (m *Manager) Dispose() {
 	m.clientsLock.Lock()
 	defer m.clientsLock.Unlock()
 
+	if m.listener != nil {
+		m.listener.Close()
+	}
+
+	// keep WeChat running, so it can be re-attached next time
+	if m.config.Wechat.RestoreSessions {
+		m.saveSessions()
+		return
+	}
+
 	for _, client := range m.clients {
 		client.Dispose()
 	}
 }
 
-// receive WeChat tcp package
-func (m *Manager) Serve() {
+// receive WeChat tcp package, nil is returned once listener is closed on shutdown
+func (m *Manager) Serve() error {
 	addr := fmt.Sprintf("127.0.0.1:%d", m.config.Wechat.ListenPort)
 	log.Infof("Manager starting to listen on %s", addr)
 
 	listen, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	m.clientsLock.Lock()
+	m.listener = listen
+	m.clientsLock.Unlock()
+
+	for {
+		if stopped, err := m.accept(listen); stopped {
+			return err
+		}
 	}
+}
+
+// returns false if a panic stopped accepting, so caller could resume
+func (m *Manager) accept(listen net.Listener) (stopped bool, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			log.Errorf("Panic while accepting WeChat connection: %v\n%s", panicErr, debug.Stack())
+			stopped, err = false, nil
+		}
+	}()
 
+	failures := 0
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
-			log.Fatalf("Failed to accept: %v", err)
+			// closed by Dispose on shutdown
+			if errors.Is(err, net.ErrClosed) {
+				return true, nil
+			}
+			failures++
+			if failures >= maxAcceptFailures {
+				return true, fmt.Errorf("failed to accept %d times in a row: %w", failures, err)
+			}
+			delay := time.Duration(1<<failures) * acceptBackoff
+			log.Warnf("Failed to accept, retry in %v: %v", delay, err)
+			time.Sleep(delay)
+			continue
 		}
+		failures = 0
 
-		go func(conn net.Conn) {
-			defer conn.Close()
+		go m.serveConn(conn)
+	}
+}
 
-			for {
-				data, err := bufio.NewReader(conn).ReadBytes('\n')
-				if err != nil {
-					if err != io.EOF {
-						log.Warnln(err)
+func (m *Manager) serveConn(conn net.Conn) {
+	defer conn.Close()
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			log.Errorf("Panic while reading WeChat connection: %v\n%s", panicErr, debug.Stack())
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		data, err := readFrame(reader, m.config.Wechat.MaxMessageSize*1024*1024)
+		if errors.Is(err, errFrameTooLarge) {
+			log.Warnf("Dropped WeChat message larger than %d MB", m.config.Wechat.MaxMessageSize)
+			conn.Write([]byte("500 ERROR"))
+			continue
+		} else if err != nil {
+			if err != io.EOF {
+				log.Warnln(err)
+			}
+			return
+		}
+
+		msg := WechatMessage{
+			IsSendByPhone: 1,
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Warnf("Failed to unmarshal data from WeChat: %v", err)
+			conn.Write([]byte("500 ERROR"))
+		} else if err := msg.validate(); err != nil {
+			log.Warnf("Skip invalid message from WeChat: %v", err)
+			log.Debugf("Invalid message from WeChat: %s", data)
+			conn.Write([]byte("500 ERROR"))
+		} else {
+			msg.ReceivedAt = time.Now()
+			go m.dispatch(&msg)
+			conn.Write([]byte("200 OK"))
+		}
+	}
+}
+
+// messages of same sender are processed in order
+func (m *Manager) dispatch(msg *WechatMessage) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			log.Errorf("Panic while processing WeChat message %d: %v\n%s", msg.MsgID, panicErr, debug.Stack())
+		}
+	}()
+
+	m.mutex.LockKey(msg.Sender)
+	defer m.mutex.UnlockKey(msg.Sender)
+
+	if mxid, ok := m.pids[msg.PID]; ok {
+		if !m.ownsMessage(mxid, msg) {
+			m.logger(mxid).Warnf("Dropped message of %s routed by pid %d, not the logged in user", msg.Self, msg.PID)
+			return
+		}
+		m.processFunc(mxid, msg)
+	} else {
+		log.Warnf("Failed to map pid (%d) to remote mxid", msg.PID)
+	}
+}
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// read a newline terminated frame, an oversized one is skipped up to next newline
+func readFrame(reader *bufio.Reader, limit int) ([]byte, error) {
+	var frame []byte
+	tooLarge := false
+	for {
+		line, err := reader.ReadSlice('\n')
+		if !tooLarge {
+			frame = append(frame, line...)
+			if limit > 0 && len(frame) > limit {
+				tooLarge = true
+				frame = nil
+			}
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err != nil:
+			return nil, err
+		case tooLarge:
+			return nil, errFrameTooLarge
+		default:
+			return frame, nil
+		}
+	}
+}
+
+// detect stalled robot by pinging every client periodically
+func (m *Manager) Watch() {
+	interval := m.config.Wechat.PingInterval
+	if interval <= 0 {
+		return
+	}
+
+	failures := map[string]int{}
+	var failuresLock sync.Mutex
+
+	for range time.Tick(interval) {
+		m.clientsLock.Lock()
+		clients := make(map[string]*Client, len(m.clients))
+		for mxid, client := range m.clients {
+			clients[mxid] = client
+		}
+		m.clientsLock.Unlock()
+
+		for mxid, client := range clients {
+			go func(mxid string, client *Client) {
+				isLogin, err := client.Ping(interval)
+
+				failuresLock.Lock()
+				if err == nil {
+					delete(failures, mxid)
+					failuresLock.Unlock()
+					if client.wasLogin.Swap(isLogin) && !isLogin {
+						m.pushFunc(mxid, newLogoutEvent(!client.loggedOut.Load()))
 					}
 					return
 				}
-
-				msg := WechatMessage{
-					IsSendByPhone: 1,
+				failures[mxid]++
+				count := failures[mxid]
+				if count >= maxPingFailures {
+					delete(failures, mxid)
 				}
-				if err := json.Unmarshal(data, &msg); err != nil {
-					log.Warnf("Failed to unmarshal data from WeChat: %v", err)
-					conn.Write([]byte("500 ERROR"))
-				} else {
-					go func() {
-						m.mutex.LockKey(msg.Sender)
-						defer m.mutex.UnlockKey(msg.Sender)
-
-						if mxid, ok := m.pids[msg.PID]; ok {
-							m.processFunc(mxid, &msg)
-						} else {
-							log.Warnf("Failed to map pid (%d) to remote mxid", msg.PID)
-						}
-					}()
-					conn.Write([]byte("200 OK"))
+				failuresLock.Unlock()
+
+				m.logger(mxid).Warnf("Failed to ping WeChat robot (%d/%d): %v", count, maxPingFailures, err)
+				if count >= maxPingFailures {
+					m.logger(mxid).Warnln("WeChat robot is stalled, disconnect it")
+					if m.GetClient(mxid) == client {
+						m.Disconnet(mxid)
+						m.pushFunc(mxid, newStalledEvent())
+					}
 				}
+			}(mxid, client)
+		}
+	}
+}
+
+// push self profile to bridge when nickname or avatar changed
+func (m *Manager) RefreshSelf() {
+	interval := m.config.Wechat.SelfRefreshInterval
+	if interval <= 0 {
+		return
+	}
+
+	snapshots := map[string]common.UserInfo{}
+
+	for range time.Tick(interval) {
+		m.clientsLock.Lock()
+		clients := make(map[string]*Client, len(m.clients))
+		for mxid, client := range m.clients {
+			clients[mxid] = client
+		}
+		m.clientsLock.Unlock()
+
+		for mxid := range snapshots {
+			if _, ok := clients[mxid]; !ok {
+				delete(snapshots, mxid)
+			}
+		}
+
+		for mxid, client := range clients {
+			if !client.IsLogin() {
+				continue
 			}
-		}(conn)
+			self, err := client.GetSelf()
+			if err != nil {
+				m.logger(mxid).Debugf("Failed to refresh self info: %v", err)
+				continue
+			}
+			m.setLabel(mxid, self)
+
+			info := self.toUserInfo()
+			last, ok := snapshots[mxid]
+			snapshots[mxid] = *info
+			if !ok || last == *info {
+				continue
+			}
+
+			m.pushFunc(mxid, &common.Event{
+				ID:        fmt.Sprint(time.Now().UnixMilli()),
+				Timestamp: time.Now().UnixMilli(),
+				From:      common.User{ID: info.ID},
+				IsSelf:    true,
+				Type:      common.EventProfile,
+				Data:      info,
+			})
+		}
+	}
+}
+
+// logger tags log lines with the account label, so interleaved accounts can be told apart
+func (m *Manager) logger(mxid string) *log.Entry {
+	label := mxid
+	if l, ok := m.config.Wechat.AccountLabels[mxid]; ok {
+		label = l
+	} else if l, ok := m.labels.Load(mxid); ok {
+		label = l.(string)
+	}
+	return log.WithField("account", label)
+}
+
+func (m *Manager) setLabel(mxid string, self *WxUserInfo) {
+	if self == nil || len(self.Nickname) == 0 {
+		return
 	}
+	m.labels.Store(mxid, self.Nickname)
 }
 
 func (m *Manager) GetClient(mxid string) *Client {
@@ -325,7 +1332,7 @@ func (m *Manager) call(mxid string, f func(*Client, ...any) (any, error), v ...a
 	m.clientsLock.Unlock()
 
 	if !ok {
-		return nil, fmt.Errorf("client not found")
+		return nil, ErrClientNotFound
 	} else {
 		return f(client, v...)
 	}
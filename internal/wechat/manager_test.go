@@ -0,0 +1,1047 @@
+package wechat
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/duo/matrix-wechat-agent/internal/common"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/tidwall/gjson"
+)
+
+// fakeListener fails a few times before handing out connections
+type fakeListener struct {
+	mu       sync.Mutex
+	failures int
+	conns    chan net.Conn
+	closed   chan struct{}
+	accepted int
+}
+
+func newFakeListener(failures int) *fakeListener {
+	return &fakeListener{
+		failures: failures,
+		conns:    make(chan net.Conn, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.failures > 0 {
+		l.failures--
+		l.mu.Unlock()
+		return nil, errors.New("accept: too many open files")
+	}
+	l.mu.Unlock()
+
+	select {
+	case conn := <-l.conns:
+		l.mu.Lock()
+		l.accepted++
+		l.mu.Unlock()
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func newTestManager() *Manager {
+	config := &common.Configure{}
+	config.Wechat.MaxMessageSize = 1
+	return &Manager{
+		config:     config,
+		clients:    map[string]*Client{},
+		pids:       map[int]string{},
+		connecting: map[string]int32{},
+		mutex:      common.NewHashed(16),
+	}
+}
+
+// client whose self wxid is known, without a robot behind
+func newLoggedInClient(pid uintptr, self string) *Client {
+	client := &Client{pid: pid}
+	client.selfID.Store(self)
+	return client
+}
+
+func TestAcceptRetriesTransientError(t *testing.T) {
+	m := newTestManager()
+	listen := newFakeListener(2)
+
+	type result struct {
+		stopped bool
+		err     error
+	}
+	ret := make(chan result, 1)
+	go func() {
+		stopped, err := m.accept(listen)
+		ret <- result{stopped, err}
+	}()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	listen.conns <- server
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		listen.mu.Lock()
+		accepted := listen.accepted
+		listen.mu.Unlock()
+		if accepted == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection not accepted after transient errors")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	listen.Close()
+	select {
+	case r := <-ret:
+		if !r.stopped || r.err != nil {
+			t.Fatalf("accept() = %v, %v, want clean stop on closed listener", r.stopped, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept didn't return after listener closed")
+	}
+}
+
+func TestAcceptGivesUp(t *testing.T) {
+	backoff := acceptBackoff
+	acceptBackoff = time.Microsecond
+	defer func() { acceptBackoff = backoff }()
+
+	m := newTestManager()
+	listen := newFakeListener(maxAcceptFailures)
+	defer listen.Close()
+
+	stopped, err := m.accept(listen)
+	if !stopped || err == nil {
+		t.Fatalf("accept() = %v, %v, want stop with error", stopped, err)
+	}
+}
+
+func TestSendSplitTextKeepsMentionsInFirstChunk(t *testing.T) {
+	var apis []int
+	var lock sync.Mutex
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		lock.Lock()
+		defer lock.Unlock()
+		switch api {
+		case WECHAT_MSG_SEND_TEXT, WECHAT_MSG_SEND_AT:
+			apis = append(apis, api)
+			return map[string]any{"result": "OK", "msgid": len(apis)}
+		case WECHAT_DATABASE_QUERY:
+			return queryResult()
+		}
+		return nil
+	})
+
+	m := newTestManager()
+	m.config.Wechat.MaxTextLength = 4
+	m.clients["@alice:example.org"] = client
+
+	event := &common.Event{
+		Type:     common.EventText,
+		Content:  "@Bob 你好世界",
+		Mentions: []string{"wxid_bob"},
+		Chat:     common.Chat{ID: "24503927881@chatroom"},
+	}
+	if _, err := m.send("@alice:example.org", event); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int{WECHAT_MSG_SEND_AT, WECHAT_MSG_SEND_TEXT, WECHAT_MSG_SEND_TEXT}
+	if !reflect.DeepEqual(apis, want) {
+		t.Errorf("sent with APIs %v, want %v", apis, want)
+	}
+}
+
+func TestReadFrameRecoversFromOversizedFrame(t *testing.T) {
+	input := strings.Repeat("x", 10000) + "\n" + `{"msgid":1}` + "\n"
+	reader := bufio.NewReaderSize(strings.NewReader(input), 16)
+
+	if _, err := readFrame(reader, 64); !errors.Is(err, errFrameTooLarge) {
+		t.Fatalf("readFrame() error = %v, want %v", err, errFrameTooLarge)
+	}
+	frame, err := readFrame(reader, 64)
+	if err != nil || string(frame) != `{"msgid":1}`+"\n" {
+		t.Fatalf("readFrame() = %q, %v, want next frame", frame, err)
+	}
+	if _, err := readFrame(reader, 64); err != io.EOF {
+		t.Fatalf("readFrame() error = %v, want EOF", err)
+	}
+}
+
+func TestServeConnDropsOversizedFrame(t *testing.T) {
+	m := newTestManager()
+	m.pids[7] = "@alice:example.org"
+	m.clients["@alice:example.org"] = newLoggedInClient(7, "wxid_self")
+
+	processed := make(chan uint64, 1)
+	m.processFunc = func(mxid string, msg *WechatMessage) {
+		processed <- msg.MsgID
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go m.serveConn(server)
+
+	reader := bufio.NewReader(client)
+	write := func(frame string) string {
+		if _, err := client.Write([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		n, err := reader.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	if ack := write(strings.Repeat("x", 2*1024*1024) + "\n"); ack != "500 ERROR" {
+		t.Errorf("oversized frame acked with %q", ack)
+	}
+	valid := `{"pid":7,"msgid":2,"type":1,"sender":"wxid_bob","wxid":"wxid_bob","self":"wxid_self","message":"hi"}` + "\n"
+	if ack := write(valid); ack != "200 OK" {
+		t.Errorf("valid frame acked with %q", ack)
+	}
+
+	select {
+	case id := <-processed:
+		if id != 2 {
+			t.Errorf("processed message %d, want 2", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("valid frame after oversized one not processed")
+	}
+}
+
+// fakeDriver spawns a stand-in process, robot injection always fails
+type fakeDriver struct {
+	cmd *exec.Cmd
+}
+
+func (d *fakeDriver) NewWechat() (uintptr, error) {
+	d.cmd = exec.Command("sleep", "30")
+	if err := d.cmd.Start(); err != nil {
+		return 0, err
+	}
+	return uintptr(d.cmd.Process.Pid), nil
+}
+
+func (d *fakeDriver) StartListen(pid uintptr, port int32) error {
+	return errors.New("start_listen failed")
+}
+
+func TestConnectCleansUpOnStartListenFailure(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+
+	m := newTestManager()
+	m.config.Wechat.Version = "3.7.0.30"
+	m.config.Wechat.ListenPort = 22300
+	m.config.Wechat.PortRangeEnd = 22399
+	m.sessions = map[string]*session{}
+	driver := &fakeDriver{}
+	m.driver = driver
+
+	if err := m.Connect("@alice:example.org", ""); err == nil {
+		t.Fatal("Connect() succeeded, want start_listen error")
+	}
+	if len(m.clients) != 0 || len(m.pids) != 0 {
+		t.Errorf("half registered client left behind: clients %v, pids %v", m.clients, m.pids)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- driver.cmd.Wait() }()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		driver.cmd.Process.Kill()
+		t.Fatal("spawned WeChat process not killed")
+	}
+}
+
+func TestConnectRefusedPastMaxClients(t *testing.T) {
+	m := newTestManager()
+	m.config.Wechat.Mock = true
+	m.config.Wechat.Version = "3.7.0.30"
+	m.config.Wechat.ListenPort = 22400
+	m.config.Wechat.PortRangeEnd = 22499
+	m.config.Wechat.MaxClients = 2
+	m.sessions = map[string]*session{}
+	defer func() {
+		for _, client := range m.clients {
+			client.mock.Close()
+		}
+	}()
+
+	for _, mxid := range []string{"@alice:example.org", "@bob:example.org"} {
+		if err := m.Connect(mxid, ""); err != nil {
+			t.Fatalf("Connect(%s) error = %v", mxid, err)
+		}
+	}
+
+	if err := m.Connect("@carol:example.org", ""); !errors.Is(err, ErrMaxClients) {
+		t.Fatalf("Connect() error = %v, want %v", err, ErrMaxClients)
+	}
+	if _, ok := m.clients["@carol:example.org"]; ok {
+		t.Error("refused client registered")
+	}
+
+	// reconnecting an existing account isn't counted against the limit
+	for _, mxid := range []string{"@alice:example.org", "@bob:example.org"} {
+		if err := m.Connect(mxid, ""); err != nil {
+			t.Errorf("Connect(%s) of existing client error = %v", mxid, err)
+		}
+		if client := m.GetClient(mxid); client == nil || !client.IsAlive() {
+			t.Errorf("existing client %s affected", mxid)
+		}
+	}
+}
+
+func TestAcceptSurvivesPanicInProcess(t *testing.T) {
+	m := newTestManager()
+	m.pids[7] = "@alice:example.org"
+	m.clients["@alice:example.org"] = newLoggedInClient(7, "wxid_self")
+
+	processed := make(chan uint64, 1)
+	m.processFunc = func(mxid string, msg *WechatMessage) {
+		if msg.MsgID == 1 {
+			panic("boom")
+		}
+		processed <- msg.MsgID
+	}
+
+	listen := newFakeListener(0)
+	done := make(chan struct{})
+	go func() {
+		m.accept(listen)
+		close(done)
+	}()
+	defer func() {
+		listen.Close()
+		<-done
+	}()
+
+	send := func(id int) {
+		server, client := net.Pipe()
+		defer client.Close()
+		listen.conns <- server
+
+		frame := `{"pid":7,"msgid":` + strconv.Itoa(id) + `,"type":1,"sender":"wxid_bob","wxid":"wxid_bob","self":"wxid_self","message":"hi"}` + "\n"
+		if _, err := client.Write([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ack := string(buf[:n]); ack != "200 OK" {
+			t.Errorf("message %d acked with %q", id, ack)
+		}
+	}
+
+	// same sender, so the key lock must be released by the panicking dispatch
+	send(1)
+	send(2)
+
+	select {
+	case id := <-processed:
+		if id != 2 {
+			t.Errorf("processed message %d, want 2", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message after panic not processed")
+	}
+}
+
+func TestSaveSessionsUsesLastKnownLogin(t *testing.T) {
+	m := newTestManager()
+	m.config.Wechat.RestoreSessions = true
+	m.config.Wechat.Workdir = t.TempDir()
+
+	// nothing listens on the robot port, a probe would fail
+	online := &Client{pid: 7, port: 1}
+	online.wasLogin.Store(true)
+	m.clients["@alice:example.org"] = online
+	m.clients["@bob:example.org"] = &Client{pid: 8, port: 1}
+
+	m.clientsLock.Lock()
+	m.saveSessions()
+	m.clientsLock.Unlock()
+
+	sessions := loadSessions(filepath.Join(m.config.Wechat.Workdir, SESSION_FILE))
+	want := map[string]*session{
+		"@alice:example.org": {PID: 7, Port: 1, IsLogin: true},
+		"@bob:example.org":   {PID: 8, Port: 1, IsLogin: false},
+	}
+	if !reflect.DeepEqual(sessions, want) {
+		t.Errorf("saved sessions = %+v, want %+v", sessions, want)
+	}
+}
+
+func TestSendReplyQuotesMessageType(t *testing.T) {
+	var xml string
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		switch api {
+		case WECHAT_MSG_SEND_XML:
+			xml = gjson.GetBytes(body, "xml").String()
+		case WECHAT_DATABASE_QUERY:
+			if strings.Contains(gjson.GetBytes(body, "sql").String(), "FROM MSG") {
+				return queryResult([]string{"8012345", "1680000000", "wxid_bob", "0", "3", `<msg><img length="1024" /></msg>`, ""})
+			}
+			return queryResult()
+		}
+		return nil
+	})
+
+	m := newTestManager()
+	m.clients["@alice:example.org"] = client
+
+	event := &common.Event{
+		Type:    common.EventText,
+		Content: "nice",
+		Chat:    common.Chat{ID: "wxid_bob"},
+		Reply:   &common.ReplyInfo{ID: "8012345", Sender: "wxid_bob", Content: "[图片]"},
+	}
+	if _, err := m.send("@alice:example.org", event); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := xmlquery.Parse(strings.NewReader(xml))
+	if err != nil {
+		t.Fatalf("invalid reply xml %q: %v", xml, err)
+	}
+	if got := xmlquery.FindOne(doc, "/appmsg/refermsg/type").InnerText(); got != "3" {
+		t.Errorf("refermsg type = %s, want 3", got)
+	}
+	if got := xmlquery.FindOne(doc, "/appmsg/refermsg/content").InnerText(); got != `<msg><img length="1024" /></msg>` {
+		t.Errorf("refermsg content = %s, want quoted message content", got)
+	}
+}
+
+func TestSendReplyWithMentions(t *testing.T) {
+	var apis []int
+	var xml string
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		switch api {
+		case WECHAT_MSG_SEND_XML, WECHAT_MSG_SEND_AT, WECHAT_MSG_SEND_TEXT:
+			apis = append(apis, api)
+			xml = gjson.GetBytes(body, "xml").String()
+		case WECHAT_DATABASE_QUERY:
+			if strings.Contains(gjson.GetBytes(body, "sql").String(), "FROM ChatRoom") {
+				return queryResult([]string{"wxid_alice^Gwxid_bob", "wxid_alice", ""})
+			}
+			return queryResult()
+		case WECHAT_CHATROOM_GET_MEMBER_NICKNAME:
+			return map[string]any{"result": "OK", "nickname": "Bob"}
+		}
+		return nil
+	})
+
+	m := newTestManager()
+	m.clients["@alice:example.org"] = client
+
+	event := &common.Event{
+		Type:     common.EventText,
+		Content:  "agreed",
+		Mentions: []string{"wxid_bob"},
+		Chat:     common.Chat{ID: "24503927881@chatroom"},
+		Reply:    &common.ReplyInfo{ID: "8012345", Sender: "wxid_bob", Content: "lunch?"},
+	}
+	if _, err := m.send("@alice:example.org", event); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{WECHAT_MSG_SEND_XML}; !reflect.DeepEqual(apis, want) {
+		t.Fatalf("sent with APIs %v, want %v", apis, want)
+	}
+	doc, err := xmlquery.Parse(strings.NewReader(xml))
+	if err != nil {
+		t.Fatalf("invalid reply xml %q: %v", xml, err)
+	}
+	if node := xmlquery.FindOne(doc, "/appmsg/refermsg/svrid"); node == nil || node.InnerText() != "8012345" {
+		t.Errorf("refermsg of quoted message missing in %s", xml)
+	}
+	if node := xmlquery.FindOne(doc, "/appmsg/atuserlist"); node == nil || node.InnerText() != "wxid_bob" {
+		t.Errorf("atuserlist missing in %s", xml)
+	}
+	if got, want := xmlquery.FindOne(doc, "/appmsg/title").InnerText(), "@Bob\u2005agreed"; got != want {
+		t.Errorf("title = %q, want %q", got, want)
+	}
+}
+
+func TestWatchNotifiesStalledClient(t *testing.T) {
+	m := newTestManager()
+	m.config.Wechat.PingInterval = 10 * time.Millisecond
+
+	events := make(chan *common.Event, 1)
+	m.pushFunc = func(mxid string, event *common.Event) {
+		events <- event
+	}
+
+	// nothing listens on the robot port, every ping fails
+	m.clients["@alice:example.org"] = &Client{pid: 7, port: 1}
+	m.pids[7] = "@alice:example.org"
+	go m.Watch()
+
+	select {
+	case event := <-events:
+		if event.Type != common.EventLogout || !event.Data.(*common.LogoutData).Forced {
+			t.Errorf("pushed %+v, want forced logout", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled client disconnected silently")
+	}
+	if m.GetClient("@alice:example.org") != nil {
+		t.Error("stalled client not disconnected")
+	}
+}
+
+func TestSendExplainsOnlyRobotFailures(t *testing.T) {
+	// the robot rejects every message, the target is no contact at all
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		switch api {
+		case WECHAT_MSG_SEND_TEXT:
+			return map[string]any{"result": "ERROR", "msg": "send failed"}
+		case WECHAT_DATABASE_QUERY:
+			return queryResult()
+		}
+		return nil
+	})
+
+	m := newTestManager()
+	m.clients["@alice:example.org"] = client
+
+	tests := []struct {
+		name      string
+		event     *common.Event
+		notFriend bool
+	}{
+		{"robot failure", &common.Event{Type: common.EventText, Content: "hi"}, true},
+		{"invalid url", &common.Event{Type: common.EventApp, Data: &common.AppData{Title: "link", URL: "ftp://example.com"}}, false},
+		{"invalid app data", &common.Event{Type: common.EventApp}, false},
+		{"unsupported type", &common.Event{Type: common.EventLocation}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.event.Chat = common.Chat{ID: "wxid_stranger"}
+			_, err := m.send("@alice:example.org", tt.event)
+			if err == nil {
+				t.Fatal("send() succeeded, want error")
+			}
+			if got := errors.Is(err, ErrNotFriend); got != tt.notFriend {
+				t.Errorf("send() error = %v, not friend %v, want %v", err, got, tt.notFriend)
+			}
+		})
+	}
+}
+
+func TestSendNotesToSelf(t *testing.T) {
+	var targets []string
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		if api == WECHAT_MSG_SEND_TEXT {
+			targets = append(targets, gjson.GetBytes(body, "wxid").String())
+		}
+		return nil
+	})
+	client.selfID.Store("wxid_self")
+
+	m := newTestManager()
+	m.clients["@alice:example.org"] = client
+
+	tests := []struct {
+		name   string
+		chat   string
+		target string
+	}{
+		{"file transfer helper", common.NotesToSelf, "filehelper"},
+		{"self", "wxid_self", "filehelper"},
+		{"others", "wxid_bob", "wxid_bob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets = nil
+			event := &common.Event{Type: common.EventText, Content: "note", Chat: common.Chat{ID: tt.chat}}
+			if _, err := m.send("@alice:example.org", event); err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{tt.target}; !reflect.DeepEqual(targets, want) {
+				t.Errorf("sent to %v, want %v", targets, want)
+			}
+		})
+	}
+
+	targets = nil
+	if _, err := m.send("@alice:example.org", &common.Event{Type: common.EventText, Content: "note"}); err == nil {
+		t.Error("send() without chat succeeded")
+	}
+	if len(targets) > 0 {
+		t.Errorf("message without chat sent to %v", targets)
+	}
+}
+
+func TestDispatchDropsMisroutedMessage(t *testing.T) {
+	processed := make(chan uint64, 3)
+	m := newTestManager()
+	m.processFunc = func(mxid string, msg *WechatMessage) {
+		processed <- msg.MsgID
+	}
+
+	// pid 7 was reused by WeChat of another account
+	m.pids[7] = "@alice:example.org"
+	m.clients["@alice:example.org"] = newLoggedInClient(7, "wxid_alice")
+	// robot of bob isn't reachable, so his self is unknown
+	m.pids[8] = "@bob:example.org"
+	m.clients["@bob:example.org"] = &Client{pid: 8, port: 1}
+
+	m.dispatch(&WechatMessage{PID: 7, MsgID: 1, Sender: "wxid_carol", Self: "wxid_mallory"})
+	m.dispatch(&WechatMessage{PID: 8, MsgID: 2, Sender: "wxid_carol", Self: "wxid_bob"})
+	m.dispatch(&WechatMessage{PID: 7, MsgID: 3, Sender: "wxid_carol", Self: "wxid_alice"})
+
+	close(processed)
+	var ids []uint64
+	for id := range processed {
+		ids = append(ids, id)
+	}
+	if want := []uint64{3}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("processed messages %v, want %v", ids, want)
+	}
+}
+
+func TestConnectDoesNotBlockOtherAccounts(t *testing.T) {
+	release := make(chan struct{})
+	pinged := make(chan struct{}, 1)
+	// robot of the re-attached WeChat hangs on ping until released
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api, _ := strconv.Atoi(r.URL.Query().Get("type")); api == WECHAT_IS_LOGIN {
+			select {
+			case pinged <- struct{}{}:
+			default:
+			}
+			<-release
+			w.Write([]byte(`{"result":"OK","is_login":0}`))
+			return
+		}
+		w.Write([]byte(`{"result":"OK"}`))
+	}))
+	defer server.Close()
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+
+	m := newTestManager()
+	m.config.Wechat.Version = "3.7.0.30"
+	m.config.Wechat.InitTimeout = 5 * time.Second
+	// the test process stands in for the still running WeChat
+	m.sessions = map[string]*session{
+		"@alice:example.org": {PID: uintptr(os.Getpid()), Port: int32(port)},
+	}
+	m.clients["@bob:example.org"] = newLoggedInClient(8, "wxid_bob")
+
+	done := make(chan error, 1)
+	go func() { done <- m.Connect("@alice:example.org", "") }()
+	select {
+	case <-pinged:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("robot not pinged")
+	}
+
+	got := make(chan *Client, 1)
+	go func() { got <- m.GetClient("@bob:example.org") }()
+	select {
+	case client := <-got:
+		if client == nil {
+			t.Error("other account lost while connecting")
+		}
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatal("other account blocked by connecting one")
+	}
+	if err := m.Connect("@alice:example.org", ""); err == nil {
+		t.Error("second Connect() of connecting account succeeded")
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connect() didn't finish")
+	}
+	if client := m.GetClient("@alice:example.org"); client == nil || client.pid != uintptr(os.Getpid()) {
+		t.Errorf("re-attached client not registered: %+v", client)
+	}
+	if len(m.connecting) != 0 {
+		t.Errorf("reservations left behind: %v", m.connecting)
+	}
+}
+
+func TestSetVersionRetries(t *testing.T) {
+	delay := setVersionDelay
+	setVersionDelay = time.Millisecond
+	defer func() { setVersionDelay = delay }()
+
+	tests := []struct {
+		name     string
+		failures int
+		attempts int
+		wantErr  bool
+	}{
+		{"first try", 0, 3, false},
+		{"second try", 1, 3, false},
+		{"last try", 2, 3, false},
+		{"gives up", 3, 3, true},
+		{"no retry by default", 1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			var version string
+			client := newFakeRobot(t, func(api int, body []byte) any {
+				if api != WECHAT_SET_VERSION {
+					return nil
+				}
+				calls++
+				if calls <= tt.failures {
+					return map[string]any{"result": "ERROR", "msg": "robot busy"}
+				}
+				version = gjson.GetBytes(body, "version").String()
+				return nil
+			})
+
+			m := newTestManager()
+			m.config.Wechat.Version = "3.7.0.30"
+			m.config.Wechat.SetVersionAttempts = tt.attempts
+
+			err := m.setVersion("@alice:example.org", client)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && version != "3.7.0.30" {
+				t.Errorf("version set to %q", version)
+			}
+		})
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	store := &LocalStore{dir: filepath.Join(dir, MEDIA_OUTGOING_DIR)}
+	path := filepath.Join(dir, OUTBOX_FILE)
+	chat := common.Chat{ID: "wxid_bob"}
+
+	queued := newOutbox(path, store)
+	queued.push("@alice:example.org", &common.Event{Chat: chat, Type: common.EventText, Content: "first"})
+	queued.push("@alice:example.org", &common.Event{Chat: chat, Type: common.EventPhoto, Data: []*common.BlobData{{Name: "cat.png", Binary: []byte("png data")}}})
+	queued.push("@alice:example.org", &common.Event{Chat: chat, Type: common.EventText, Content: "third"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), base64.StdEncoding.EncodeToString([]byte("png data"))) {
+		t.Errorf("media binary stored inline in %s", data)
+	}
+
+	// agent restarts with messages still queued
+	var sent []string
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		switch api {
+		case WECHAT_MSG_SEND_TEXT:
+			sent = append(sent, gjson.GetBytes(body, "msg").String())
+		case WECHAT_MSG_SEND_IMAGE:
+			data, _ := os.ReadFile(gjson.GetBytes(body, "img_path").String())
+			sent = append(sent, string(data))
+		}
+		return nil
+	})
+	client.selfID.Store("wxid_self")
+
+	var deliveries []*common.DeliveryData
+	m := newTestManager()
+	m.store = store
+	m.outbox = newOutbox(path, store)
+	m.clients["@alice:example.org"] = client
+	m.pushFunc = func(mxid string, event *common.Event) {
+		deliveries = append(deliveries, event.Data.(*common.DeliveryData))
+	}
+
+	for i := 0; i < 5 && m.outbox.pending("@alice:example.org", chat.ID); i++ {
+		m.deliverDue(time.Now())
+	}
+
+	if want := []string{"first", "png data", "third"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("%d delivery events, want 3", len(deliveries))
+	}
+	for _, delivery := range deliveries {
+		if len(delivery.Error) > 0 {
+			t.Errorf("delivery of %s failed: %s", delivery.RequestID, delivery.Error)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(store.dir, "outbox")); len(entries) > 0 {
+		t.Errorf("%d queued media left in store", len(entries))
+	}
+	if reloaded := newOutbox(path, store); len(reloaded.items) > 0 {
+		t.Errorf("%d messages left in outbox", len(reloaded.items))
+	}
+}
+
+func TestLogoutOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    map[string]any
+		wantErr bool
+	}{
+		{"logged out", nil, false},
+		{"robot refused", map[string]any{"result": "ERROR", "msg": "unknown failure"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			client := newFakeRobot(t, func(api int, body []byte) any {
+				if api != WECHAT_LOGOUT {
+					return nil
+				}
+				calls++
+				if tt.resp == nil {
+					return nil
+				}
+				return tt.resp
+			})
+			m := newTestManager()
+			m.clients["@alice:example.org"] = client
+
+			if _, err := m.LogoutOnly("@alice:example.org"); (err != nil) != tt.wantErr {
+				t.Fatalf("LogoutOnly() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != 1 {
+				t.Errorf("%d logout calls, want 1", calls)
+			}
+			if client.loggedOut.Load() == tt.wantErr {
+				t.Errorf("loggedOut = %v, want %v", client.loggedOut.Load(), !tt.wantErr)
+			}
+			// WeChat keeps running, the account can log in again
+			if m.GetClient("@alice:example.org") != client {
+				t.Error("client removed by logout")
+			}
+			// logout noticed by watcher is reported as user initiated
+			if forced := newLogoutEvent(!client.loggedOut.Load()).Data.(*common.LogoutData).Forced; forced != tt.wantErr {
+				t.Errorf("logout event forced = %v, want %v", forced, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := newTestManager().LogoutOnly("@bob:example.org"); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("LogoutOnly() of unknown account error = %v, want %v", err, ErrClientNotFound)
+	}
+}
+
+func TestServeConnValidatesMessage(t *testing.T) {
+	m := newTestManager()
+	m.pids[7] = "@alice:example.org"
+	m.clients["@alice:example.org"] = newLoggedInClient(7, "wxid_self")
+
+	processed := make(chan uint64, 8)
+	m.processFunc = func(mxid string, msg *WechatMessage) {
+		processed <- msg.MsgID
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go m.serveConn(server)
+	reader := bufio.NewReader(client)
+
+	tests := []struct {
+		name  string
+		frame string
+		want  string
+	}{
+		{"valid", `{"pid":7,"msgid":1,"type":1,"sender":"wxid_bob","wxid":"wxid_bob","self":"wxid_self","message":"hi"}`, "200 OK"},
+		{"missing msgid", `{"pid":7,"type":1,"sender":"wxid_bob","self":"wxid_self","message":"hi"}`, "500 ERROR"},
+		{"unknown type", `{"pid":7,"msgid":3,"type":12345,"sender":"wxid_bob","self":"wxid_self"}`, "500 ERROR"},
+		{"missing sender", `{"pid":7,"msgid":4,"type":1,"self":"wxid_self","message":"hi"}`, "500 ERROR"},
+		{"not json", `msgid=5`, "500 ERROR"},
+		{"wrong field type", `{"pid":7,"msgid":"6","type":1,"sender":"wxid_bob"}`, "500 ERROR"},
+		{"system message", `{"pid":7,"msgid":7,"type":10000,"sender":"wxid_bob","wxid":"wxid_bob","self":"wxid_self","message":"你已添加了Bob"}`, "200 OK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := client.Write([]byte(tt.frame + "\n")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 16)
+			n, err := reader.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ack := string(buf[:n]); ack != tt.want {
+				t.Errorf("frame acked with %q, want %q", ack, tt.want)
+			}
+		})
+	}
+
+	got := map[uint64]bool{}
+	for len(got) < 2 {
+		select {
+		case id := <-processed:
+			got[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("processed %v, want valid messages 1 and 7", got)
+		}
+	}
+	if !got[1] || !got[7] {
+		t.Errorf("processed %v, want valid messages 1 and 7", got)
+	}
+}
+
+func TestPruneWorkdir(t *testing.T) {
+	// name, size and age of files in workdir
+	files := []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{SESSION_FILE, 10, 48 * time.Hour},
+		{OUTBOX_FILE, 10, 48 * time.Hour},
+		{"wxid_self/old.jpg", 100, 48 * time.Hour},
+		{"wxid_self/hour.jpg", 100, 2 * time.Hour},
+		{"wxid_self/recent.jpg", 100, 30 * time.Minute},
+		{"wxid_self/fresh.jpg", 100, time.Minute},
+	}
+
+	tests := []struct {
+		name    string
+		maxAge  time.Duration
+		maxSize int64
+		want    []string
+	}{
+		{"age", 24 * time.Hour, 0, []string{"wxid_self/fresh.jpg", "wxid_self/hour.jpg", "wxid_self/recent.jpg"}},
+		{"size", 0, 250, []string{"wxid_self/fresh.jpg", "wxid_self/recent.jpg"}},
+		{"age and size", time.Hour, 1000, []string{"wxid_self/fresh.jpg", "wxid_self/recent.jpg"}},
+		{"grace period", 0, 1, []string{"wxid_self/fresh.jpg"}},
+		{"within limits", 72 * time.Hour, 1000, []string{"wxid_self/fresh.jpg", "wxid_self/hour.jpg", "wxid_self/old.jpg", "wxid_self/recent.jpg"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range files {
+				path := filepath.Join(dir, f.name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, make([]byte, f.size), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				modTime := time.Now().Add(-f.age)
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pruneWorkdir(dir, tt.maxAge, tt.maxSize)
+
+			var got []string
+			filepath.WalkDir(filepath.Join(dir, "wxid_self"), func(path string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					rel, _ := filepath.Rel(dir, path)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("files left = %v, want %v", got, tt.want)
+			}
+			for _, state := range []string{SESSION_FILE, OUTBOX_FILE} {
+				if !pathExists(filepath.Join(dir, state)) {
+					t.Errorf("%s removed", state)
+				}
+			}
+		})
+	}
+}
+
+func TestGetSelfBeforeLogin(t *testing.T) {
+	tests := []struct {
+		name    string
+		isLogin int
+		self    map[string]any
+		want    string
+		wantErr error
+	}{
+		{"not logged in", 0, nil, "", ErrNotLoggedIn},
+		{"login in progress", 1, map[string]any{"wxId": ""}, "", ErrNotLoggedIn},
+		{"logged in", 1, map[string]any{"wxId": "wxid_self", "wxNickName": "Alice"}, "wxid_self", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				api, _ := strconv.Atoi(r.URL.Query().Get("type"))
+				switch api {
+				case WECHAT_IS_LOGIN:
+					w.Write([]byte(`{"result":"OK","is_login":` + strconv.Itoa(tt.isLogin) + `}`))
+				case WECHAT_GET_SELF_INFO:
+					data, _ := json.Marshal(map[string]any{"result": "OK", "data": tt.self})
+					w.Write(data)
+				}
+			}))
+			defer server.Close()
+
+			m := newTestManager()
+			client := &Client{port: int32(server.Listener.Addr().(*net.TCPAddr).Port)}
+			m.clients["@alice:example.org"] = client
+
+			ret, err := m.GetSelf("@alice:example.org")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GetSelf() error = %v, want %v", err, tt.wantErr)
+			}
+			if common.GetErrorCode(err) == common.CodeProcessFailed && tt.wantErr != nil {
+				t.Errorf("GetSelf() error has no code: %v", err)
+			}
+			if client.SelfID() != tt.want {
+				t.Errorf("self wxid = %q, want %q", client.SelfID(), tt.want)
+			}
+			if tt.wantErr == nil && ret.(*common.UserInfo).ID != tt.want {
+				t.Errorf("GetSelf() = %+v, want %s", ret, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package wechat
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/duo/matrix-wechat-agent/internal/common"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// upper bounds in seconds, media download may take up to media_timeout
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var messageLatency = newHistogram(
+	"wechat_agent_message_latency_seconds",
+	"Time from receiving a WeChat message to pushing it to bridge.",
+	latencyBuckets,
+)
+
+// histogram in Prometheus text format, partitioned by whether media was downloaded
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	lock   sync.Mutex
+	counts map[bool][]uint64
+	sums   map[bool]float64
+	totals map[bool]uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  map[bool][]uint64{false: make([]uint64, len(buckets)), true: make([]uint64, len(buckets))},
+		sums:    map[bool]float64{},
+		totals:  map[bool]uint64{},
+	}
+}
+
+func (h *histogram) Observe(media bool, d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	v := d.Seconds()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[media][i]++
+		}
+	}
+	h.sums[media] += v
+	h.totals[media]++
+}
+
+func (h *histogram) Write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	for _, media := range []bool{false, true} {
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{media=\"%t\",le=\"%g\"} %d\n", h.name, media, le, h.counts[media][i])
+		}
+		fmt.Fprintf(w, "%s_bucket{media=\"%t\",le=\"+Inf\"} %d\n", h.name, media, h.totals[media])
+		fmt.Fprintf(w, "%s_sum{media=\"%t\"} %g\n", h.name, media, h.sums[media])
+		fmt.Fprintf(w, "%s_count{media=\"%t\"} %d\n", h.name, media, h.totals[media])
+	}
+}
+
+func isMediaEvent(event *common.Event) bool {
+	switch event.Type {
+	case common.EventPhoto, common.EventSticker, common.EventAudio, common.EventVideo, common.EventFile:
+		return true
+	default:
+		return false
+	}
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		messageLatency.Write(w)
+	})
+
+	log.Infof("Metrics listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Warnf("Failed to serve metrics: %v", err)
+	}
+}
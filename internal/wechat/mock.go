@@ -0,0 +1,208 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MOCK_SELF_WXID   = "wxid_mock_self"
+	MOCK_FRIEND_WXID = "wxid_mock_friend"
+	MOCK_GROUP_WXID  = "10000000000@chatroom"
+
+	// POST a WechatMessage here to feed it into the agent like a real one
+	MOCK_INJECT_PATH = "/inject"
+)
+
+// fake pids never collide with real processes mapped by manager
+var mockPID atomic.Uintptr
+
+var mockUserNameRegex = regexp.MustCompile(`(UserName|ChatRoomName|Alias)='((?:[^']|'')*)'`)
+
+// mockRobot speaks the robot HTTP API with canned data, so the whole pipeline
+// can be exercised without WeChat. Sends are only logged.
+type mockRobot struct {
+	listen int32
+	pid    uintptr
+	server *http.Server
+	msgID  atomic.Uint64
+	login  atomic.Bool
+}
+
+func startMockRobot(port int32, listen int32) (*mockRobot, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &mockRobot{
+		listen: listen,
+		pid:    mockPID.Add(1) + 1<<30,
+	}
+	r.msgID.Store(uint64(time.Now().UnixMilli()))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", r.handleAPI)
+	mux.HandleFunc(MOCK_INJECT_PATH, r.handleInject)
+	r.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := r.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Warnf("Mock robot on port %d stopped: %v", port, err)
+		}
+	}()
+
+	log.Infof("Mock robot (pid %d) listening on port %d", r.pid, port)
+
+	return r, nil
+}
+
+func (r *mockRobot) Close() error {
+	return r.server.Close()
+}
+
+func (r *mockRobot) handleAPI(w http.ResponseWriter, req *http.Request) {
+	apiType, err := strconv.Atoi(req.URL.Query().Get("type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+
+	var resp any
+	switch apiType {
+	case WECHAT_IS_LOGIN:
+		isLogin := 0
+		if r.login.Load() {
+			isLogin = 1
+		}
+		resp = map[string]any{"result": "OK", "is_login": isLogin}
+	case WECHAT_GET_SELF_INFO:
+		resp = &WxGetSelfResp{
+			Result: "OK",
+			Data:   WxUserInfo{ID: MOCK_SELF_WXID, Nickname: "Mock Self"},
+		}
+	case WECHAT_MSG_SEND_TEXT, WECHAT_MSG_SEND_AT, WECHAT_MSG_SEND_IMAGE, WECHAT_MSG_SEND_FILE, WECHAT_MSG_SEND_XML, WECHAT_MSG_FORWARD_MESSAGE, WECHAT_MSG_SEND_EMOTION:
+		log.Infof("Mock robot (pid %d) sends type %d: %s", r.pid, apiType, body)
+		resp = map[string]any{"result": "OK", "msgid": r.msgID.Add(1)}
+	case WECHAT_GET_QROCDE_IMAGE:
+		// scanning is simulated by asking for the code
+		r.login.Store(true)
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)))
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+		return
+	case WECHAT_LOGOUT:
+		r.login.Store(false)
+		resp = map[string]any{"result": "OK"}
+	case WECHAT_CHATROOM_GET_MEMBER_LIST:
+		resp = &WxGetGroupMembersResp{
+			Result:  "OK",
+			Members: strings.Join([]string{MOCK_SELF_WXID, MOCK_FRIEND_WXID}, "^G"),
+		}
+	case WECHAT_CHATROOM_GET_MEMBER_NICKNAME:
+		resp = map[string]any{"result": "OK", "nickname": "Mock Member"}
+	case WECHAT_DATABASE_GET_HANDLES:
+		resp = map[string]any{
+			"result": "OK",
+			"data": []map[string]any{
+				{"db_name": DB_MICRO_MSG, "handle": 1},
+				{"db_name": DB_OPENIM_CONTACT, "handle": 2},
+			},
+		}
+	case WECHAT_DATABASE_QUERY:
+		resp = map[string]any{"result": "OK", "data": r.query(gjson.GetBytes(body, "sql").String())}
+	default:
+		resp = map[string]any{"result": "OK"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// only contact lookups are answered, other queries return the header row alone
+func (r *mockRobot) query(sql string) [][]string {
+	rows := [][]string{{"header"}}
+	if !strings.Contains(sql, "FROM Contact") {
+		return rows
+	}
+
+	contacts := [][]string{
+		{MOCK_FRIEND_WXID, "Mock Friend", "", "", "", "mock_friend", "3", "0"},
+		{MOCK_GROUP_WXID, "Mock Group", "", "", "", "", "2", "0"},
+		{"gh_mock", "Mock Official", "", "", "", "", "3", "8"},
+	}
+
+	match := mockUserNameRegex.FindStringSubmatch(sql)
+	for _, c := range contacts {
+		if match != nil {
+			column := c[0]
+			if match[1] == "Alias" {
+				column = c[5]
+			}
+			if column != strings.ReplaceAll(match[2], "''", "'") {
+				continue
+			}
+		}
+		rows = append(rows, c)
+	}
+
+	return rows
+}
+
+func (r *mockRobot) handleInject(w http.ResponseWriter, req *http.Request) {
+	msg := WechatMessage{
+		IsSendByPhone: 1,
+		Self:          MOCK_SELF_WXID,
+		Sender:        MOCK_FRIEND_WXID,
+		WxID:          MOCK_FRIEND_WXID,
+		MsgType:       1,
+	}
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg.PID = int(r.pid)
+	if msg.MsgID == 0 {
+		msg.MsgID = r.msgID.Add(1)
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().Unix()
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", r.listen))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Write([]byte(strconv.FormatUint(msg.MsgID, 10)))
+}
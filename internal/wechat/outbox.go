@@ -0,0 +1,227 @@
+package wechat
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/duo/matrix-wechat-agent/internal/common"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	OUTBOX_FILE = "outbox.json"
+
+	maxOutboxBackoff = 5 * time.Minute
+)
+
+type outboxItem struct {
+	ID       string        `json:"id"`
+	MXID     string        `json:"mxid"`
+	Event    *common.Event `json:"event"`
+	Attempts int           `json:"attempts"`
+	Created  time.Time     `json:"created"`
+	NextTry  time.Time     `json:"next_try"`
+	// store keys of the event media, binary is kept out of the queue file
+	Media []string `json:"media,omitempty"`
+}
+
+// durable queue of messages waiting for the robot to come back
+type outbox struct {
+	path  string
+	store MediaStore
+	items []*outboxItem
+	lock  sync.Mutex
+}
+
+func newOutbox(path string, store MediaStore) *outbox {
+	o := &outbox{path: path, store: store}
+
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &o.items); err != nil {
+			log.Warnf("Failed to load outbox: %v", err)
+		}
+	}
+
+	return o
+}
+
+func (o *outbox) push(mxid string, event *common.Event) string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	now := time.Now()
+	item := &outboxItem{
+		ID:      fmt.Sprintf("outbox_%d", now.UnixNano()),
+		MXID:    mxid,
+		Created: now,
+		NextTry: now,
+	}
+	item.Event, item.Media = o.putMedia(item.ID, event)
+	o.items = append(o.items, item)
+	o.save()
+
+	return item.ID
+}
+
+// whether there are messages queued for the chat
+func (o *outbox) pending(mxid string, chat string) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, item := range o.items {
+		if item.MXID == mxid && item.Event.Chat.ID == chat {
+			return true
+		}
+	}
+	return false
+}
+
+// head of each chat queue which is ready for retrying
+func (o *outbox) due(now time.Time) []*outboxItem {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	var items []*outboxItem
+	seen := map[string]struct{}{}
+	for _, item := range o.items {
+		key := item.MXID + "|" + item.Event.Chat.ID
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		if !item.NextTry.After(now) {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func (o *outbox) remove(id string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for i, item := range o.items {
+		if item.ID == id {
+			o.items = append(o.items[:i], o.items[i+1:]...)
+			o.releaseMedia(item)
+			break
+		}
+	}
+	o.save()
+}
+
+// queued event with its media read back from store
+func (o *outbox) event(item *outboxItem) (*common.Event, error) {
+	event, blobs := cloneBlobs(item.Event)
+	for i, key := range item.Media {
+		if len(key) == 0 || i >= len(blobs) {
+			continue
+		}
+
+		path, err := o.store.Fetch(key)
+		if err != nil {
+			return nil, err
+		}
+		if blobs[i].Binary, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return event, nil
+}
+
+// move media binary into store, it's kept inline if store is unavailable
+func (o *outbox) putMedia(id string, event *common.Event) (*common.Event, []string) {
+	queued, blobs := cloneBlobs(event)
+
+	var keys []string
+	for i, blob := range blobs {
+		var key string
+		if len(blob.Binary) > 0 {
+			var err error
+			if key, err = o.store.Put(filepath.Join("outbox", id, strconv.Itoa(i)), blob.Binary); err != nil {
+				log.Warnf("Failed to store media of queued message %s: %v", id, err)
+				return event, nil
+			}
+			blob.Binary = nil
+		}
+		keys = append(keys, key)
+	}
+
+	return queued, keys
+}
+
+func (o *outbox) releaseMedia(item *outboxItem) {
+	for _, key := range item.Media {
+		if len(key) == 0 {
+			continue
+		}
+		if path, err := o.store.Fetch(key); err == nil {
+			if err := o.store.Release(path); err != nil {
+				log.Warnf("Failed to release media of queued message %s: %v", item.ID, err)
+			}
+		}
+	}
+}
+
+// shallow copy of event with its own top level blobs
+func cloneBlobs(event *common.Event) (*common.Event, []*common.BlobData) {
+	clone := *event
+
+	var blobs []*common.BlobData
+	switch data := event.Data.(type) {
+	case *common.BlobData:
+		blob := *data
+		clone.Data = &blob
+		blobs = append(blobs, &blob)
+	case []*common.BlobData:
+		photos := make([]*common.BlobData, len(data))
+		for i := range data {
+			blob := *data[i]
+			photos[i] = &blob
+		}
+		clone.Data = photos
+		blobs = photos
+	}
+
+	return &clone, blobs
+}
+
+// record a failed attempt and schedule next try with exponential backoff
+func (o *outbox) retry(id string) int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, item := range o.items {
+		if item.ID == id {
+			item.Attempts++
+			backoff := time.Duration(1<<uint(item.Attempts)) * time.Second
+			if backoff <= 0 || backoff > maxOutboxBackoff {
+				backoff = maxOutboxBackoff
+			}
+			item.NextTry = time.Now().Add(backoff)
+			o.save()
+			return item.Attempts
+		}
+	}
+	return 0
+}
+
+func (o *outbox) save() {
+	data, err := json.Marshal(o.items)
+	if err != nil {
+		log.Warnf("Failed to marshal outbox: %v", err)
+		return
+	}
+	if err := writeFileAtomic(o.path, data); err != nil {
+		log.Warnf("Failed to save outbox: %v", err)
+	}
+}
@@ -1,12 +1,18 @@
 package wechat
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/duo/matrix-wechat-agent/internal/common"
@@ -17,24 +23,77 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// websocket to bridge, implemented by wsc.Client
+type bridgeConn interface {
+	Connect() error
+	Disconnect()
+	ReadJSON(v any) error
+	WriteJSON(v any) error
+}
+
 type Service struct {
 	config *common.Configure
 
-	workdir string
-	docdir  string
+	workdir  string
+	docdir   string
+	location *time.Location
 
-	bridge  *wsc.Client
+	ignoreTypes    map[int]struct{}
+	ignoreAppTypes map[int]struct{}
+
+	bridge  bridgeConn
 	manager *Manager
 
 	history tinylru.LRU
+	// last seen time of media messages, keyed by mediaKey
+	media tinylru.LRU
+
+	// limits concurrently handled bridge requests
+	requests chan struct{}
+
+	pendingLock sync.Mutex
+	pending     []*pendingEvent
+
+	// closed when service can't go on, e.g. WeChat listener gave up
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
+// event failed to push, kept until bridge reconnects
+type pendingEvent struct {
+	msg  *common.Message
+	done func()
+}
+
+const (
+	maxPendingEvents     = 1000
+	defaultFavoriteLimit = 50
+)
+
 func (s *Service) Start() {
 	if err := s.bridge.Connect(); err != nil {
 		log.Fatal(err)
 	}
 
-	go s.manager.Serve()
+	go func() {
+		if err := s.manager.Serve(); err != nil {
+			log.Errorf("Failed to serve WeChat: %v", err)
+			s.doneOnce.Do(func() { close(s.done) })
+		}
+	}()
+	go s.manager.Watch()
+	go s.manager.RefreshSelf()
+	go s.manager.Janitor()
+	go s.manager.Deliver()
+
+	if len(s.config.Service.MetricsAddr) > 0 {
+		go serveMetrics(s.config.Service.MetricsAddr)
+	}
+}
+
+// closed when service stopped on its own and agent should shut down
+func (s *Service) Done() <-chan struct{} {
+	return s.done
 }
 
 func (s *Service) Stop() {
@@ -44,17 +103,19 @@ func (s *Service) Stop() {
 }
 
 func NewService(config *common.Configure) *Service {
-	options, err := wsc.NewClientOptions(
-		config.Service.Addr,
-		wsc.HTTPHeaders(http.Header{
-			"Authorization": []string{fmt.Sprintf("Basic %s", config.Service.Secret)},
-		}),
-		wsc.PingTimeout(config.Service.PingInterval),
-	)
+	options, err := bridgeOptions(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if err := SetProxy(config.Wechat.Proxy); err != nil {
+		log.Fatalf("Failed to set proxy: %v", err)
+	}
+	SetHeaders(config.Wechat.UserAgent, config.Wechat.Headers)
+	if err := SetNameEncoding(config.Wechat.NameEncoding); err != nil {
+		log.Fatalf("Failed to set name encoding: %v", err)
+	}
+
 	workdir := filepath.Join(getDocDir(), "matrix_wechat_agent")
 	if !pathExists(workdir) {
 		if err := os.MkdirAll(workdir, 0o644); err != nil {
@@ -63,21 +124,102 @@ func NewService(config *common.Configure) *Service {
 	}
 	config.Wechat.Workdir = workdir
 
+	docdir, err := resolveWechatDocdir(config.Wechat.DataDir)
+	if err != nil {
+		log.Fatalf("Failed to resolve WeChat data folder: %v", err)
+	}
+	log.Infof("WeChat data folder: %s", docdir)
+
+	location := time.Local
+	if len(config.Wechat.Timezone) > 0 {
+		location, err = time.LoadLocation(config.Wechat.Timezone)
+		if err != nil {
+			log.Fatalf("Failed to load timezone: %v", err)
+		}
+	}
+
+	ignoreTypes, ignoreAppTypes, err := parseIgnoreTypes(config.Wechat.IgnoreTypes)
+	if err != nil {
+		log.Fatalf("Failed to parse ignore types: %v", err)
+	}
+
+	maxRequests := config.Service.MaxConcurrentRequests
+	if maxRequests <= 0 {
+		maxRequests = 1
+	}
+
 	service := &Service{
-		config:  config,
-		workdir: workdir,
-		docdir:  getWechatDocdir(),
-		bridge:  wsc.NewClient(options),
+		config:         config,
+		workdir:        workdir,
+		docdir:         docdir,
+		location:       location,
+		ignoreTypes:    ignoreTypes,
+		ignoreAppTypes: ignoreAppTypes,
+		bridge:         wsc.NewClient(options),
+		requests:       make(chan struct{}, maxRequests),
+		done:           make(chan struct{}),
 	}
 
+	service.resizeDedup(config.Wechat.DedupCacheSize)
+
 	options.OnConnected = service.consumeWebsocket
-	service.manager = NewManager(config, service.processWechatMessage)
+	service.manager = NewManager(config, service.processWechatMessage, service.pushEvent, service.downloadMedia)
 
 	return service
 }
 
+// TLS config for bridge connection, verification is strict unless explicitly disabled
+// wsc dials with its own dialer, so TLS settings go through options
+func bridgeOptions(config *common.Configure) (*wsc.ClientOptions, error) {
+	options, err := wsc.NewClientOptions(
+		config.Service.Addr,
+		wsc.HTTPHeaders(http.Header{
+			"Authorization": []string{fmt.Sprintf("Basic %s", config.Service.Secret)},
+		}),
+		wsc.PingTimeout(config.Service.PingInterval),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.TLSConfig, err = loadTLSConfig(config); err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
+
+func loadTLSConfig(config *common.Configure) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if len(config.Service.CACert) > 0 {
+		data, err := os.ReadFile(config.Service.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", config.Service.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.Service.InsecureSkipVerify {
+		log.Warnln("TLS certificate verification for bridge is disabled, this is insecure!")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return tlsConfig, nil
+}
+
 // read messages from bridge
 func (s *Service) consumeWebsocket(client *wsc.Client) {
+	go s.flushPending()
+
+	// responses can't be delivered once the connection is gone
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	for {
 		var msg common.Message
 		err := s.bridge.ReadJSON(&msg)
@@ -90,7 +232,7 @@ func (s *Service) consumeWebsocket(client *wsc.Client) {
 		case common.MsgRequest:
 			request := msg.Data.(*common.Request)
 			log.Debugf("Receive request #%d: %+v", msg.ID, request)
-			go s.processRequest(msg.ID, msg.MXID, request)
+			s.dispatchRequest(ctx, msg.ID, msg.MXID, request)
 		case common.MsgResponse:
 			response := msg.Data.(*common.Response)
 			log.Debugf("Receive response for #%d: %+v", msg.ID, response)
@@ -98,16 +240,25 @@ func (s *Service) consumeWebsocket(client *wsc.Client) {
 	}
 }
 
-// process requests from bridge
-func (s *Service) processRequest(id int64, mxid string, req *common.Request) {
+// wait for a free slot before spawning the handler, so a flood of requests
+// is queued by the websocket instead of piling up goroutines
+func (s *Service) dispatchRequest(ctx context.Context, id int64, mxid string, req *common.Request) {
+	s.requests <- struct{}{}
+	go s.processRequest(ctx, id, mxid, req)
+}
+
+// process requests from bridge, the slot is taken by dispatchRequest
+func (s *Service) processRequest(ctx context.Context, id int64, mxid string, req *common.Request) {
+	defer func() { <-s.requests }()
+
 	defer func() {
 		panicErr := recover()
 		if panicErr != nil {
-			log.Errorf("Panic while responding to command %s in request #%d: %v\n%s", req.Type, id, panicErr, debug.Stack())
+			s.manager.logger(mxid).Errorf("Panic while responding to command %s in request #%d: %v\n%s", req.Type, id, panicErr, debug.Stack())
 		}
 	}()
 
-	resp := s.actuallyHandleRequest(mxid, req)
+	resp := s.actuallyHandleRequest(ctx, mxid, req)
 	if id != 0 {
 		respMsg := &common.Message{
 			ID:   id,
@@ -117,12 +268,12 @@ func (s *Service) processRequest(id int64, mxid string, req *common.Request) {
 		}
 		log.Debugf("Send response for %d: %+v", id, respMsg)
 		if err := s.bridge.WriteJSON(respMsg); err != nil {
-			log.Warnf("Failed to send response for #%d: %v", id, err)
+			s.manager.logger(mxid).Warnf("Failed to send response for #%d: %v", id, err)
 		}
 	}
 }
 
-func (s *Service) actuallyHandleRequest(mxid string, req *common.Request) *common.Response {
+func (s *Service) actuallyHandleRequest(ctx context.Context, mxid string, req *common.Request) *common.Response {
 	switch req.Type {
 	case common.ReqEvent:
 		ret, err := s.manager.SendMessage(mxid, req.Data.(*common.Event))
@@ -133,6 +284,9 @@ func (s *Service) actuallyHandleRequest(mxid string, req *common.Request) *commo
 	case common.ReqDisconnect:
 		err := s.manager.Disconnet(mxid)
 		return genResponse(common.RespDisconnect, nil, err)
+	case common.ReqLogout:
+		_, err := s.manager.LogoutOnly(mxid)
+		return genResponse(common.RespLogout, nil, err)
 	case common.ReqLoginQR:
 		ret, err := s.manager.LoginWtihQRCode(mxid)
 		return genResponse(common.RespLoginQR, ret, err)
@@ -151,6 +305,9 @@ func (s *Service) actuallyHandleRequest(mxid string, req *common.Request) *commo
 	case common.ReqGetGroupMembers:
 		ret, err := s.manager.GetGroupMembers(mxid, req.Data.([]string)[0])
 		return genResponse(common.RespGetGroupMembers, ret, err)
+	case common.ReqGetGroupMemberDetail:
+		ret, err := s.manager.GetGroupMemberDetail(mxid, req.Data.([]string)[0])
+		return genResponse(common.RespGetGroupMemberDetail, ret, err)
 	case common.ReqGetGroupMemberNickname:
 		ret, err := s.manager.GetGroupMemberNickname(mxid, req.Data.([]string)[0], req.Data.([]string)[1])
 		return genResponse(common.RespGetGroupMemberNickname, ret, err)
@@ -160,14 +317,147 @@ func (s *Service) actuallyHandleRequest(mxid string, req *common.Request) *commo
 	case common.ReqGetGroupList:
 		ret, err := s.manager.GetGroupList(mxid)
 		return genResponse(common.RespGetGroupList, ret, err)
+	case common.ReqGetContactType:
+		ret, err := s.manager.GetContactType(mxid, req.Data.([]string)[0])
+		return genResponse(common.RespGetContactType, ret, err)
+	case common.ReqGetOfficialAccountList:
+		ret, err := s.manager.GetOfficialAccountList(mxid)
+		return genResponse(common.RespGetOfficialAccountList, ret, err)
+	case common.ReqSyncAll:
+		ret, err := s.manager.SyncAll(mxid)
+		return genResponse(common.RespSyncAll, ret, err)
+	case common.ReqDownloadMedia:
+		msgID, err := strconv.ParseUint(req.Data.([]string)[0], 10, 64)
+		if err != nil {
+			return genResponse(common.RespDownloadMedia, nil, err)
+		}
+		ret, err := s.manager.DownloadMedia(ctx, mxid, msgID)
+		return genResponse(common.RespDownloadMedia, ret, err)
+	case common.ReqAcceptTransfer:
+		params := req.Data.([]string)
+		if len(params) != 3 {
+			return genResponse(common.RespAcceptTransfer, nil, fmt.Errorf("expect wxid, transfer id and transaction id"))
+		}
+		_, err := s.manager.AcceptTransfer(mxid, params[0], params[1], params[2])
+		return genResponse(common.RespAcceptTransfer, nil, err)
+	case common.ReqGetChatroomName:
+		ret, err := s.manager.GetGroupName(mxid, req.Data.([]string)[0])
+		return genResponse(common.RespGetChatroomName, ret, err)
+	case common.ReqDisconnectAll:
+		if !s.isAdmin(mxid) {
+			return genResponse(common.RespDisconnectAll, nil, common.WithCode(common.CodeForbidden, fmt.Errorf("%s is not admin", mxid)))
+		}
+		return genResponse(common.RespDisconnectAll, s.manager.DisconnectAll(), nil)
+	case common.ReqGetGroupMemberNicknames:
+		params := req.Data.([]string)
+		if len(params) < 2 {
+			return genResponse(common.RespGetGroupMemberNicknames, nil, fmt.Errorf("expect group and members"))
+		}
+		ret, err := s.manager.GetGroupMemberNicknames(mxid, params[0], params[1:])
+		return genResponse(common.RespGetGroupMemberNicknames, ret, err)
+	case common.ReqGetFavorites:
+		limit := defaultFavoriteLimit
+		if params := req.Data.([]string); len(params) > 0 {
+			n, err := strconv.Atoi(params[0])
+			if err != nil || n <= 0 {
+				return genResponse(common.RespGetFavorites, nil, fmt.Errorf("invalid limit %q", params[0]))
+			}
+			limit = n
+		}
+		ret, err := s.manager.GetFavorites(mxid, limit)
+		return genResponse(common.RespGetFavorites, ret, err)
+	case common.ReqGetMessage:
+		msgID, err := strconv.ParseUint(req.Data.([]string)[0], 10, 64)
+		if err != nil {
+			return genResponse(common.RespGetMessage, nil, err)
+		}
+		ret, err := s.manager.GetMessage(mxid, msgID)
+		return genResponse(common.RespGetMessage, ret, err)
 	default:
 		return nil
 	}
 }
 
+// announcement may be absent from the message, then it's loaded from group info
+func (s *Service) setTopic(mxid string, event *common.Event, msg *WechatMessage, notice string) bool {
+	if !strings.HasSuffix(msg.Sender, "@chatroom") {
+		return false
+	}
+
+	info := &common.GroupInfo{
+		ID:           msg.Sender,
+		Notice:       notice,
+		NoticeEditor: msg.WxID,
+		NoticeTime:   event.Timestamp,
+	}
+	if len(notice) == 0 {
+		ret, err := s.manager.GetGroupInfo(mxid, msg.Sender)
+		if err != nil {
+			s.manager.logger(mxid).Debugf("Failed to load announcement of %s: %v", msg.Sender, err)
+			return false
+		}
+		group, ok := ret.(*common.GroupInfo)
+		if !ok || group == nil || len(group.Notice) == 0 {
+			return false
+		}
+		info.Notice = group.Notice
+		info.NoticeEditor = group.NoticeEditor
+		info.NoticeTime = group.NoticeTime
+	}
+
+	event.Type = common.EventTopic
+	event.Content = info.Notice
+	event.Data = info
+
+	return true
+}
+
+// first existing candidate wins, otherwise the file may not be written yet
+func (s *Service) mediaPath(msg *WechatMessage, path string) (string, bool) {
+	if len(path) == 0 {
+		return "", false
+	}
+
+	for _, candidate := range mediaPathCandidates(s.docdir, msg.Self, path) {
+		if pathExists(candidate) {
+			log.Debugf("Resolved media %s to %s", path, candidate)
+			return candidate, true
+		}
+	}
+
+	return "", false
+}
+
+// msgids sent by hook and media keys are remembered for the last size messages
+func (s *Service) resizeDedup(size int) {
+	if size > 0 {
+		s.history.Resize(size)
+		s.media.Resize(size)
+	}
+}
+
+// WeChat may deliver a media message several times in quick succession
+func (s *Service) isDuplicateMedia(key mediaKey) bool {
+	v, ok := s.media.Set(key, time.Now())
+	if !ok || s.config.Wechat.MediaDebounce <= 0 {
+		return false
+	}
+
+	return time.Since(v.(time.Time)) < s.config.Wechat.MediaDebounce
+}
+
+func (s *Service) isAdmin(mxid string) bool {
+	for _, admin := range s.config.Service.Admins {
+		if admin == mxid {
+			return true
+		}
+	}
+	return false
+}
+
 // process WeChat message
 func (s *Service) processWechatMessage(mxid string, msg *WechatMessage) {
-	log.Debugf("Receive WeChat msg: %+v", msg)
+	s.manager.logger(mxid).Debugf("Receive WeChat msg: %+v", msg)
 
 	// Skip message sent by hook
 	if msg.IsSendByPhone == 0 && msg.MsgType != 10000 {
@@ -177,12 +467,36 @@ func (s *Service) processWechatMessage(mxid string, msg *WechatMessage) {
 		return
 	}
 
+	// skip before any media is downloaded
+	if _, ok := s.ignoreTypes[msg.MsgType]; ok {
+		return
+	}
+
+	// media never showing up shouldn't hold the sender's lock for long
+	ctx := context.Background()
+	if s.config.Wechat.ProcessTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.Wechat.ProcessTimeout)
+		defer cancel()
+	}
+
 	event := &common.Event{
 		ID:        fmt.Sprint(msg.MsgID),
-		Timestamp: msg.Timestamp * 1000,
+		Timestamp: getTimestamp(msg, s.location),
 		Type:      common.EventText,
 		Content:   msg.Message,
 		Chat:      common.Chat{ID: msg.Sender},
+		IsSelf:    msg.IsSendMsg == 1,
+	}
+
+	// filehelper is a regular chat with oneself, others only carry notifications
+	if isSystemContact(msg.Sender) && msg.Sender != "filehelper" {
+		if (msg.MsgType != 1 && msg.MsgType != 10002) || msg.IsSendMsg == 1 {
+			return
+		}
+		if msg.MsgType == 1 {
+			event.Type = common.EventNotice
+		}
 	}
 
 	if msg.IsSendMsg == 0 {
@@ -194,16 +508,26 @@ func (s *Service) processWechatMessage(mxid string, msg *WechatMessage) {
 		event.From = common.User{ID: msg.Self}
 	}
 
+	if key, ok := getMediaKey(msg); ok {
+		if s.isDuplicateMedia(key) {
+			s.manager.logger(mxid).Debugf("Skip duplicate media message %d from %s", msg.MsgID, msg.Sender)
+			return
+		}
+		// renewed when done, so copies queued behind a slow download are dropped
+		defer s.media.Set(key, time.Now())
+	}
+
 	switch msg.MsgType {
 	case 0: // unknown
 		return
 	case 1: // Txt
-		event.Mentions = getMentions(s, msg)
+		event.Mentions = getMentions(msg)
+		event.MentionsSelf = isMentioned(event.Mentions, msg.Self)
 	case 3: // Image
 		if len(msg.FilePath) == 0 {
 			return
 		}
-		blob := downloadImage(s, msg)
+		blob := downloadImage(ctx, s, msg)
 		if blob != nil {
 			event.Type = common.EventPhoto
 			event.Data = []*common.BlobData{blob}
@@ -211,7 +535,7 @@ func (s *Service) processWechatMessage(mxid string, msg *WechatMessage) {
 			event.Content = "[图片下载失败]"
 		}
 	case 34: // Voice
-		blob := downloadVoice(s, msg, s.manager.GetClient(mxid))
+		blob := downloadVoice(ctx, s, msg, s.manager.GetClient(mxid))
 		if blob != nil {
 			event.Type = common.EventAudio
 			event.Data = blob
@@ -219,22 +543,19 @@ func (s *Service) processWechatMessage(mxid string, msg *WechatMessage) {
 			event.Content = "[语音下载失败]"
 		}
 	case 42: // Card
-		if card := parseCard(s, msg); card != nil {
+		if card := parseCard(msg); card != nil {
 			event.Type = common.EventApp
 			event.Data = card
 		} else {
+			logParseFailure(msg, 0)
 			event.Content = "[名片解析失败]"
 		}
 	case 43: // Video
 		if len(msg.FilePath) == 0 && len(msg.Thumbnail) == 0 {
 			return
 		}
-		if _, ok := s.history.Get(msg.MsgID); ok {
-			return
-		}
-		s.history.Set(msg.MsgID, struct{}{})
 
-		blob := downloadVideo(s, msg)
+		blob := downloadVideo(ctx, s, msg)
 		if blob != nil {
 			event.Type = common.EventVideo
 			event.Data = blob
@@ -250,28 +571,25 @@ func (s *Service) processWechatMessage(mxid string, msg *WechatMessage) {
 			event.Content = "[表情下载失败]"
 		}
 	case 48: // Location
-		location := parseLocation(s, msg)
+		location := parseLocation(msg)
 		if location != nil {
 			event.Type = common.EventLocation
 			event.Data = location
 		} else {
+			logParseFailure(msg, 0)
 			event.Content = "[位置解析失败]"
 		}
 	case 49: // App
-		appType := getAppType(s, msg)
+		appType := getAppType(msg)
+		if _, ok := s.ignoreAppTypes[appType]; ok {
+			return
+		}
 		switch appType {
 		case 6: // File
 			if len(msg.FilePath) == 0 {
 				return
 			}
-			// FIXME: skip duplicate file
-			if !strings.HasPrefix(msg.Message, "<?xml") {
-				return
-			}
-			if _, ok := s.history.Set(msg.MsgID, struct{}{}); ok {
-				return
-			}
-			blob := downloadFile(s, msg)
+			blob := downloadFile(ctx, s, msg)
 			if blob != nil {
 				event.Type = common.EventFile
 				event.Data = blob
@@ -282,10 +600,6 @@ func (s *Service) processWechatMessage(mxid string, msg *WechatMessage) {
 			if len(msg.FilePath) == 0 {
 				return
 			}
-			// FIXME: skip duplicate sticker
-			if strings.HasPrefix(msg.Message, "<?xml") {
-				return
-			}
 			blob := downloadSticker(s, msg)
 			if blob != nil {
 				event.Type = common.EventSticker
@@ -294,37 +608,66 @@ func (s *Service) processWechatMessage(mxid string, msg *WechatMessage) {
 				event.Content = "[表情下载失败]"
 			}
 		case 57: // TODO: reply meesage not found fallback
-			content, reply := parseReply(s, msg)
+			content, reply := parseReply(msg)
 			if len(content) > 0 && reply != nil {
 				event.Content = content
 				event.Reply = reply
+			} else {
+				logParseFailure(msg, appType)
+			}
+		case 87: // group announcement
+			if !s.setTopic(mxid, event, msg, parseNotice(msg)) {
+				logParseFailure(msg, appType)
 			}
-		case 87:
-			content := parseNotice(s, msg)
+		case 17: // live location
+			wxid := msg.WxID
+			if msg.IsSendMsg == 1 {
+				wxid = msg.Self
+			}
+			content := parseLiveLocation(msg, s.manager.displayName(mxid, msg.Sender, wxid))
 			if len(content) > 0 {
 				event.Type = common.EventNotice
 				event.Content = content
+			} else {
+				logParseFailure(msg, appType)
+			}
+		case 2000: // Transfer
+			transfer := parseTransfer(msg)
+			if transfer != nil {
+				event.Type = common.EventTransfer
+				event.Content = strings.TrimSpace(fmt.Sprintf("[转账] %s %s", transfer.Amount, transfer.Memo))
+				event.Data = transfer
+			} else {
+				logParseFailure(msg, appType)
+				event.Content = "[转账解析失败]"
 			}
-		//case 2000: // Transfer
 		default:
-			app := parseApp(s, msg, appType)
+			app := parseApp(msg, appType)
 			if app != nil {
 				event.Type = common.EventApp
 				event.Data = app
 			} else {
+				logParseFailure(msg, appType)
 				event.Content = "[应用解析失败]"
+				if s.config.Wechat.UnknownAppAsText {
+					if text := parseAppText(msg); len(text) > 0 {
+						event.Content = fmt.Sprintf("[app:%d] %s", appType, text)
+					} else {
+						event.Content = fmt.Sprintf("[应用解析失败: app:%d]", appType)
+					}
+				}
 			}
 		}
 	case 50: // private voip
 		event.Type = common.EventVoIP
-		event.Content = parsePrivateVoIP(s, msg)
+		event.Content = parsePrivateVoIP(msg)
 		if event.Content == "" {
 			return
 		}
 	case 51: // last message
 		return
 	case 10000: // revoke
-		content := parseRevoke(s, msg)
+		content := parseRevoke(msg)
 		if len(content) > 0 {
 			event.Reply = &common.ReplyInfo{
 				ID: event.ID,
@@ -336,27 +679,144 @@ func (s *Service) processWechatMessage(mxid string, msg *WechatMessage) {
 			event.Type = common.EventSystem
 		}
 	case 10002: // system
-		if msg.Sender == "weixin" || msg.IsSendMsg == 1 {
+		// recalled on phone or by others, replacemsg is what WeChat shows instead
+		if msgID, replace, isSelf := parseRecall(msg); len(msgID) > 0 {
+			event.ID = fmt.Sprint(time.Now().UnixMilli())
+			event.Type = common.EventRevoke
+			event.Content = replace
+			event.Reply = &common.ReplyInfo{ID: msgID}
+			if isSelf || msg.IsSendMsg == 1 {
+				event.From = common.User{ID: msg.Self}
+				event.IsSelf = true
+				if !strings.HasSuffix(msg.Sender, "@chatroom") {
+					event.Chat = common.Chat{ID: msg.Sender}
+				}
+			}
+			break
+		}
+		if msg.IsSendMsg == 1 {
 			return
 		}
+		if notice, ok := parseAnnouncement(msg); ok && s.setTopic(mxid, event, msg, notice) {
+			break
+		}
+		if approval := parseInviteApproval(msg); approval != nil {
+			event.Type = common.EventInviteApproval
+			event.Content = parseSystemMessage(msg, false)
+			event.Data = approval
+			break
+		}
+		if notice := parseLiveLocationNotice(msg); len(notice) > 0 {
+			event.Type = common.EventNotice
+			event.Content = notice
+			break
+		}
+		// security warnings must reach the account owner regardless of verbosity
+		if !strings.HasSuffix(msg.Sender, "@chatroom") {
+			if notice := parseLinkNotice(msg); len(notice) > 0 {
+				event.Type = common.EventNotice
+				event.Content = notice
+				break
+			}
+		}
+		if isSystemContact(msg.Sender) && !s.config.Wechat.VerboseNotices {
+			return
+		}
+		if reaction := parseReaction(msg); reaction != nil {
+			if len(reaction.Reactor) > 0 {
+				event.From = common.User{ID: reaction.Reactor}
+				event.IsSelf = reaction.Reactor == msg.Self
+			}
+			event.Type = common.EventReaction
+			event.Content = reaction.Emoji
+			event.Reply = &common.ReplyInfo{ID: reaction.MsgID}
+			event.Data = reaction
+			break
+		}
 		event.Type = common.EventSystem
-		event.Content = parseSystemMessage(s, msg)
+		event.Content = parseSystemMessage(msg, s.config.Wechat.VerboseNotices)
 		if len(event.Content) == 0 {
+			logParseFailure(msg, 0)
 			return
 		}
 		if event.Content == "You recalled a message" || event.Content == "你撤回了一条消息" {
 			event.From = common.User{ID: msg.Self}
+			event.IsSelf = true
 			if !strings.HasSuffix(msg.Sender, "@chatroom") {
 				event.Chat = common.Chat{ID: msg.WxID}
 			}
 		}
 	}
 
-	s.pushEvent(mxid, event)
+	if !s.shapeSelfEcho(msg, event) {
+		return
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		s.manager.logger(mxid).Warnf("Processing message %d timed out after %v", msg.MsgID, s.config.Wechat.ProcessTimeout)
+	}
+
+	s.sendEvent(mxid, event, func() {
+		messageLatency.Observe(isMediaEvent(event), time.Since(msg.ReceivedAt))
+	})
+}
+
+// text sent from own phone is echoed, operators may tag or suppress it,
+// other self messages (media, recalls, group changes) are kept as is.
+// returns false if the event should be dropped
+func (s *Service) shapeSelfEcho(msg *WechatMessage, event *common.Event) bool {
+	if msg.IsSendMsg != 1 || event.Type != common.EventText {
+		return true
+	}
+	if s.config.Wechat.SuppressSelfEcho {
+		return false
+	}
+
+	event.Content = s.config.Wechat.SelfEchoPrefix + event.Content
+	return true
+}
+
+// locate media of a historical message, nil if it's not a media message or
+// it's gone. nothing is writing it anymore, so it's looked up only once
+// instead of waiting for MediaTimeout
+func (s *Service) downloadMedia(ctx context.Context, mxid string, msg *WechatMessage) *common.BlobData {
+	// images, videos and files are referenced by the message row
+	if msg.MsgType != 34 && msg.MsgType != 47 && len(msg.FilePath) == 0 && len(msg.Thumbnail) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	switch msg.MsgType {
+	case 3: // Image
+		return downloadImage(ctx, s, msg)
+	case 34: // Voice
+		return downloadVoice(ctx, s, msg, s.manager.GetClient(mxid))
+	case 43: // Video
+		return downloadVideo(ctx, s, msg)
+	case 47: // Sticker
+		return downloadSticker(s, msg)
+	case 49: // App
+		if getAppType(msg) == 6 {
+			return downloadFile(ctx, s, msg)
+		}
+	}
+
+	return nil
+}
+
+// raw message may contain private content, so it is only logged at debug level
+func logParseFailure(msg *WechatMessage, appType int) {
+	log.Debugf("[unhandled message] type: %d, app type: %d, msgid: %d, raw: %s", msg.MsgType, appType, msg.MsgID, msg.Message)
 }
 
 // push event ro bridge
 func (s *Service) pushEvent(mxid string, event *common.Event) {
+	s.sendEvent(mxid, event, nil)
+}
+
+// done is called after event is written to bridge
+func (s *Service) sendEvent(mxid string, event *common.Event, done func()) {
 	msg := &common.Message{
 		MXID: mxid,
 		Type: common.MsgRequest,
@@ -367,13 +827,54 @@ func (s *Service) pushEvent(mxid string, event *common.Event) {
 	}
 
 	go func() {
-		log.Debugf("Push event: %+v", event)
+		s.manager.logger(mxid).Debugf("Push event: %+v", event)
 		if err := s.bridge.WriteJSON(msg); err != nil {
-			log.Warnf("Failed to push event %s: %v", event.ID, err)
+			s.manager.logger(mxid).Warnf("Failed to push event %s, retry after reconnect: %v", event.ID, err)
+			s.addPending(&pendingEvent{msg, done})
+		} else if done != nil {
+			done()
 		}
 	}()
 }
 
+func (s *Service) addPending(items ...*pendingEvent) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	s.pending = append(s.pending, items...)
+	if over := len(s.pending) - maxPendingEvents; over > 0 {
+		log.Warnf("Pending events exceed %d, drop %d oldest", maxPendingEvents, over)
+		s.pending = s.pending[over:]
+	}
+}
+
+// resend events failed while bridge was down, stop at first failure
+func (s *Service) flushPending() {
+	s.pendingLock.Lock()
+	items := s.pending
+	s.pending = nil
+	s.pendingLock.Unlock()
+
+	if len(items) == 0 {
+		return
+	}
+
+	log.Infof("Resend %d pending events", len(items))
+	for i, item := range items {
+		if err := s.bridge.WriteJSON(item.msg); err != nil {
+			log.Warnf("Failed to resend pending events: %v", err)
+			s.pendingLock.Lock()
+			rest := s.pending
+			s.pending = nil
+			s.pendingLock.Unlock()
+			s.addPending(append(items[i:], rest...)...)
+			return
+		} else if item.done != nil {
+			item.done()
+		}
+	}
+}
+
 func genResponse(rType common.ResponseType, data any, err error) *common.Response {
 	resp := &common.Response{
 		Type: rType,
@@ -381,7 +882,7 @@ func genResponse(rType common.ResponseType, data any, err error) *common.Respons
 
 	if err != nil {
 		resp.Error = &common.ErrorResponse{
-			Code:    "PROCESS_FAILED",
+			Code:    string(common.GetErrorCode(err)),
 			Message: err.Error(),
 		}
 	} else {
@@ -0,0 +1,713 @@
+package wechat
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/duo/matrix-wechat-agent/internal/common"
+	"github.com/duo/wsc"
+	"github.com/tidwall/gjson"
+)
+
+func TestBridgeOptionsCACert(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, cert, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(config *common.Configure) error {
+		options, err := bridgeOptions(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: options.TLSConfig}}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	config := &common.Configure{}
+	config.Service.Addr = "wss://127.0.0.1/"
+	if err := get(config); err == nil {
+		t.Fatal("expect unknown authority without CA")
+	}
+
+	config.Service.CACert = caFile
+	if err := get(config); err != nil {
+		t.Fatalf("expect CA to be trusted: %v", err)
+	}
+}
+
+func TestBridgeOptionsInvalidCACert(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &common.Configure{}
+	config.Service.Addr = "wss://127.0.0.1/"
+	config.Service.CACert = caFile
+	if _, err := bridgeOptions(config); err == nil {
+		t.Fatal("expect error for invalid CA file")
+	}
+}
+
+func TestIsDuplicateMedia(t *testing.T) {
+	image := func(id uint64, path string) *WechatMessage {
+		return &WechatMessage{MsgID: id, MsgType: 3, Sender: "wxid_bob", FilePath: path}
+	}
+	file := func(id uint64, path string) *WechatMessage {
+		return &WechatMessage{
+			MsgID:    id,
+			MsgType:  49,
+			Sender:   "wxid_bob",
+			Message:  `<msg><appmsg><title>report.pdf</title><type>6</type></appmsg></msg>`,
+			FilePath: path,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		debounce time.Duration
+		msgs     []*WechatMessage
+		want     []bool
+	}{
+		{"image", time.Minute, []*WechatMessage{image(1, "a.dat"), image(1, "a.dat")}, []bool{false, true}},
+		{"image without path", time.Minute, []*WechatMessage{image(1, ""), image(1, "a.dat"), image(1, "a.dat")}, []bool{false, false, true}},
+		{"file", time.Minute, []*WechatMessage{file(1, "report.pdf"), file(1, "report.pdf")}, []bool{false, true}},
+		{"different messages", time.Minute, []*WechatMessage{image(1, "a.dat"), image(2, "a.dat"), file(1, "report.pdf")}, []bool{false, false, false}},
+		{"disabled", 0, []*WechatMessage{image(1, "a.dat"), image(1, "a.dat")}, []bool{false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &common.Configure{}
+			config.Wechat.MediaDebounce = tt.debounce
+			s := &Service{config: config}
+
+			for i, msg := range tt.msgs {
+				key, ok := getMediaKey(msg)
+				got := ok && s.isDuplicateMedia(key)
+				if got != tt.want[i] {
+					t.Errorf("message %d duplicate = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIsDuplicateMediaExpires(t *testing.T) {
+	config := &common.Configure{}
+	config.Wechat.MediaDebounce = 20 * time.Millisecond
+	s := &Service{config: config}
+
+	key, _ := getMediaKey(&WechatMessage{MsgID: 1, MsgType: 3, Sender: "wxid_bob", FilePath: "a.dat"})
+	s.isDuplicateMedia(key)
+	time.Sleep(30 * time.Millisecond)
+	if s.isDuplicateMedia(key) {
+		t.Error("copy after debounce window treated as duplicate")
+	}
+}
+
+func TestMissingMediaDoesNotBlockSender(t *testing.T) {
+	config := &common.Configure{}
+	config.Wechat.MediaTimeout = time.Minute
+	config.Wechat.ProcessTimeout = 100 * time.Millisecond
+
+	m := newTestManager()
+	m.pids[7] = "@alice:example.org"
+	m.clients["@alice:example.org"] = newLoggedInClient(7, "wxid_self")
+
+	s := &Service{
+		config:   config,
+		workdir:  t.TempDir(),
+		location: time.UTC,
+		bridge:   wsc.NewClient(&wsc.ClientOptions{}),
+		manager:  m,
+	}
+
+	processed := make(chan uint64, 2)
+	m.processFunc = func(mxid string, msg *WechatMessage) {
+		s.processWechatMessage(mxid, msg)
+		processed <- msg.MsgID
+	}
+
+	image := &WechatMessage{PID: 7, MsgID: 1, MsgType: 3, Sender: "wxid_bob", WxID: "wxid_bob", Self: "wxid_self", IsSendByPhone: 1, FilePath: "never.dat"}
+	text := &WechatMessage{PID: 7, MsgID: 2, MsgType: 1, Sender: "wxid_bob", WxID: "wxid_bob", Self: "wxid_self", IsSendByPhone: 1, Message: "hi"}
+
+	start := time.Now()
+	go m.dispatch(image)
+	time.Sleep(10 * time.Millisecond)
+	go m.dispatch(text)
+
+	for _, want := range []uint64{1, 2} {
+		select {
+		case id := <-processed:
+			if id != want {
+				t.Errorf("processed message %d, want %d", id, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d still blocked", want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= config.Wechat.MediaTimeout {
+		t.Errorf("text waited %v for missing media", elapsed)
+	}
+}
+
+func TestShapeSelfEcho(t *testing.T) {
+	tests := []struct {
+		name     string
+		suppress bool
+		prefix   string
+		self     bool
+		typ      common.EventType
+		keep     bool
+		want     string
+	}{
+		{"others untouched", true, "[phone] ", false, common.EventText, true, "hi"},
+		{"suppress self text", true, "", true, common.EventText, false, ""},
+		{"suppress keeps self media", true, "", true, common.EventPhoto, true, "hi"},
+		{"tag self text", false, "[phone] ", true, common.EventText, true, "[phone] hi"},
+		{"tag skips self media", false, "[phone] ", true, common.EventPhoto, true, "hi"},
+		{"disabled", false, "", true, common.EventText, true, "hi"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &common.Configure{}
+			config.Wechat.SuppressSelfEcho = tt.suppress
+			config.Wechat.SelfEchoPrefix = tt.prefix
+			s := &Service{config: config}
+
+			msg := &WechatMessage{MsgType: 1}
+			if tt.self {
+				msg.IsSendMsg = 1
+			}
+			event := &common.Event{Type: tt.typ, Content: "hi"}
+
+			if keep := s.shapeSelfEcho(msg, event); keep != tt.keep {
+				t.Fatalf("shapeSelfEcho() = %v, want %v", keep, tt.keep)
+			}
+			if tt.keep && event.Content != tt.want {
+				t.Errorf("content = %q, want %q", event.Content, tt.want)
+			}
+		})
+	}
+}
+
+func TestDispatchRequestLimitsConcurrency(t *testing.T) {
+	const limit, total = 2, 10
+
+	var lock sync.Mutex
+	var active, peak, handled int
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		if api != WECHAT_DATABASE_QUERY {
+			return nil
+		}
+		lock.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		lock.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		lock.Lock()
+		active--
+		handled++
+		lock.Unlock()
+		return queryResult([]string{"group"})
+	})
+
+	m := newTestManager()
+	m.clients["@alice:example.org"] = client
+	s := &Service{
+		config:   &common.Configure{},
+		manager:  m,
+		requests: make(chan struct{}, limit),
+	}
+
+	for i := 0; i < total; i++ {
+		s.dispatchRequest(context.Background(), 0, "@alice:example.org", &common.Request{
+			Type: common.ReqGetChatroomName,
+			Data: []string{"24503927881@chatroom"},
+		})
+	}
+	// every slot is free again once all handlers are done
+	for i := 0; i < limit; i++ {
+		s.requests <- struct{}{}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if handled != total {
+		t.Errorf("%d requests handled, want %d", handled, total)
+	}
+	if peak > limit {
+		t.Errorf("%d handlers ran concurrently, want at most %d", peak, limit)
+	}
+}
+
+// MSG.BytesExtra as returned by the robot, repeated field 3 {1: key, 2: value}
+func bytesExtra(info map[int]string) string {
+	var data []byte
+	for key, value := range info {
+		var pair []byte
+		pair = append(pair, 1<<3|0)
+		pair = binary.AppendUvarint(pair, uint64(key))
+		pair = append(pair, 2<<3|2)
+		pair = binary.AppendUvarint(pair, uint64(len(value)))
+		pair = append(pair, value...)
+
+		data = append(data, 3<<3|2)
+		data = binary.AppendUvarint(data, uint64(len(pair)))
+		data = append(data, pair...)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestDownloadMediaOfHistoricalMessage(t *testing.T) {
+	// MsgSvrID, CreateTime, StrTalker, IsSender, Type, StrContent, BytesExtra
+	messages := map[string][]string{
+		"1": {"1", "1650000000", "wxid_bob", "0", "3", "", bytesExtra(map[int]string{EXTRA_FILE_PATH: "Image/2022-04/present.dat"})},
+		"2": {"2", "1650000000", "wxid_bob", "0", "3", "", bytesExtra(map[int]string{EXTRA_FILE_PATH: "Image/2022-04/gone.dat"})},
+		"3": {"3", "1650000000", "wxid_bob", "0", "3", "", ""},
+		"4": {"4", "1650000000", "wxid_bob", "0", "34", `<msg><voicemsg clientmsgid="voice4" /></msg>`, ""},
+	}
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		if api != WECHAT_DATABASE_QUERY {
+			return nil
+		}
+		sql := gjson.GetBytes(body, "sql").String()
+		for id, row := range messages {
+			if strings.Contains(sql, "MsgSvrID="+id) {
+				return queryResult(row)
+			}
+		}
+		// no voice in Media
+		return queryResult()
+	})
+	client.selfID.Store("wxid_self")
+
+	config := &common.Configure{}
+	config.Wechat.MediaTimeout = time.Minute
+	s := &Service{config: config, workdir: t.TempDir()}
+	if err := os.MkdirAll(filepath.Join(s.workdir, "wxid_self"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.workdir, "wxid_self", "present.jpg"), []byte("jpeg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newTestManager()
+	m.clients["@alice:example.org"] = client
+	m.downloadFunc = s.downloadMedia
+	s.manager = m
+
+	tests := []struct {
+		name  string
+		msgID uint64
+		want  string
+	}{
+		{"present", 1, "present.dat.jpg"},
+		{"file gone", 2, ""},
+		{"no media row", 3, ""},
+		{"voice not in db", 4, ""},
+		{"unknown message", 5, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			blob, err := m.DownloadMedia(context.Background(), "@alice:example.org", tt.msgID)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("DownloadMedia() took %v", elapsed)
+			}
+			if len(tt.want) == 0 {
+				if err == nil {
+					t.Fatalf("DownloadMedia() = %+v, want error", blob)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if blob.Name != tt.want {
+				t.Errorf("DownloadMedia() name = %s, want %s", blob.Name, tt.want)
+			}
+		})
+	}
+
+	if _, err := m.DownloadMedia(context.Background(), "@alice:example.org", 2); common.GetErrorCode(err) != common.CodeNotFound {
+		t.Errorf("DownloadMedia() of missing file error = %v, want not found", err)
+	}
+}
+
+func TestAnnouncementSetsTopic(t *testing.T) {
+	const (
+		announcementXML = `<sysmsg type="mmchatroombarannouncememt">
+	<mmchatroombarannouncememt>
+		<content><![CDATA[本周五下午团建，请大家准时参加]]></content>
+		<xmlcontent><![CDATA[]]></xmlcontent>
+		<ispublish>1</ispublish>
+	</mmchatroombarannouncememt>
+</sysmsg>`
+		// edited on phone, content has to be loaded from group info
+		emptyXML = `<sysmsg type="mmchatroombarannouncememt"><mmchatroombarannouncememt><content><![CDATA[]]></content></mmchatroombarannouncememt></sysmsg>`
+	)
+
+	tests := []struct {
+		name   string
+		sender string
+		xml    string
+		want   *common.GroupInfo
+	}{
+		{"announcement", "24503927881@chatroom", announcementXML, &common.GroupInfo{
+			ID:           "24503927881@chatroom",
+			Notice:       "本周五下午团建，请大家准时参加",
+			NoticeEditor: "wxid_alice",
+			NoticeTime:   1658212345000,
+		}},
+		{"private chat", "wxid_alice", announcementXML, nil},
+		{"content unavailable", "24503927881@chatroom", emptyXML, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{config: &common.Configure{}, manager: newTestManager()}
+			msg := &WechatMessage{MsgType: 10002, Sender: tt.sender, WxID: "wxid_alice", Message: tt.xml}
+			event := &common.Event{Type: common.EventNotice, Timestamp: 1658212345000}
+
+			notice, ok := parseAnnouncement(msg)
+			if !ok {
+				t.Fatal("parseAnnouncement() not recognized")
+			}
+			if got := s.setTopic("@alice:example.org", event, msg, notice); got != (tt.want != nil) {
+				t.Fatalf("setTopic() = %v, want %v", got, tt.want != nil)
+			}
+			if tt.want == nil {
+				return
+			}
+			if event.Type != common.EventTopic || event.Content != tt.want.Notice {
+				t.Errorf("event = %s %q, want topic %q", event.Type, event.Content, tt.want.Notice)
+			}
+			if got := event.Data.(*common.GroupInfo); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topic = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, ok := parseAnnouncement(&WechatMessage{Message: recallXML}); ok {
+		t.Error("parseAnnouncement() recognized a recall")
+	}
+}
+
+func TestGenResponseErrorCode(t *testing.T) {
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		switch api {
+		case WECHAT_MSG_SEND_TEXT:
+			return map[string]any{"result": "ERROR", "msg": "不是好友"}
+		case WECHAT_DATABASE_QUERY:
+			return queryResult()
+		}
+		return nil
+	})
+	_, notFriend := client.SendText("wxid_bob", "hi")
+	_, notFound := client.GetUserInfo("wxid_nobody")
+	unavailable := (&Client{port: 1}).checkLogin()
+
+	tests := []struct {
+		name string
+		err  error
+		want common.ErrorCode
+	}{
+		{"robot error", notFriend, common.CodeNotFriend},
+		{"not found", notFound, common.CodeNotFound},
+		{"robot down", unavailable, common.CodeRobotUnavailable},
+		{"wrapped", fmt.Errorf("failed to send: %w", ErrRateLimited), common.CodeRateLimited},
+		{"uncoded", errors.New("boom"), common.CodeProcessFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := genResponse(common.RespEvent, "ignored", tt.err)
+			if resp.Error == nil {
+				t.Fatalf("genResponse(%v) has no error", tt.err)
+			}
+			if resp.Error.Code != string(tt.want) || resp.Error.Message != tt.err.Error() {
+				t.Errorf("error = %s %q, want %s %q", resp.Error.Code, resp.Error.Message, tt.want, tt.err)
+			}
+			if resp.Data != nil {
+				t.Errorf("data = %v, want nil on error", resp.Data)
+			}
+		})
+	}
+
+	if resp := genResponse(common.RespEvent, "ok", nil); resp.Error != nil || resp.Data != "ok" {
+		t.Errorf("genResponse() = %+v, want data only", resp)
+	}
+}
+
+// fakeBridge records written messages, writes fail while down
+type fakeBridge struct {
+	mu      sync.Mutex
+	down    bool
+	onWrite func()
+	written []string
+	events  chan *common.Event
+}
+
+func (b *fakeBridge) Connect() error       { return nil }
+func (b *fakeBridge) Disconnect()          {}
+func (b *fakeBridge) ReadJSON(v any) error { return errors.New("not implemented") }
+
+func (b *fakeBridge) WriteJSON(v any) error {
+	if b.onWrite != nil {
+		b.onWrite()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return errors.New("websocket: close sent")
+	}
+	event := v.(*common.Message).Data.(*common.Request).Data.(*common.Event)
+	b.written = append(b.written, event.ID)
+	if b.events != nil {
+		b.events <- event
+	}
+	return nil
+}
+
+func pendingIDs(s *Service) []string {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	var ids []string
+	for _, item := range s.pending {
+		ids = append(ids, item.msg.Data.(*common.Request).Data.(*common.Event).ID)
+	}
+	return ids
+}
+
+func newPendingEvent(id string, done func()) *pendingEvent {
+	return &pendingEvent{
+		msg: &common.Message{
+			Type: common.MsgRequest,
+			Data: &common.Request{Type: common.ReqEvent, Data: &common.Event{ID: id}},
+		},
+		done: done,
+	}
+}
+
+func TestAddPendingDropsOldest(t *testing.T) {
+	s := &Service{}
+	for i := 0; i < maxPendingEvents+5; i++ {
+		s.addPending(newPendingEvent(fmt.Sprint(i), nil))
+	}
+
+	ids := pendingIDs(s)
+	if len(ids) != maxPendingEvents {
+		t.Fatalf("%d pending events, want %d", len(ids), maxPendingEvents)
+	}
+	if ids[0] != "5" || ids[len(ids)-1] != fmt.Sprint(maxPendingEvents+4) {
+		t.Errorf("pending events from %s to %s, want 5 to %d", ids[0], ids[len(ids)-1], maxPendingEvents+4)
+	}
+}
+
+func TestFlushPendingKeepsOrder(t *testing.T) {
+	bridge := &fakeBridge{}
+	s := &Service{bridge: bridge}
+
+	var done []string
+	for _, id := range []string{"1", "2", "3", "4"} {
+		id := id
+		s.addPending(newPendingEvent(id, func() { done = append(done, id) }))
+	}
+
+	// connection drops again at the third event, while a new event fails to push
+	writes := 0
+	bridge.onWrite = func() {
+		writes++
+		if writes == 3 {
+			bridge.mu.Lock()
+			bridge.down = true
+			bridge.mu.Unlock()
+			s.addPending(newPendingEvent("5", nil))
+		}
+	}
+	s.flushPending()
+
+	if want := []string{"1", "2"}; !reflect.DeepEqual(bridge.written, want) {
+		t.Errorf("written %v, want %v", bridge.written, want)
+	}
+	if want := []string{"1", "2"}; !reflect.DeepEqual(done, want) {
+		t.Errorf("done %v, want %v", done, want)
+	}
+	if want := []string{"3", "4", "5"}; !reflect.DeepEqual(pendingIDs(s), want) {
+		t.Errorf("pending %v, want %v", pendingIDs(s), want)
+	}
+
+	bridge.onWrite = nil
+	bridge.down = false
+	s.flushPending()
+
+	if want := []string{"1", "2", "3", "4", "5"}; !reflect.DeepEqual(bridge.written, want) {
+		t.Errorf("written %v, want %v", bridge.written, want)
+	}
+	if want := []string{"1", "2", "3", "4"}; !reflect.DeepEqual(done, want) {
+		t.Errorf("done %v, want %v", done, want)
+	}
+	if ids := pendingIDs(s); len(ids) > 0 {
+		t.Errorf("pending %v after flush, want none", ids)
+	}
+}
+
+func TestDedupCacheSize(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		kept int
+	}{
+		{"configured", 3, 3},
+		{"default", 0, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &common.Configure{}
+			config.Wechat.MediaDebounce = time.Minute
+			s := &Service{config: config, manager: newTestManager()}
+			s.resizeDedup(tt.size)
+
+			// sent by hook, the echo is skipped by msgid
+			for id := uint64(1); id <= 5; id++ {
+				s.processWechatMessage("@alice:example.org", &WechatMessage{MsgID: id, MsgType: 1, Sender: "wxid_bob"})
+			}
+			for id := uint64(1); id <= 5; id++ {
+				_, ok := s.history.Get(id)
+				if want := id > uint64(5-tt.kept); ok != want {
+					t.Errorf("msgid %d remembered = %v, want %v", id, ok, want)
+				}
+			}
+
+			var keys []mediaKey
+			for id := uint64(1); id <= 5; id++ {
+				key, _ := getMediaKey(&WechatMessage{MsgID: id, MsgType: 3, Sender: "wxid_bob", FilePath: "a.dat"})
+				keys = append(keys, key)
+				s.isDuplicateMedia(key)
+			}
+			if got, want := s.isDuplicateMedia(keys[0]), tt.kept == 5; got != want {
+				t.Errorf("first media duplicate = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDisconnectAll(t *testing.T) {
+	tests := []struct {
+		name     string
+		mxid     string
+		wantCode common.ErrorCode
+		remained int
+	}{
+		{"admin", "@admin:example.org", "", 0},
+		{"not admin", "@alice:example.org", common.CodeForbidden, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &common.Configure{}
+			config.Service.Admins = []string{"@admin:example.org"}
+			config.Wechat.RestoreSessions = true
+			config.Wechat.Workdir = t.TempDir()
+
+			m := newTestManager()
+			m.config = config
+			m.clients["@alice:example.org"] = newLoggedInClient(1001, "wxid_alice")
+			m.clients["@bob:example.org"] = newLoggedInClient(1002, "wxid_bob")
+			m.pids[1001] = "@alice:example.org"
+			m.pids[1002] = "@bob:example.org"
+			m.saveSessions()
+			s := &Service{config: config, manager: m}
+
+			resp := s.actuallyHandleRequest(context.Background(), tt.mxid, &common.Request{Type: common.ReqDisconnectAll})
+			if len(tt.wantCode) > 0 {
+				if resp.Error == nil || resp.Error.Code != string(tt.wantCode) {
+					t.Fatalf("error = %+v, want %s", resp.Error, tt.wantCode)
+				}
+			} else if resp.Error != nil || resp.Data != 2 {
+				t.Fatalf("response = %v %+v, want 2 disconnected", resp.Data, resp.Error)
+			}
+			if len(m.clients) != tt.remained || len(m.pids) != tt.remained {
+				t.Errorf("%d clients and %d pids left, want %d", len(m.clients), len(m.pids), tt.remained)
+			}
+			// disconnected clients are not restored on next start
+			sessions := loadSessions(filepath.Join(config.Wechat.Workdir, SESSION_FILE))
+			if len(sessions) != tt.remained {
+				t.Errorf("%d sessions saved, want %d", len(sessions), tt.remained)
+			}
+		})
+	}
+}
+
+func TestUnknownAppAsText(t *testing.T) {
+	const redPacketXML = `<msg><appmsg><title></title><des>收到红包，请在手机上查看</des><type>2001</type>` +
+		`<url>https://wxapp.tenpay.com/mmpayhb/wxhb_personalreceive</url></appmsg></msg>`
+	const blankXML = `<msg><appmsg><title></title><des> </des><type>2001</type></appmsg></msg>`
+
+	tests := []struct {
+		name   string
+		asText bool
+		xml    string
+		want   string
+	}{
+		{"disabled", false, redPacketXML, "[应用解析失败]"},
+		{"text", true, redPacketXML, "[app:2001] 收到红包，请在手机上查看\nhttps://wxapp.tenpay.com/mmpayhb/wxhb_personalreceive"},
+		{"no text", true, blankXML, "[应用解析失败: app:2001]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &common.Configure{}
+			config.Wechat.UnknownAppAsText = tt.asText
+			bridge := &fakeBridge{events: make(chan *common.Event, 1)}
+			s := &Service{config: config, manager: newTestManager(), bridge: bridge}
+			s.resizeDedup(0)
+
+			s.processWechatMessage("@alice:example.org", &WechatMessage{
+				MsgID:         1,
+				MsgType:       49,
+				Sender:        "wxid_bob",
+				WxID:          "wxid_bob",
+				Self:          "wxid_alice",
+				IsSendByPhone: 1,
+				Message:       tt.xml,
+			})
+
+			select {
+			case event := <-bridge.events:
+				if event.Type != common.EventText || event.Content != tt.want {
+					t.Errorf("event = %s %q, want text %q", event.Type, event.Content, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no event pushed")
+			}
+		})
+	}
+}
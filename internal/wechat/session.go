@@ -0,0 +1,38 @@
+package wechat
+
+import (
+	"encoding/json"
+	"os"
+)
+
+const SESSION_FILE = "sessions.json"
+
+// last known state of a client, used to re-attach after agent restarts
+type session struct {
+	PID     uintptr `json:"pid"`
+	Port    int32   `json:"port"`
+	IsLogin bool    `json:"is_login"`
+}
+
+func loadSessions(path string) map[string]*session {
+	sessions := map[string]*session{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return sessions
+	}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return map[string]*session{}
+	}
+
+	return sessions
+}
+
+func saveSessions(path string, sessions map[string]*session) error {
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,156 @@
+package wechat
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/duo/matrix-wechat-agent/internal/common"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MEDIA_STORE_LOCAL = "local"
+	MEDIA_STORE_S3    = "s3"
+
+	// only media written by agent for sending is kept here
+	MEDIA_OUTGOING_DIR = "outgoing"
+)
+
+// MediaStore keeps outgoing media until it is sent to WeChat.
+type MediaStore interface {
+	// Put saves the data with the given name and returns the key to access it.
+	Put(name string, data []byte) (string, error)
+	// Fetch makes the stored media available at a local path WeChat can read.
+	Fetch(key string) (string, error)
+	// Release cleans up the local path returned by Fetch.
+	Release(path string) error
+}
+
+func NewMediaStore(config *common.Configure) (MediaStore, error) {
+	switch config.Wechat.MediaStore.Type {
+	case "", MEDIA_STORE_LOCAL:
+		return &LocalStore{dir: filepath.Join(config.Wechat.Workdir, MEDIA_OUTGOING_DIR)}, nil
+	case MEDIA_STORE_S3:
+		return &S3Store{
+			dir:       filepath.Join(config.Wechat.Workdir, MEDIA_OUTGOING_DIR),
+			endpoint:  config.Wechat.MediaStore.S3.Endpoint,
+			bucket:    config.Wechat.MediaStore.S3.Bucket,
+			accessKey: config.Wechat.MediaStore.S3.AccessKey,
+			secretKey: config.Wechat.MediaStore.S3.SecretKey,
+		}, nil
+	default:
+		return nil, fmt.Errorf("media store type not support: %s", config.Wechat.MediaStore.Type)
+	}
+}
+
+// LocalStore saves media into the agent workdir.
+type LocalStore struct {
+	dir string
+}
+
+func (s *LocalStore) Put(name string, data []byte) (string, error) {
+	path := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func (s *LocalStore) Fetch(key string) (string, error) {
+	if !pathExists(key) {
+		return "", fmt.Errorf("media %s not found", key)
+	}
+
+	return key, nil
+}
+
+func (s *LocalStore) Release(path string) error {
+	if err := removeFile(path); err != nil {
+		return err
+	}
+
+	// drop the per send directory, kept if anything else is still inside
+	if dir := filepath.Dir(path); filepath.Dir(dir) != s.dir && dir != s.dir {
+		os.Remove(dir)
+	}
+
+	return nil
+}
+
+// S3Store saves media into a S3-compatible bucket.
+// TODO: not implemented yet
+type S3Store struct {
+	dir       string
+	endpoint  string
+	bucket    string
+	accessKey string
+	secretKey string
+}
+
+func (s *S3Store) Put(name string, data []byte) (string, error) {
+	return "", fmt.Errorf("s3 media store (%s/%s) not implemented", s.endpoint, s.bucket)
+}
+
+func (s *S3Store) Fetch(key string) (string, error) {
+	return "", fmt.Errorf("s3 media store (%s/%s) not implemented", s.endpoint, s.bucket)
+}
+
+func (s *S3Store) Release(path string) error {
+	// fetched file is a temp copy of the stored object
+	return removeFile(path)
+}
+
+// remove leftover outgoing media older than maxAge
+func sweepOutgoing(dir string, maxAge time.Duration) {
+	if maxAge <= 0 {
+		return
+	}
+
+	var dirs []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			return nil
+		}
+
+		if err := removeFile(path); err != nil {
+			log.Warnf("Failed to remove outgoing media %s: %v", path, err)
+		} else {
+			log.Debugf("Removed outgoing media %s", path)
+		}
+
+		return nil
+	})
+
+	// per send directories left empty, deepest first so parents can go too
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
+
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -1,6 +1,11 @@
 package wechat
 
-import "github.com/duo/matrix-wechat-agent/internal/common"
+import (
+	"fmt"
+	"time"
+
+	"github.com/duo/matrix-wechat-agent/internal/common"
+)
 
 type WxIsLoginResp struct {
 	IsLogin int    `json:"is_login"`
@@ -33,15 +38,27 @@ type WxGetGroupMembersResp struct {
 }
 
 type WxContactResp struct {
+	Data   [][8]string `json:"data,omitempty"`
+	Result string      `json:"result"`
+}
+
+// row of favorite query: LocalId, Type, UpdateTime, FromUser, XmlBuf
+type WxFavoriteResp struct {
 	Data   [][5]string `json:"data,omitempty"`
 	Result string      `json:"result"`
 }
 
+// row of contact query: UserName, NickName, BigHeadImgUrl, SmallHeadImgUrl, Remark, Alias, Type, VerifyFlag
+type WxContact = [8]string
+
 type WxUserInfo struct {
-	ID        string `json:"wxId"`
-	Nickname  string `json:"wxNickName"`
-	BigAvatar string `json:"wxBigAvatar"`
-	Remark    string `json:"wxRemark"`
+	ID          string `json:"wxId"`
+	Alias       string `json:"wxNumber"`
+	Nickname    string `json:"wxNickName"`
+	BigAvatar   string `json:"wxBigAvatar"`
+	SmallAvatar string `json:"wxSmallAvatar"`
+	Signature   string `json:"wxSignature"`
+	Remark      string `json:"wxRemark"`
 }
 
 func (w *WxUserInfo) toUserInfo() *common.UserInfo {
@@ -49,20 +66,45 @@ func (w *WxUserInfo) toUserInfo() *common.UserInfo {
 		return nil
 	}
 
+	avatar := w.BigAvatar
+	if len(avatar) == 0 {
+		avatar = w.SmallAvatar
+	}
+
 	return &common.UserInfo{
-		ID:     w.ID,
-		Name:   w.Nickname,
-		Avatar: w.BigAvatar,
-		Remark: w.Remark,
+		ID:        w.ID,
+		Alias:     w.Alias,
+		Name:      w.Nickname,
+		Avatar:    avatar,
+		Signature: w.Signature,
+		Remark:    w.Remark,
 	}
 }
 
+func contactToUserInfo(c WxContact) *WxUserInfo {
+	info := &WxUserInfo{
+		ID:        c[0],
+		Nickname:  c[1],
+		BigAvatar: c[2],
+		Remark:    c[4],
+		Alias:     c[5],
+	}
+	if len(info.BigAvatar) == 0 {
+		info.BigAvatar = c[3]
+	}
+
+	return info
+}
+
 type WxGroupInfo struct {
-	ID        string   `json:"wxId"`
-	Name      string   `json:"wxNickName"`
-	BigAvatar string   `json:"wxBigAvatar"`
-	Notice    string   `json:"notice"`
-	Members   []string `json:"members"`
+	ID           string   `json:"wxId"`
+	Name         string   `json:"wxNickName"`
+	BigAvatar    string   `json:"wxBigAvatar"`
+	Notice       string   `json:"notice"`
+	NoticeEditor string   `json:"noticeEditor"`
+	NoticeTime   int64    `json:"noticeTime"`
+	Owner        string   `json:"owner"`
+	Members      []string `json:"members"`
 }
 
 func (w *WxGroupInfo) toGroupInfo() *common.GroupInfo {
@@ -71,11 +113,14 @@ func (w *WxGroupInfo) toGroupInfo() *common.GroupInfo {
 	}
 
 	return &common.GroupInfo{
-		ID:      w.ID,
-		Name:    w.Name,
-		Avatar:  w.BigAvatar,
-		Notice:  w.Notice,
-		Members: w.Members,
+		ID:           w.ID,
+		Name:         w.Name,
+		Avatar:       w.BigAvatar,
+		Notice:       w.Notice,
+		NoticeEditor: w.NoticeEditor,
+		NoticeTime:   w.NoticeTime,
+		Owner:        w.Owner,
+		Members:      w.Members,
 	}
 }
 
@@ -94,4 +139,44 @@ type WechatMessage struct {
 	FilePath      string `json:"filepath"`
 	Thumbnail     string `json:"thumb_path"`
 	ExtraInfo     string `json:"extrainfo"`
+
+	ReceivedAt time.Time `json:"-"`
+}
+
+// message types WeChat is known to send, unhandled ones are still valid
+var knownMsgTypes = map[int]struct{}{
+	1: {}, 3: {}, 34: {}, 37: {}, 40: {}, 42: {}, 43: {}, 47: {}, 48: {}, 49: {},
+	50: {}, 51: {}, 52: {}, 53: {}, 62: {}, 9999: {}, 10000: {}, 10002: {},
+}
+
+func (w *WechatMessage) validate() error {
+	if w.MsgID == 0 {
+		return fmt.Errorf("missing msgid")
+	}
+	if _, ok := knownMsgTypes[w.MsgType]; !ok {
+		return fmt.Errorf("unknown type %d of message %d", w.MsgType, w.MsgID)
+	}
+	if len(w.Sender) == 0 {
+		return fmt.Errorf("missing sender of message %d", w.MsgID)
+	}
+
+	return nil
+}
+
+func (w *WechatMessage) toMessageInfo() *common.MessageInfo {
+	if w == nil {
+		return nil
+	}
+
+	return &common.MessageInfo{
+		ID:        fmt.Sprint(w.MsgID),
+		Timestamp: w.Timestamp * 1000,
+		Chat:      w.Sender,
+		From:      w.WxID,
+		IsSelf:    w.IsSendMsg == 1,
+		Type:      w.MsgType,
+		Content:   w.Message,
+		FilePath:  w.FilePath,
+		Thumbnail: w.Thumbnail,
+	}
 }
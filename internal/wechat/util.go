@@ -1,27 +1,43 @@
 package wechat
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/duo/matrix-wechat-agent/internal/common"
 
 	"github.com/antchfx/xmlquery"
-	"golang.org/x/sys/windows/registry"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	qrCodeLifetime     = 2 * time.Minute
+	maxMediaCandidates = 6
 )
 
 var (
@@ -34,26 +50,196 @@ var (
 		},
 	}
 
-	UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/87.0.4280.88 Safari/537.36 Edg/87.0.664.66"
+	UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+	// extra headers required by some CDN endpoints, e.g. Referer
+	Headers = map[string]string{}
+
+	// encoding of name fields in DB, legacy builds may store GBK
+	nameEncoding = NAME_ENCODING_AUTO
 )
 
-func LoadDriver() syscall.Handle {
-	var driverDLL string
-	if runtime.GOARCH == "amd64" {
-		driverDLL = "wxDriver64.dll"
-	} else {
-		driverDLL = "wxDriver.dll"
+const (
+	NAME_ENCODING_AUTO = "auto"
+	NAME_ENCODING_UTF8 = "utf8"
+	NAME_ENCODING_GBK  = "gbk"
+)
+
+func SetHeaders(userAgent string, headers map[string]string) {
+	if len(userAgent) > 0 {
+		UserAgent = userAgent
+	}
+	for k, v := range headers {
+		Headers[k] = v
+	}
+}
+
+func SetNameEncoding(encoding string) error {
+	switch strings.ToLower(encoding) {
+	case "", NAME_ENCODING_AUTO:
+		nameEncoding = NAME_ENCODING_AUTO
+	case NAME_ENCODING_UTF8, "utf-8":
+		nameEncoding = NAME_ENCODING_UTF8
+	case NAME_ENCODING_GBK:
+		nameEncoding = NAME_ENCODING_GBK
+	default:
+		return fmt.Errorf("unknown name encoding %q", encoding)
+	}
+
+	return nil
+}
+
+// auto only transcodes names which aren't valid UTF-8
+func decodeName(name string) string {
+	switch nameEncoding {
+	case NAME_ENCODING_UTF8:
+		return name
+	case NAME_ENCODING_AUTO:
+		if utf8.ValidString(name) {
+			return name
+		}
+	}
+
+	decoded, err := simplifiedchinese.GBK.NewDecoder().String(name)
+	if err != nil {
+		return name
+	}
+
+	return decoded
+}
+
+// proxy only applies to outbound CDN fetches, not the robot API
+func SetProxy(proxy string) error {
+	if len(proxy) == 0 {
+		return nil
 	}
 
-	driver, err := syscall.LoadLibrary(driverDLL)
+	u, err := url.Parse(proxy)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("proxy scheme not support: %s", u.Scheme)
 	}
 
-	return driver
+	httpClient.Transport.(*http.Transport).Proxy = http.ProxyURL(u)
+
+	return nil
+}
+
+var msgTypeNames = map[string]int{
+	"text":     1,
+	"image":    3,
+	"voice":    34,
+	"card":     42,
+	"video":    43,
+	"sticker":  47,
+	"location": 48,
+	"app":      49,
+	"voip":     50,
+	"revoke":   10000,
+	"system":   10002,
+}
+
+var appTypeNames = map[string][]int{
+	"link":         {5},
+	"file":         {6},
+	"mini_program": {33, 36},
+	"reply":        {57},
+	"channels":     {51, 63},
+	"transfer":     {2000},
+	// live location sharing, join and stop notices are plain system messages
+	"live_location": {17},
 }
 
-func getMentions(s *Service, msg *WechatMessage) []string {
+// types are given by WeChat msgType number, symbolic name, or "app:<type>" for app messages
+func parseIgnoreTypes(names []string) (map[int]struct{}, map[int]struct{}, error) {
+	types := map[int]struct{}{}
+	appTypes := map[int]struct{}{}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if t, ok := msgTypeNames[name]; ok {
+			types[t] = struct{}{}
+		} else if ts, ok := appTypeNames[name]; ok {
+			for _, t := range ts {
+				appTypes[t] = struct{}{}
+			}
+		} else if strings.HasPrefix(name, "app:") {
+			t, err := strconv.Atoi(strings.TrimPrefix(name, "app:"))
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid app type %s", name)
+			}
+			appTypes[t] = struct{}{}
+		} else if t, err := strconv.Atoi(name); err == nil {
+			types[t] = struct{}{}
+		} else {
+			return nil, nil, fmt.Errorf("unknown message type %s", name)
+		}
+	}
+
+	return types, appTypes, nil
+}
+
+func getTimestamp(msg *WechatMessage, location *time.Location) int64 {
+	if msg.Timestamp > 0 {
+		return msg.Timestamp * 1000
+	}
+
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", msg.Time, location)
+	if err != nil {
+		return time.Now().UnixMilli()
+	}
+
+	return t.UnixMilli()
+}
+
+// pseudo contacts used by WeChat itself
+var systemContacts = map[string]struct{}{
+	"filehelper":  {},
+	"fmessage":    {},
+	"floatbottle": {},
+	"medianote":   {},
+	"newsapp":     {},
+	"qmessage":    {},
+	"qqmail":      {},
+	"tmessage":    {},
+	"weixin":      {},
+}
+
+func isSystemContact(wxid string) bool {
+	_, ok := systemContacts[wxid]
+	return ok
+}
+
+func getContactCategory(c WxContact) common.ContactType {
+	if strings.HasSuffix(c[0], "@chatroom") {
+		return common.ContactGroup
+	}
+	if isSystemContact(c[0]) {
+		return common.ContactSystem
+	}
+
+	verifyFlag, _ := strconv.Atoi(c[7])
+	if verifyFlag != 0 || strings.HasPrefix(c[0], "gh_") {
+		return common.ContactOfficial
+	}
+
+	// lowest bit is set for saved contacts, blacklist bit for blocked ones
+	contactType, _ := strconv.Atoi(c[6])
+	if contactType&CONTACT_TYPE_BLACKLIST != 0 {
+		return common.ContactBlocked
+	}
+	if contactType&CONTACT_TYPE_FRIEND != 0 {
+		return common.ContactFriend
+	}
+
+	return common.ContactStranger
+}
+
+func getMentions(msg *WechatMessage) []string {
 	if len(msg.ExtraInfo) == 0 {
 		return nil
 	}
@@ -73,11 +259,24 @@ func getMentions(s *Service, msg *WechatMessage) []string {
 	})
 }
 
-func downloadImage(s *Service, msg *WechatMessage) *common.BlobData {
-	ctx, cancel := context.WithTimeout(context.Background(), s.config.Wechat.RequestTimeout)
+func isMentioned(mentions []string, wxid string) bool {
+	for _, mention := range mentions {
+		if mention == wxid || mention == "notify@all" {
+			return true
+		}
+	}
+	return false
+}
+
+func downloadImage(ctx context.Context, s *Service, msg *WechatMessage) *common.BlobData {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Wechat.MediaTimeout)
 	defer cancel()
 
-	imageFile := filepath.Join(s.workdir, msg.Self, filepath.Base(msg.FilePath))
+	imageDir := filepath.Join(s.workdir, msg.Self)
+	if err := os.MkdirAll(imageDir, 0o755); err != nil {
+		log.Printf("Failed to create image directory %s: %v", imageDir, err)
+	}
+	imageFile := filepath.Join(imageDir, filepath.Base(msg.FilePath))
 
 	baseFile := strings.TrimSuffix(imageFile, filepath.Ext(imageFile))
 	fileName := filepath.Base(msg.FilePath)
@@ -117,7 +316,7 @@ func downloadImage(s *Service, msg *WechatMessage) *common.BlobData {
 	}
 }
 
-func downloadVoice(s *Service, msg *WechatMessage, client *Client) *common.BlobData {
+func downloadVoice(ctx context.Context, s *Service, msg *WechatMessage, client *Client) *common.BlobData {
 	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
 	if err != nil {
 		return nil
@@ -129,19 +328,16 @@ func downloadVoice(s *Service, msg *WechatMessage, client *Client) *common.BlobD
 	}
 	path := node.InnerText()
 
-	ctx, cancel := context.WithTimeout(context.Background(), s.config.Wechat.RequestTimeout)
+	ctx, cancel := context.WithTimeout(ctx, s.config.Wechat.MediaTimeout)
 	defer cancel()
 
 	voiceFile := filepath.Join(s.workdir, msg.Self, path+".amr")
 	for {
-		// check from disk
-		if pathExists(voiceFile) {
-			data, err := os.ReadFile(voiceFile)
-			if err == nil && data != nil {
-				return &common.BlobData{
-					Name:   filepath.Base(voiceFile),
-					Binary: data,
-				}
+		// check from disk, skip stale zero-byte placeholder
+		if data, err := os.ReadFile(voiceFile); err == nil && len(data) > 0 {
+			return &common.BlobData{
+				Name:   filepath.Base(voiceFile),
+				Binary: data,
 			}
 		}
 
@@ -149,9 +345,13 @@ func downloadVoice(s *Service, msg *WechatMessage, client *Client) *common.BlobD
 		if client != nil {
 			if data, err := client.GetVoice(msg.MsgID); err != nil {
 				return nil
-			} else if data != nil {
+			} else if len(data) > 0 {
+				// cache decoded voice, so the next request hits the disk
+				if err := writeFileAtomic(voiceFile, data); err != nil {
+					log.Printf("Failed to cache voice %s: %v", voiceFile, err)
+				}
 				return &common.BlobData{
-					Name:   path + ".amr",
+					Name:   filepath.Base(voiceFile),
 					Binary: data,
 				}
 			}
@@ -165,25 +365,66 @@ func downloadVoice(s *Service, msg *WechatMessage, client *Client) *common.BlobD
 	}
 }
 
-func downloadVideo(s *Service, msg *WechatMessage) *common.BlobData {
-	ctx, cancel := context.WithTimeout(context.Background(), s.config.Wechat.RequestTimeout)
+// concurrent readers never see a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", path, time.Now().UnixNano())
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+type mediaKey struct {
+	sender  string
+	msgID   uint64
+	msgType int
+	appType int
+}
+
+// only messages whose media is downloaded are debounced, a copy without
+// file path yet doesn't count, as the next one carries it
+func getMediaKey(msg *WechatMessage) (mediaKey, bool) {
+	key := mediaKey{sender: msg.Sender, msgID: msg.MsgID, msgType: msg.MsgType}
+	switch msg.MsgType {
+	case 3:
+		return key, len(msg.FilePath) > 0
+	case 34, 47:
+		return key, true
+	case 43:
+		return key, len(msg.FilePath) > 0 || len(msg.Thumbnail) > 0
+	case 49:
+		key.appType = getAppType(msg)
+		return key, (key.appType == 6 || key.appType == 8) && len(msg.FilePath) > 0
+	default:
+		return key, false
+	}
+}
+
+func downloadVideo(ctx context.Context, s *Service, msg *WechatMessage) *common.BlobData {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Wechat.MediaTimeout)
 	defer cancel()
 
-	var videoFile string
-	if len(msg.FilePath) > 0 {
-		videoFile = filepath.Join(s.docdir, msg.FilePath)
-	} else {
-		videoFile = filepath.Join(s.docdir, msg.Thumbnail)
-		videoFile = strings.TrimSuffix(videoFile, filepath.Ext(videoFile))
-		videoFile += ".mp4"
+	videoPath := msg.FilePath
+	if len(videoPath) == 0 {
+		videoPath = strings.TrimSuffix(msg.Thumbnail, filepath.Ext(msg.Thumbnail)) + ".mp4"
 	}
 	for {
-		if pathExists(videoFile) {
+		if videoFile, ok := s.mediaPath(msg, videoPath); ok {
 			data, err := os.ReadFile(videoFile)
 			if err == nil && data != nil {
 				return &common.BlobData{
-					Name:   filepath.Base(videoFile),
-					Binary: data,
+					Name:      filepath.Base(videoFile),
+					Binary:    data,
+					Thumbnail: getVideoThumbnail(s, msg),
 				}
 			}
 		}
@@ -196,6 +437,38 @@ func downloadVideo(s *Service, msg *WechatMessage) *common.BlobData {
 	}
 }
 
+// thumbnail is only a preview, so missing one is not an error
+func getVideoThumbnail(s *Service, msg *WechatMessage) *common.BlobData {
+	if len(msg.Thumbnail) == 0 {
+		return nil
+	}
+
+	thumbFile, ok := s.mediaPath(msg, msg.Thumbnail)
+	if !ok {
+		return nil
+	}
+	data, err := os.ReadFile(thumbFile)
+	if err != nil {
+		return nil
+	}
+
+	thumb := &common.BlobData{
+		Name:   filepath.Base(thumbFile),
+		Binary: data,
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		thumb.Width = config.Width
+		thumb.Height = config.Height
+	} else if doc, err := xmlquery.Parse(strings.NewReader(msg.Message)); err == nil {
+		if node := xmlquery.FindOne(doc, "/msg/videomsg"); node != nil {
+			thumb.Width, _ = strconv.Atoi(node.SelectAttr("cdnthumbwidth"))
+			thumb.Height, _ = strconv.Atoi(node.SelectAttr("cdnthumbheight"))
+		}
+	}
+
+	return thumb
+}
+
 func downloadSticker(s *Service, msg *WechatMessage) *common.BlobData {
 	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
 	if err != nil {
@@ -224,7 +497,7 @@ func downloadSticker(s *Service, msg *WechatMessage) *common.BlobData {
 	}
 }
 
-func parseLocation(s *Service, msg *WechatMessage) *common.LocationData {
+func parseLocation(msg *WechatMessage) *common.LocationData {
 	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
 	if err != nil {
 		return nil
@@ -265,7 +538,7 @@ func parseLocation(s *Service, msg *WechatMessage) *common.LocationData {
 	}
 }
 
-func getAppType(s *Service, msg *WechatMessage) int {
+func getAppType(msg *WechatMessage) int {
 	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
 	if err != nil {
 		return 0
@@ -284,7 +557,7 @@ func getAppType(s *Service, msg *WechatMessage) int {
 	return 0
 }
 
-func parseReply(s *Service, msg *WechatMessage) (string, *common.ReplyInfo) {
+func parseReply(msg *WechatMessage) (string, *common.ReplyInfo) {
 	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
 	if err != nil {
 		return "", nil
@@ -313,10 +586,39 @@ func parseReply(s *Service, msg *WechatMessage) (string, *common.ReplyInfo) {
 		return "", nil
 	}
 
-	return titleNode.InnerText(), &common.ReplyInfo{ID: fmt.Sprint(msgId), Sender: userNode.InnerText()}
+	content := titleNode.InnerText()
+	if typeNode := xmlquery.FindOne(doc, "/msg/appmsg/refermsg/type"); typeNode != nil {
+		if placeholder := getReferPlaceholder(typeNode.InnerText()); len(placeholder) > 0 {
+			content = placeholder + "\n" + content
+		}
+	}
+
+	return content, &common.ReplyInfo{ID: fmt.Sprint(msgId), Sender: userNode.InnerText()}
 }
 
-func parseNotice(s *Service, msg *WechatMessage) string {
+// describe the non-text message being replied to
+func getReferPlaceholder(referType string) string {
+	switch referType {
+	case "3":
+		return "[replied to an image]"
+	case "34":
+		return "[replied to a voice message]"
+	case "42":
+		return "[replied to a contact card]"
+	case "43":
+		return "[replied to a video]"
+	case "47":
+		return "[replied to a sticker]"
+	case "48":
+		return "[replied to a location]"
+	case "49":
+		return "[replied to a file or link]"
+	default:
+		return ""
+	}
+}
+
+func parseNotice(msg *WechatMessage) string {
 	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
 	if err != nil {
 		return ""
@@ -330,7 +632,22 @@ func parseNotice(s *Service, msg *WechatMessage) string {
 	return noticeNode.InnerText()
 }
 
-func parseCard(s *Service, msg *WechatMessage) *common.AppData {
+// announcement change notified by system message, content may be left empty
+func parseAnnouncement(msg *WechatMessage) (string, bool) {
+	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
+	if err != nil {
+		return "", false
+	}
+
+	node := xmlquery.FindOne(doc, "/sysmsg[@type='mmchatroombarannouncememt']/mmchatroombarannouncememt")
+	if node == nil {
+		return "", false
+	}
+
+	return getChildText(node, "content"), true
+}
+
+func parseCard(msg *WechatMessage) *common.AppData {
 	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
 	if err != nil {
 		return nil
@@ -349,12 +666,30 @@ func parseCard(s *Service, msg *WechatMessage) *common.AppData {
 	}
 }
 
-func parseApp(s *Service, msg *WechatMessage, appType int) *common.AppData {
+func parseApp(msg *WechatMessage, appType int) *common.AppData {
 	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
 	if err != nil {
 		return nil
 	}
 
+	// official account article list, the first article is the headline
+	if articles := parseArticles(doc); len(articles) > 0 {
+		var source string
+		if node := xmlquery.FindOne(doc, "/msg/appmsg/mmreader/publisher/nickname"); node != nil {
+			source = node.InnerText()
+		} else if node := xmlquery.FindOne(doc, "/msg/appmsg/mmreader/category/name"); node != nil {
+			source = node.InnerText()
+		}
+		return &common.AppData{
+			Title:       articles[0].Title,
+			Description: articles[0].Digest,
+			Source:      source,
+			URL:         articles[0].URL,
+			Thumb:       articles[0].Cover,
+			Articles:    articles,
+		}
+	}
+
 	switch appType {
 	case 1:
 		titleNode := xmlquery.FindOne(doc, "/msg/appmsg/title")
@@ -383,6 +718,45 @@ func parseApp(s *Service, msg *WechatMessage, appType int) *common.AppData {
 			Source:      "",
 			URL:         "",
 		}
+	case 33, 36: // mini program
+		titleNode := xmlquery.FindOne(doc, "/msg/appmsg/title")
+		if titleNode == nil || len(titleNode.InnerText()) == 0 {
+			return nil
+		}
+		var des string
+		desNode := xmlquery.FindOne(doc, "/msg/appmsg/des")
+		if desNode != nil {
+			des = desNode.InnerText()
+		}
+		var url string
+		urlNode := xmlquery.FindOne(doc, "/msg/appmsg/url")
+		if urlNode != nil {
+			url = urlNode.InnerText()
+		}
+		var source string
+		if sourceNode := xmlquery.FindOne(doc, "/msg/appmsg/sourcedisplayname"); sourceNode != nil {
+			source = sourceNode.InnerText()
+		}
+		miniProgram := &common.MiniProgramData{}
+		if node := xmlquery.FindOne(doc, "/msg/appmsg/weappinfo/username"); node != nil {
+			miniProgram.Username = node.InnerText()
+		}
+		if node := xmlquery.FindOne(doc, "/msg/appmsg/weappinfo/appid"); node != nil {
+			miniProgram.AppID = node.InnerText()
+		}
+		if node := xmlquery.FindOne(doc, "/msg/appmsg/weappinfo/pagepath"); node != nil {
+			miniProgram.PagePath = node.InnerText()
+		}
+		if node := xmlquery.FindOne(doc, "/msg/appmsg/weappinfo/weappiconurl"); node != nil {
+			miniProgram.Icon = node.InnerText()
+		}
+		return &common.AppData{
+			Title:       titleNode.InnerText(),
+			Description: des,
+			Source:      source,
+			URL:         url,
+			MiniProgram: miniProgram,
+		}
 	case 51: // video
 		titleNode := xmlquery.FindOne(doc, "/msg/appmsg/finderFeed/nickname")
 		if titleNode == nil || len(titleNode.InnerText()) == 0 {
@@ -398,11 +772,21 @@ func parseApp(s *Service, msg *WechatMessage, appType int) *common.AppData {
 		if urlNode != nil {
 			url = urlNode.InnerText()
 		}
+		var objectID string
+		if objectNode := xmlquery.FindOne(doc, "/msg/appmsg/finderFeed/objectId"); objectNode != nil {
+			objectID = objectNode.InnerText()
+		}
+		var nonceID string
+		if nonceNode := xmlquery.FindOne(doc, "/msg/appmsg/finderFeed/objectNonceId"); nonceNode != nil {
+			nonceID = nonceNode.InnerText()
+		}
 		return &common.AppData{
 			Title:       titleNode.InnerText(),
 			Description: des,
 			Source:      titleNode.InnerText(),
 			URL:         url,
+			ObjectID:    objectID,
+			NonceID:     nonceID,
 		}
 	case 63: // live
 		titleNode := xmlquery.FindOne(doc, "/msg/appmsg/finderLive/nickname")
@@ -419,11 +803,26 @@ func parseApp(s *Service, msg *WechatMessage, appType int) *common.AppData {
 		if urlNode != nil {
 			url = urlNode.InnerText()
 		}
+		var objectID string
+		if objectNode := xmlquery.FindOne(doc, "/msg/appmsg/finderLive/finderObjectID"); objectNode != nil {
+			objectID = objectNode.InnerText()
+		}
+		var nonceID string
+		if nonceNode := xmlquery.FindOne(doc, "/msg/appmsg/finderLive/finderNonceID"); nonceNode != nil {
+			nonceID = nonceNode.InnerText()
+		}
+		var liveID string
+		if liveNode := xmlquery.FindOne(doc, "/msg/appmsg/finderLive/finderLiveID"); liveNode != nil {
+			liveID = liveNode.InnerText()
+		}
 		return &common.AppData{
 			Title:       titleNode.InnerText(),
 			Description: des,
 			Source:      titleNode.InnerText(),
 			URL:         url,
+			ObjectID:    objectID,
+			NonceID:     nonceID,
+			LiveID:      liveID,
 		}
 	default:
 		titleNode := xmlquery.FindOne(doc, "/msg/appmsg/title")
@@ -455,7 +854,192 @@ func parseApp(s *Service, msg *WechatMessage, appType int) *common.AppData {
 	}
 }
 
-func parseRevoke(s *Service, msg *WechatMessage) string {
+// best effort text of app message whose structure is unknown
+func parseAppText(msg *WechatMessage) string {
+	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
+	if err != nil {
+		return ""
+	}
+
+	var parts []string
+	for _, expr := range []string{"/msg/appmsg/title", "/msg/appmsg/des", "/msg/appmsg/url"} {
+		if node := xmlquery.FindOne(doc, expr); node != nil {
+			if text := strings.TrimSpace(node.InnerText()); len(text) > 0 {
+				parts = append(parts, text)
+			}
+		}
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+func parseArticles(doc *xmlquery.Node) []*common.ArticleData {
+	var articles []*common.ArticleData
+	for _, item := range xmlquery.Find(doc, "/msg/appmsg/mmreader/category/item") {
+		article := &common.ArticleData{
+			Title:  getChildText(item, "title"),
+			Digest: getChildText(item, "digest"),
+			URL:    getChildText(item, "url"),
+			Cover:  getChildText(item, "cover"),
+		}
+		if len(article.Title) > 0 {
+			articles = append(articles, article)
+		}
+	}
+
+	return articles
+}
+
+var favoriteTypeNames = map[string]string{
+	"1":  "text",
+	"2":  "image",
+	"3":  "voice",
+	"4":  "video",
+	"5":  "link",
+	"8":  "file",
+	"14": "note",
+	"18": "chat_history",
+}
+
+func parseFavorite(row [5]string) *common.FavoriteItem {
+	item := &common.FavoriteItem{
+		ID:   row[0],
+		Type: favoriteTypeNames[row[1]],
+		From: row[3],
+	}
+	if len(item.Type) == 0 {
+		item.Type = "unknown"
+	}
+	ts, _ := strconv.ParseInt(row[2], 10, 64)
+	item.Timestamp = ts * 1000
+
+	doc, err := xmlquery.Parse(strings.NewReader(row[4]))
+	if err != nil {
+		return nil
+	}
+	node := xmlquery.FindOne(doc, "/favitem")
+	if node == nil {
+		return nil
+	}
+
+	item.Description = getChildText(node, "desc")
+	if web := node.SelectElement("weburlitem"); web != nil {
+		item.Title = getChildText(web, "pagetitle")
+		if desc := getChildText(web, "pagedesc"); len(desc) > 0 {
+			item.Description = desc
+		}
+	}
+	item.URL = getChildText(node, "link")
+
+	// first data item carries the media
+	if data := xmlquery.FindOne(node, "./datalist/dataitem"); data != nil {
+		if len(item.Title) == 0 {
+			item.Title = getChildText(data, "datatitle")
+		}
+		if len(item.Description) == 0 {
+			item.Description = getChildText(data, "datadesc")
+		}
+		if ext := getChildText(data, "datafmt"); len(item.Title) > 0 && len(ext) > 0 && item.Type == "file" {
+			item.FileName = item.Title
+			if !strings.HasSuffix(item.FileName, "."+ext) {
+				item.FileName += "." + ext
+			}
+		}
+		item.FileSize, _ = strconv.ParseInt(getChildText(data, "fullsize"), 10, 64)
+		item.CDNURL = getChildText(data, "cdn_dataurl")
+		item.CDNKey = getChildText(data, "cdn_datakey")
+		item.MD5 = getChildText(data, "fullmd5")
+	}
+
+	return item
+}
+
+func parseTransfer(msg *WechatMessage) *common.TransferData {
+	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
+	if err != nil {
+		return nil
+	}
+
+	node := xmlquery.FindOne(doc, "/msg/appmsg/wcpayinfo")
+	if node == nil {
+		return nil
+	}
+
+	transfer := &common.TransferData{
+		TransferID:    getChildText(node, "transferid"),
+		TransactionID: getChildText(node, "transcationid"),
+		Amount:        getChildText(node, "feedesc"),
+		Memo:          getChildText(node, "pay_memo"),
+	}
+	transfer.Status, _ = strconv.Atoi(getChildText(node, "paysubtype"))
+	if len(transfer.TransferID) == 0 || len(transfer.TransactionID) == 0 {
+		return nil
+	}
+
+	return transfer
+}
+
+// live location sharing started by name, others join via the WeChat client
+func parseLiveLocation(msg *WechatMessage, name string) string {
+	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
+	if err != nil {
+		return ""
+	}
+
+	if xmlquery.FindOne(doc, "/msg/appmsg[type='17']") == nil {
+		return ""
+	}
+
+	text := name + " started sharing live location"
+	if poi := xmlquery.FindOne(doc, "/msg/appmsg/location"); poi != nil {
+		if label := poi.SelectAttr("label"); len(label) > 0 {
+			text += ": " + label
+		}
+	}
+
+	return text
+}
+
+// joining and stopping live location sharing arrive as templated system
+// messages, e.g. "$username$加入了位置共享", naming the participant
+func parseLiveLocationNotice(msg *WechatMessage) string {
+	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
+	if err != nil {
+		return ""
+	}
+
+	templateNode := xmlquery.FindOne(doc, "/sysmsg[@type='sysmsgtemplate']//content_template")
+	if templateNode == nil {
+		return ""
+	}
+	template := getChildText(templateNode, "template")
+	if !strings.Contains(template, "位置共享") {
+		return ""
+	}
+
+	var name string
+	if member := xmlquery.FindOne(templateNode, "./link_list/link[@name='username']/memberlist/member"); member != nil {
+		if name = getChildText(member, "nickname"); len(name) == 0 {
+			name = getChildText(member, "username")
+		}
+	}
+	if len(name) == 0 {
+		return renderSysTemplate(templateNode)
+	}
+
+	switch {
+	case strings.Contains(template, "加入"):
+		return name + " joined live location sharing"
+	case strings.Contains(template, "结束"), strings.Contains(template, "退出"):
+		return name + " stopped sharing live location"
+	case strings.Contains(template, "发起"):
+		return name + " started sharing live location"
+	default:
+		return renderSysTemplate(templateNode)
+	}
+}
+
+func parseRevoke(msg *WechatMessage) string {
 	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
 	if err != nil {
 		return ""
@@ -469,7 +1053,31 @@ func parseRevoke(s *Service, msg *WechatMessage) string {
 	return revokeNode.InnerText()
 }
 
-func parsePrivateVoIP(s *Service, msg *WechatMessage) string {
+// recall notice with the server msgid of recalled message, replacemsg is the text to show
+func parseRecall(msg *WechatMessage) (string, string, bool) {
+	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
+	if err != nil {
+		return "", "", false
+	}
+
+	node := xmlquery.FindOne(doc, "/sysmsg[@type='revokemsg']/revokemsg")
+	if node == nil {
+		return "", "", false
+	}
+
+	msgID := getChildText(node, "newmsgid")
+	replace := getChildText(node, "replacemsg")
+	if len(msgID) == 0 || msgID == "0" || len(replace) == 0 {
+		return "", "", false
+	}
+	isSelf := strings.HasPrefix(replace, "你撤回") || strings.HasPrefix(replace, "You recalled")
+
+	return msgID, replace, isSelf
+}
+
+// only invite status 1 and 2 are known, how a call ended (missed, cancelled,
+// declined, busy) comes as localized text of VoIPBubbleMsg, e.g. 对方已拒绝
+func parsePrivateVoIP(msg *WechatMessage) string {
 	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
 	if err != nil {
 		return ""
@@ -481,11 +1089,11 @@ func parsePrivateVoIP(s *Service, msg *WechatMessage) string {
 		if statusNode != nil {
 			switch statusNode.InnerText() {
 			case "1":
-				return "VoIP: Started a call"
+				return "[发起通话]"
 			case "2":
-				return "VoIP: Call ended"
+				return "[通话结束]"
 			default:
-				return fmt.Sprintf("VoIP: Unknown status %s", statusNode.InnerText())
+				return fmt.Sprintf("[未知通话状态: %s]", statusNode.InnerText())
 			}
 		}
 	}
@@ -493,14 +1101,14 @@ func parsePrivateVoIP(s *Service, msg *WechatMessage) string {
 	if bubbleNode != nil {
 		msgNode := xmlquery.FindOne(doc, "//msg")
 		if msgNode != nil {
-			return fmt.Sprintf("VoIP: %s", msgNode.InnerText())
+			return fmt.Sprintf("[通话] %s", msgNode.InnerText())
 		}
 	}
 
 	return ""
 }
 
-func parseSystemMessage(s *Service, msg *WechatMessage) string {
+func parseSystemMessage(msg *WechatMessage, verbose bool) string {
 	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
 	if err != nil {
 		return ""
@@ -515,23 +1123,242 @@ func parseSystemMessage(s *Service, msg *WechatMessage) string {
 	if bannerNode != nil {
 		return fmt.Sprintf("VoIP: %s", bannerNode.InnerText())
 	}
-	/*
-		replaceNode := xmlquery.FindOne(doc, "/sysmsg/revokemsg/replacemsg")
-		if replaceNode != nil {
-			return replaceNode.InnerText()
+	sysmsg := xmlquery.FindOne(doc, "/sysmsg")
+	if sysmsg == nil {
+		return ""
+	}
+
+	sysType := sysmsg.SelectAttr("type")
+	switch sysType {
+	case "sysmsgtemplate": // group invitation, QR code expired, etc.
+		templateNode := xmlquery.FindOne(sysmsg, ".//content_template")
+		if templateNode != nil {
+			if text := renderSysTemplate(templateNode); len(text) > 0 {
+				return text
+			}
+		}
+	case "pat":
+		templateNode := xmlquery.FindOne(sysmsg, "./pat/template")
+		if templateNode != nil {
+			return strings.NewReplacer("${", "", "}", "").Replace(templateNode.InnerText())
+		}
+	case "roomtoolstips": // group todo
+		if todoNode := xmlquery.FindOne(sysmsg, "./todo"); todoNode != nil {
+			return renderTodo(todoNode)
+		}
+	case "mmchattopmsg": // pinned message
+		if topNode := xmlquery.FindOne(sysmsg, "./mmchattopmsg"); topNode != nil {
+			return renderPin(topNode)
+		}
+	}
+
+	if verbose {
+		for _, expr := range []string{".//content", ".//title", ".//text"} {
+			if node := xmlquery.FindOne(sysmsg, expr); node != nil {
+				if text := strings.TrimSpace(node.InnerText()); len(text) > 0 {
+					return text
+				}
+			}
 		}
-	*/
+		if len(sysType) > 0 {
+			return fmt.Sprintf("[系统消息: %s]", sysType)
+		}
+	}
 
 	return ""
 }
 
-func downloadFile(s *Service, msg *WechatMessage) *common.BlobData {
-	ctx, cancel := context.WithTimeout(context.Background(), s.config.Wechat.RequestTimeout)
+func renderTodo(node *xmlquery.Node) string {
+	title := getChildText(node, "title")
+	creator := getChildText(node, "creator")
+	if len(creator) == 0 {
+		creator = getChildText(node, "username")
+	}
+
+	var text string
+	if getChildText(node, "op") == "1" {
+		text = fmt.Sprintf("%s removed group todo: %s", creator, title)
+	} else {
+		text = fmt.Sprintf("%s set group todo: %s", creator, title)
+	}
+	if msgID := getChildText(node, "related_msgid"); len(msgID) > 0 && msgID != "0" {
+		text += fmt.Sprintf(" (msgid %s)", msgID)
+	}
+
+	return text
+}
+
+func renderPin(node *xmlquery.Node) string {
+	operator := getChildText(node, "displayname")
+	if len(operator) == 0 {
+		operator = getChildText(node, "fromusr")
+	}
+
+	var text string
+	if getChildText(node, "optype") == "2" {
+		text = fmt.Sprintf("%s unpinned a message", operator)
+	} else {
+		text = fmt.Sprintf("%s pinned a message", operator)
+	}
+	if msgID := getChildText(node, "srvid"); len(msgID) > 0 && msgID != "0" {
+		text += fmt.Sprintf(" (msgid %s)", msgID)
+	}
+
+	return text
+}
+
+func getChildText(node *xmlquery.Node, name string) string {
+	if n := node.SelectElement(name); n != nil {
+		return strings.TrimSpace(n.InnerText())
+	}
+	return ""
+}
+
+// fill $name$ placeholders of system message template with link_list
+func renderSysTemplate(node *xmlquery.Node) string {
+	templateNode := node.SelectElement("template")
+	if templateNode == nil {
+		return ""
+	}
+
+	var oldnew []string
+	for _, link := range xmlquery.Find(node, "./link_list/link") {
+		var values []string
+		for _, member := range xmlquery.Find(link, "./memberlist/member") {
+			if n := member.SelectElement("nickname"); n != nil {
+				values = append(values, n.InnerText())
+			} else if n := member.SelectElement("username"); n != nil {
+				values = append(values, n.InnerText())
+			}
+		}
+		if len(values) == 0 {
+			if n := link.SelectElement("title"); n != nil {
+				values = append(values, n.InnerText())
+			} else if n := link.SelectElement("plain"); n != nil {
+				values = append(values, n.InnerText())
+			}
+		}
+
+		separator := "、"
+		if n := link.SelectElement("separator"); n != nil {
+			separator = n.InnerText()
+		}
+		oldnew = append(oldnew, "$"+link.SelectAttr("name")+"$", strings.Join(values, separator))
+	}
+
+	return strings.TrimSpace(strings.NewReplacer(oldnew...).Replace(templateNode.InnerText()))
+}
+
+// notice from WeChat team (account security warning, etc.) rendered with its links
+func parseLinkNotice(msg *WechatMessage) string {
+	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
+	if err != nil {
+		return ""
+	}
+
+	templateNode := xmlquery.FindOne(doc, "/sysmsg//content_template")
+	if templateNode == nil {
+		return ""
+	}
+
+	var urls []string
+	for _, link := range xmlquery.Find(templateNode, "./link_list/link") {
+		if url := getChildText(link, "url"); len(url) > 0 {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		return ""
+	}
+
+	text := renderSysTemplate(templateNode)
+	if len(text) == 0 {
+		return ""
+	}
+
+	return text + "\n" + strings.Join(urls, "\n")
+}
+
+// invitation waiting for group owner's approval, the ticket is in the link to confirm page
+func parseInviteApproval(msg *WechatMessage) *common.InviteApprovalData {
+	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
+	if err != nil {
+		return nil
+	}
+
+	templateNode := xmlquery.FindOne(doc, "/sysmsg[@type='sysmsgtemplate']//content_template")
+	if templateNode == nil {
+		return nil
+	}
+
+	approval := &common.InviteApprovalData{}
+	for _, link := range xmlquery.Find(templateNode, "./link_list/link") {
+		var members []string
+		for _, member := range xmlquery.Find(link, "./memberlist/member") {
+			if username := getChildText(member, "username"); len(username) > 0 {
+				members = append(members, username)
+			}
+		}
+
+		switch link.SelectAttr("name") {
+		case "username":
+			if len(members) > 0 {
+				approval.Inviter = members[0]
+			}
+		case "names":
+			approval.Invitees = members
+		default:
+			if u, err := url.Parse(getChildText(link, "url")); err == nil {
+				if ticket := u.Query().Get("ticket"); len(ticket) > 0 {
+					approval.Ticket = ticket
+				}
+			}
+		}
+	}
+	if len(approval.Ticket) == 0 || len(approval.Inviter) == 0 {
+		return nil
+	}
+
+	return approval
+}
+
+func parseReaction(msg *WechatMessage) *common.ReactionData {
+	doc, err := xmlquery.Parse(strings.NewReader(msg.Message))
+	if err != nil {
+		return nil
+	}
+
+	node := xmlquery.FindOne(doc, "/sysmsg[@type='msgreaction']/msgreaction")
+	if node == nil {
+		return nil
+	}
+
+	reaction := &common.ReactionData{}
+	if n := node.SelectElement("msgsvrid"); n != nil {
+		reaction.MsgID = n.InnerText()
+	}
+	if n := node.SelectElement("fromusername"); n != nil {
+		reaction.Reactor = n.InnerText()
+	}
+	if n := node.SelectElement("emoji"); n != nil {
+		reaction.Emoji = n.InnerText()
+	}
+	if n := node.SelectElement("count"); n != nil {
+		reaction.Count, _ = strconv.Atoi(n.InnerText())
+	}
+	if len(reaction.MsgID) == 0 || len(reaction.Emoji) == 0 {
+		return nil
+	}
+
+	return reaction
+}
+
+func downloadFile(ctx context.Context, s *Service, msg *WechatMessage) *common.BlobData {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Wechat.MediaTimeout)
 	defer cancel()
 
-	file := filepath.Join(s.docdir, msg.FilePath)
 	for {
-		if pathExists(file) {
+		if file, ok := s.mediaPath(msg, msg.FilePath); ok {
 			data, err := os.ReadFile(file)
 			if err == nil && data != nil {
 				return &common.BlobData{
@@ -549,7 +1376,9 @@ func downloadFile(s *Service, msg *WechatMessage) *common.BlobData {
 	}
 }
 
-func saveBlob(workdir string, msg *common.Event) string {
+// outgoing media is namespaced per account and send, so concurrent sends of
+// the same name never remove each other's file
+func saveBlob(store MediaStore, mxid string, msg *common.Event, limit int64) (string, error) {
 	var data *common.BlobData
 	if msg.Type == common.EventPhoto {
 		// TODO:
@@ -558,18 +1387,297 @@ func saveBlob(workdir string, msg *common.Event) string {
 		data = msg.Data.(*common.BlobData)
 	}
 
-	var path string
-	if len(data.Name) > 0 {
-		path = filepath.Join(workdir, data.Name)
-	} else {
-		path = filepath.Join(workdir, fmt.Sprintf("%x", md5.Sum(data.Binary)))
+	binary := data.Binary
+	if len(binary) == 0 && len(data.URL) > 0 {
+		var err error
+		if binary, err = fetchBlob(data.URL, limit); err != nil {
+			return "", err
+		}
 	}
 
-	if err := os.WriteFile(path, data.Binary, 0o644); err != nil {
-		return ""
+	name := data.Name
+	if u, err := url.Parse(data.URL); len(name) == 0 && err == nil && len(filepath.Ext(u.Path)) > 0 {
+		name = filepath.Base(u.Path)
+	}
+	if len(name) == 0 {
+		name = fmt.Sprintf("%x", md5.Sum(binary))
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
 	}
 
-	return path
+	owner := fmt.Sprintf("%x", md5.Sum([]byte(mxid)))
+	return store.Put(filepath.Join(owner, hex.EncodeToString(id), filepath.Base(name)), binary)
+}
+
+// download media referenced by bridge, limit is in MB
+func fetchBlob(rawURL string, limit int64) ([]byte, error) {
+	if err := validateURL(rawURL); err != nil {
+		return nil, err
+	}
+
+	reader, err := HTTPGetReadCloser(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if limit <= 0 {
+		return io.ReadAll(reader)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, limit*1024*1024+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit*1024*1024 {
+		return nil, fmt.Errorf("file too large (max %d MB)", limit)
+	}
+
+	return data, nil
+}
+
+// some robot builds drop text with unnormalized or control characters,
+// emoji sequences (ZWJ, variation selectors, skin tones) are kept intact
+func normalizeText(text string, stripControl bool) string {
+	text = norm.NFC.String(text)
+	if !stripControl {
+		return text
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			return r
+		case unicode.IsControl(r):
+			return -1
+		case r == '\ufeff', r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// file extension of outgoing media may be missing or wrong
+func isGIF(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+
+	return string(header) == "GIF8"
+}
+
+// split text into chunks of at most limit runes, prefer breaking at newline or space
+func splitText(content string, limit int, truncate bool) []string {
+	runes := []rune(content)
+	if limit <= 0 || len(runes) <= limit {
+		return []string{content}
+	}
+
+	if truncate {
+		return []string{string(runes[:limit-1]) + "…"}
+	}
+
+	var chunks []string
+	for len(runes) > limit {
+		cut, space := limit, 0
+		for i := limit; i > limit/2; i-- {
+			if runes[i-1] == '\n' {
+				cut, space = i, 0
+				break
+			} else if runes[i-1] == ' ' && space == 0 {
+				space = i
+			}
+		}
+		if space > 0 {
+			cut = space
+		}
+		chunks = append(chunks, string(runes[:cut]))
+		runes = runes[cut:]
+	}
+	if len(runes) > 0 {
+		chunks = append(chunks, string(runes))
+	}
+
+	return chunks
+}
+
+// robot fails silently on oversize file, limit is in MB
+func checkFileSize(path string, limit int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("file %s not found: %w", filepath.Base(path), err)
+	}
+
+	if limit > 0 && info.Size() > limit*1024*1024 {
+		return fmt.Errorf("file too large (max %d MB)", limit)
+	}
+
+	return nil
+}
+
+type protoField struct {
+	num    int
+	wire   int
+	varint uint64
+	data   []byte
+}
+
+// minimal protobuf decoder, only top level fields are read
+func readProtoFields(data []byte) []protoField {
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fields
+		}
+		data = data[n:]
+
+		field := protoField{num: int(key >> 3), wire: int(key & 7)}
+		switch field.wire {
+		case 0: // varint
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fields
+			}
+			field.varint = v
+			data = data[n:]
+		case 1: // 64-bit
+			if len(data) < 8 {
+				return fields
+			}
+			data = data[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return fields
+			}
+			field.data = data[n : n+int(l)]
+			data = data[n+int(l):]
+		case 5: // 32-bit
+			if len(data) < 4 {
+				return fields
+			}
+			data = data[4:]
+		default:
+			return fields
+		}
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// parse key/value pairs stored in MSG.BytesExtra
+func parseBytesExtra(data []byte) map[int]string {
+	extra := map[int]string{}
+	for _, field := range readProtoFields(data) {
+		if field.num != 3 || field.wire != 2 {
+			continue
+		}
+
+		var key int
+		var value string
+		for _, f := range readProtoFields(field.data) {
+			switch {
+			case f.num == 1 && f.wire == 0:
+				key = int(f.varint)
+			case f.num == 2 && f.wire == 2:
+				value = string(f.data)
+			}
+		}
+		extra[key] = value
+	}
+
+	return extra
+}
+
+// ChatRoom.RoomData holds members as repeated field 1 {1: wxid, 2: display name}
+func parseRoomData(data []byte) map[string]string {
+	names := map[string]string{}
+	for _, field := range readProtoFields(data) {
+		if field.num != 1 || field.wire != 2 {
+			continue
+		}
+
+		var wxid, name string
+		for _, f := range readProtoFields(field.data) {
+			switch {
+			case f.num == 1 && f.wire == 2:
+				wxid = string(f.data)
+			case f.num == 2 && f.wire == 2:
+				name = string(f.data)
+			}
+		}
+		if len(wxid) > 0 && len(name) > 0 {
+			names[wxid] = name
+		}
+	}
+
+	return names
+}
+
+// robot returns the raw QR code image, the login uuid is not exposed
+func normalizeQRCode(data []byte) (*common.QRCodeData, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid QR code image: %w", err)
+	}
+
+	if format != "png" {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+
+	return &common.QRCodeData{
+		PNG:       data,
+		ExpiresAt: time.Now().Add(qrCodeLifetime).UnixMilli(),
+	}, nil
+}
+
+// appmsg is the only root, as received type 57 messages, refermsg content
+// is the raw content of quoted message, mentioned wxids go to atuserlist
+func buildReplyXML(target string, content string, reply *common.ReplyInfo, referType int, mentions []string) string {
+	var atuserlist string
+	if len(mentions) > 0 {
+		atuserlist = fmt.Sprintf(`<atuserlist>%s</atuserlist>`, escapeXML(strings.Join(mentions, ",")))
+	}
+
+	return fmt.Sprintf(
+		`<appmsg appid="" sdkver="0"><title>%s</title><des></des><type>57</type><url></url>`+
+			`<refermsg><type>%d</type><svrid>%s</svrid><fromusr>%s</fromusr><chatusr>%s</chatusr><content>%s</content></refermsg>%s</appmsg>`,
+		escapeXML(content), referType, escapeXML(reply.ID), escapeXML(target), escapeXML(reply.Sender), escapeXML(reply.Content), atuserlist,
+	)
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func validateURL(rawURL string) error {
+	u, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url %s: %w", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url %s: scheme not support", rawURL)
+	}
+
+	return nil
 }
 
 func pathExists(path string) bool {
@@ -577,6 +1685,60 @@ func pathExists(path string) bool {
 	return err == nil || errors.Is(err, os.ErrExist)
 }
 
+// layouts differ across WeChat versions, newer ones nest media under the
+// account folder and paths may be relative to it
+func mediaPathCandidates(docdir string, self string, path string) []string {
+	if filepath.IsAbs(path) {
+		return []string{path}
+	}
+
+	rel := strings.TrimLeft(path, `\/`)
+	candidates := []string{filepath.Join(docdir, rel)}
+	add := func(candidate string) {
+		if len(candidates) >= maxMediaCandidates {
+			return
+		}
+		for _, c := range candidates {
+			if c == candidate {
+				return
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	if len(self) > 0 {
+		add(filepath.Join(docdir, self, rel))
+		// relative to a folder named after alias instead of wxid
+		if i := strings.IndexAny(rel, `\/`); i > 0 {
+			add(filepath.Join(docdir, self, rel[i+1:]))
+		}
+	}
+	// data folder configured as the parent of "WeChat Files"
+	add(filepath.Join(docdir, "WeChat Files", rel))
+	if len(self) > 0 {
+		add(filepath.Join(docdir, "WeChat Files", self, rel))
+	}
+
+	return candidates
+}
+
+// configured folder takes precedence over the one from registry
+func resolveWechatDocdir(override string) (string, error) {
+	if len(override) == 0 {
+		return getWechatDocdir(), nil
+	}
+
+	info, err := os.Stat(override)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a folder", override)
+	}
+
+	return filepath.Abs(override)
+}
+
 func getDocDir() string {
 	u, _ := user.Current()
 	baseDir := filepath.Join(u.HomeDir, "Documents")
@@ -589,20 +1751,6 @@ func getDocDir() string {
 	return baseDir
 }
 
-func getWechatDocdir() string {
-	baseDir := getDocDir()
-
-	regKey, err := registry.OpenKey(registry.CURRENT_USER, "SOFTWARE\\Tencent\\WeChat", registry.QUERY_VALUE)
-	if err == nil {
-		path, _, err := regKey.GetStringValue("FileSavePath")
-		if err == nil && path != "MyDocument:" && path != "" {
-			baseDir = path
-		}
-	}
-
-	return filepath.Join(baseDir, "WeChat Files")
-}
-
 func GetBytes(url string) ([]byte, error) {
 	reader, err := HTTPGetReadCloser(url)
 	if err != nil {
@@ -648,10 +1796,18 @@ func HTTPGetReadCloser(url string) (io.ReadCloser, error) {
 		return nil, err
 	}
 	req.Header["User-Agent"] = []string{UserAgent}
+	for k, v := range Headers {
+		req.Header.Set(k, v)
+	}
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	// error pages must not be taken as the media
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to get %s: HTTP %d", url, resp.StatusCode)
+	}
 	if strings.Contains(resp.Header.Get("Content-Encoding"), "gzip") {
 		return NewGzipReadCloser(resp.Body)
 	}
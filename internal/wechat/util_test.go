@@ -0,0 +1,1427 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/duo/matrix-wechat-agent/internal/common"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+const (
+	replyTextXML = `<?xml version="1.0"?>
+<msg>
+	<appmsg appid="" sdkver="0">
+		<title>好的，下午三点</title>
+		<des />
+		<action />
+		<type>57</type>
+		<showtype>0</showtype>
+		<refermsg>
+			<type>1</type>
+			<svrid>7285924331924569382</svrid>
+			<fromusr>24503927881@chatroom</fromusr>
+			<chatusr>wxid_alice</chatusr>
+			<displayname>Alice</displayname>
+			<content>明天开会吗</content>
+			<msgsource>&lt;msgsource&gt;&lt;/msgsource&gt;</msgsource>
+		</refermsg>
+	</appmsg>
+	<fromusername>wxid_bob</fromusername>
+	<scene>0</scene>
+	<appinfo>
+		<version>1</version>
+		<appname></appname>
+	</appinfo>
+	<commenturl></commenturl>
+</msg>`
+
+	replyImageXML = `<?xml version="1.0"?>
+<msg>
+	<appmsg appid="" sdkver="0">
+		<title>这张不错</title>
+		<type>57</type>
+		<refermsg>
+			<type>3</type>
+			<svrid>1688049781234567890</svrid>
+			<fromusr>wxid_alice</fromusr>
+			<displayname>Alice</displayname>
+			<content>&lt;?xml version="1.0"?&gt;&lt;msg&gt;&lt;img length="102400" /&gt;&lt;/msg&gt;</content>
+		</refermsg>
+	</appmsg>
+	<fromusername>wxid_bob</fromusername>
+</msg>`
+
+	locationXML = `<?xml version="1.0"?>
+<msg>
+	<location x="31.230416" y="121.473701" scale="15" label="上海市黄浦区人民大道200号" maptype="roadmap" poiname="人民广场" poiid="nearby_1234567890" buildingId="" floorName="" poiCategoryTips="" poiBusinessHour="" poiPhone="" poiPriceTips="0.0" isFromPoiList="true" adcode="310101" cityname="上海市" />
+</msg>`
+
+	linkXML = `<?xml version="1.0"?>
+<msg>
+	<appmsg appid="wx6618f1cfc6c132f8" sdkver="0">
+		<title>Go 1.19 is released</title>
+		<des>Go 1.19 adds richer doc comments</des>
+		<type>5</type>
+		<showtype>0</showtype>
+		<url>https://go.dev/blog/go1.19</url>
+		<thumburl>https://go.dev/images/go-logo-blue.svg</thumburl>
+		<sourcedisplayname></sourcedisplayname>
+	</appmsg>
+	<fromusername>wxid_alice</fromusername>
+	<appinfo>
+		<version>1</version>
+		<appname>The Go Blog</appname>
+	</appinfo>
+</msg>`
+
+	miniProgramXML = `<?xml version="1.0"?>
+<msg>
+	<appmsg appid="" sdkver="0">
+		<title>查看快递进度</title>
+		<des></des>
+		<type>33</type>
+		<url>https://mp.weixin.qq.com/mp/waerrpage?appid=wx6885acbedba59c14&amp;type=upgrade</url>
+		<sourcedisplayname>快递100</sourcedisplayname>
+		<weappinfo>
+			<username><![CDATA[gh_4a2d1b4c5a3c@app]]></username>
+			<appid><![CDATA[wx6885acbedba59c14]]></appid>
+			<pagepath><![CDATA[pages/result/result.html]]></pagepath>
+			<weappiconurl><![CDATA[http://mmbiz.qpic.cn/mmbiz_png/icon/0]]></weappiconurl>
+		</weappinfo>
+	</appmsg>
+</msg>`
+
+	articlesXML = `<?xml version="1.0"?>
+<msg>
+	<appmsg appid="" sdkver="0">
+		<title><![CDATA[Go 1.19 正式发布]]></title>
+		<des><![CDATA[]]></des>
+		<type>5</type>
+		<url><![CDATA[http://mp.weixin.qq.com/s?__biz=MzA4NjE1OTAxNw==&mid=2651&idx=1]]></url>
+		<mmreader>
+			<category type="20" count="2">
+				<name><![CDATA[Gopher 日报]]></name>
+				<topnew>
+					<cover><![CDATA[]]></cover>
+					<width>0</width>
+					<height>0</height>
+					<digest><![CDATA[]]></digest>
+				</topnew>
+				<item>
+					<itemshowtype>0</itemshowtype>
+					<title><![CDATA[Go 1.19 正式发布]]></title>
+					<url><![CDATA[http://mp.weixin.qq.com/s?__biz=MzA4NjE1OTAxNw==&mid=2651&idx=1]]></url>
+					<cover><![CDATA[https://mmbiz.qpic.cn/mmbiz_jpg/go119/0?wx_fmt=jpeg]]></cover>
+					<digest><![CDATA[文档注释支持链接和列表]]></digest>
+				</item>
+				<item>
+					<itemshowtype>0</itemshowtype>
+					<title><![CDATA[泛型一周年回顾]]></title>
+					<url><![CDATA[http://mp.weixin.qq.com/s?__biz=MzA4NjE1OTAxNw==&mid=2651&idx=2]]></url>
+					<cover><![CDATA[https://mmbiz.qpic.cn/mmbiz_jpg/generics/0?wx_fmt=jpeg]]></cover>
+					<digest><![CDATA[]]></digest>
+				</item>
+			</category>
+			<publisher>
+				<username><![CDATA[gh_3dfda90e39d6]]></username>
+				<nickname><![CDATA[Gopher 日报]]></nickname>
+			</publisher>
+		</mmreader>
+	</appmsg>
+	<fromusername><![CDATA[gh_3dfda90e39d6]]></fromusername>
+</msg>`
+
+	noticeXML = `<?xml version="1.0"?>
+<msg>
+	<appmsg appid="" sdkver="0">
+		<title>群公告</title>
+		<type>87</type>
+		<textannouncement><![CDATA[本周五下午团建，请大家准时参加]]></textannouncement>
+	</appmsg>
+	<fromusername>wxid_alice</fromusername>
+</msg>`
+
+	cardXML = `<?xml version="1.0"?>
+<msg bigheadimgurl="http://wx.qlogo.cn/mmhead/ver_1/carol/0" smallheadimgurl="http://wx.qlogo.cn/mmhead/ver_1/carol/132" username="wxid_carol" nickname="Carol" fullpy="carol" shortpy="" alias="carol_2022" imagestatus="3" scene="17" province="广东" city="深圳" sign="" sex="2" certflag="0" certinfo="" brandIconUrl="" brandHomeUrl="" brandSubscriptConfigUrl="" brandFlags="0" regionCode="CN_Guangdong_Shenzhen" />`
+
+	revokeXML = `<revokemsg>"Alice" 撤回了一条消息</revokemsg>`
+
+	recallXML = `<sysmsg type="revokemsg"><revokemsg><session>24503927881@chatroom</session><msgid>1052315233</msgid><newmsgid>7285924331924569382</newmsgid><replacemsg><![CDATA["Alice" 撤回了一条消息]]></replacemsg></revokemsg></sysmsg>`
+
+	recallSelfXML = `<sysmsg type="revokemsg"><revokemsg><session>wxid_alice</session><msgid>1052315234</msgid><newmsgid>3842107261928374650</newmsgid><replacemsg><![CDATA[你撤回了一条消息]]></replacemsg></revokemsg></sysmsg>`
+
+	liveLocationStartXML = `<?xml version="1.0"?>
+<msg>
+	<appmsg appid="" sdkver="0">
+		<title><![CDATA[我发起了位置共享]]></title>
+		<des></des>
+		<type>17</type>
+		<url></url>
+		<location x="31.230416" y="121.473701" label="上海市黄浦区人民大道200号" poiname="人民广场" />
+	</appmsg>
+	<fromusername>wxid_alice</fromusername>
+</msg>`
+
+	liveLocationJoinXML = `<sysmsg type="sysmsgtemplate"><sysmsgtemplate><content_template type="tmpl_type_profile"><plain><![CDATA[]]></plain><template><![CDATA["$username$"加入了位置共享]]></template><link_list><link name="username" type="link_profile"><memberlist><member><username><![CDATA[wxid_bob]]></username><nickname><![CDATA[Bob]]></nickname></member></memberlist></link></link_list></content_template></sysmsgtemplate></sysmsg>`
+
+	liveLocationStopXML = `<sysmsg type="sysmsgtemplate"><sysmsgtemplate><content_template type="tmpl_type_profile"><plain><![CDATA[]]></plain><template><![CDATA["$username$"结束了位置共享]]></template><link_list><link name="username" type="link_profile"><memberlist><member><username><![CDATA[wxid_alice]]></username><nickname><![CDATA[Alice]]></nickname></member></memberlist></link></link_list></content_template></sysmsgtemplate></sysmsg>`
+)
+
+func voipBubbleXML(text string) string {
+	return `<voipmsg type="VoIPBubbleMsg"><VoIPBubbleMsg><msg><![CDATA[` + text + `]]></msg><room_type>1</room_type><red_dot>false</red_dot><roomid>560478123</roomid><roomkey>0</roomkey><inviteid>1671234567</inviteid><msg_type>100</msg_type><timestamp>1671234600123</timestamp><identity><![CDATA[7134902823497215]]></identity><duration>0</duration></VoIPBubbleMsg></voipmsg>`
+}
+
+func voipInviteXML(status string) string {
+	return `<voipinvitemsg><roomid>560478123</roomid><key>7134902823497215</key><status>` + status + `</status><invitetype>0</invitetype></voipinvitemsg><voipextinfo><recvtime>1671234567</recvtime></voipextinfo>`
+}
+
+func TestGetAppType(t *testing.T) {
+	tests := []struct {
+		name string
+		xml  string
+		want int
+	}{
+		{"reply", replyTextXML, 57},
+		{"link", linkXML, 5},
+		{"mini program", miniProgramXML, 33},
+		{"notice", noticeXML, 87},
+		{"not app", locationXML, 0},
+		{"invalid", "not xml <", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getAppType(&WechatMessage{Message: tt.xml}); got != tt.want {
+				t.Errorf("getAppType() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetMentions(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		want  []string
+	}{
+		{"none", "", nil},
+		{"members", `<msgsource><atuserlist><![CDATA[wxid_alice,wxid_bob]]></atuserlist><silence>0</silence><membercount>12</membercount></msgsource>`, []string{"wxid_alice", "wxid_bob"}},
+		{"leading comma", `<msgsource><atuserlist>,wxid_alice</atuserlist></msgsource>`, []string{"wxid_alice"}},
+		{"all", `<msgsource><atuserlist>notify@all</atuserlist></msgsource>`, []string{"notify@all"}},
+		{"empty list", `<msgsource><silence>0</silence><membercount>12</membercount></msgsource>`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getMentions(&WechatMessage{ExtraInfo: tt.extra}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getMentions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		xml     string
+		content string
+		reply   *common.ReplyInfo
+	}{
+		{"text", replyTextXML, "好的，下午三点", &common.ReplyInfo{ID: "7285924331924569382", Sender: "wxid_alice"}},
+		{"image from private chat", replyImageXML, "[replied to an image]\n这张不错", &common.ReplyInfo{ID: "1688049781234567890", Sender: "wxid_alice"}},
+		{"not reply", linkXML, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, reply := parseReply(&WechatMessage{Message: tt.xml})
+			if content != tt.content || !reflect.DeepEqual(reply, tt.reply) {
+				t.Errorf("parseReply() = %q, %+v, want %q, %+v", content, reply, tt.content, tt.reply)
+			}
+		})
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		name string
+		xml  string
+		want *common.LocationData
+	}{
+		{"poi", locationXML, &common.LocationData{Name: "人民广场", Address: "上海市黄浦区人民大道200号", Latitude: 31.230416, Longitude: 121.473701}},
+		{"no coordinate", `<msg><location label="somewhere" /></msg>`, nil},
+		{"bad coordinate", `<msg><location x="north" y="121.4" /></msg>`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseLocation(&WechatMessage{Message: tt.xml}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLocation() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseApp(t *testing.T) {
+	tests := []struct {
+		name string
+		xml  string
+		want *common.AppData
+	}{
+		{"link", linkXML, &common.AppData{
+			Title:       "Go 1.19 is released",
+			Description: "Go 1.19 adds richer doc comments",
+			Source:      "",
+			URL:         "https://go.dev/blog/go1.19",
+		}},
+		{"mini program", miniProgramXML, &common.AppData{
+			Title:  "查看快递进度",
+			Source: "快递100",
+			URL:    "https://mp.weixin.qq.com/mp/waerrpage?appid=wx6885acbedba59c14&type=upgrade",
+			MiniProgram: &common.MiniProgramData{
+				Username: "gh_4a2d1b4c5a3c@app",
+				AppID:    "wx6885acbedba59c14",
+				PagePath: "pages/result/result.html",
+				Icon:     "http://mmbiz.qpic.cn/mmbiz_png/icon/0",
+			},
+		}},
+		{"official account articles", articlesXML, &common.AppData{
+			Title:       "Go 1.19 正式发布",
+			Description: "文档注释支持链接和列表",
+			Source:      "Gopher 日报",
+			URL:         "http://mp.weixin.qq.com/s?__biz=MzA4NjE1OTAxNw==&mid=2651&idx=1",
+			Thumb:       "https://mmbiz.qpic.cn/mmbiz_jpg/go119/0?wx_fmt=jpeg",
+			Articles: []*common.ArticleData{
+				{
+					Title:  "Go 1.19 正式发布",
+					Digest: "文档注释支持链接和列表",
+					URL:    "http://mp.weixin.qq.com/s?__biz=MzA4NjE1OTAxNw==&mid=2651&idx=1",
+					Cover:  "https://mmbiz.qpic.cn/mmbiz_jpg/go119/0?wx_fmt=jpeg",
+				},
+				{
+					Title: "泛型一周年回顾",
+					URL:   "http://mp.weixin.qq.com/s?__biz=MzA4NjE1OTAxNw==&mid=2651&idx=2",
+					Cover: "https://mmbiz.qpic.cn/mmbiz_jpg/generics/0?wx_fmt=jpeg",
+				},
+			},
+		}},
+		{"no title", `<msg><appmsg><type>5</type><url>https://example.com</url></appmsg></msg>`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &WechatMessage{Message: tt.xml}
+			if got := parseApp(msg, getAppType(msg)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseApp() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLiveLocation(t *testing.T) {
+	if got, want := parseLiveLocation(&WechatMessage{Message: liveLocationStartXML}, "Alice"), "Alice started sharing live location: 上海市黄浦区人民大道200号"; got != want {
+		t.Errorf("parseLiveLocation() = %q, want %q", got, want)
+	}
+	if got := parseLiveLocation(&WechatMessage{Message: linkXML}, "Alice"); got != "" {
+		t.Errorf("parseLiveLocation() of link = %q, want empty", got)
+	}
+
+	tests := []struct {
+		name string
+		xml  string
+		want string
+	}{
+		{"join", liveLocationJoinXML, "Bob joined live location sharing"},
+		{"stop", liveLocationStopXML, "Alice stopped sharing live location"},
+		{"other template", recallXML, ""},
+		{"start is not a notice", liveLocationStartXML, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseLiveLocationNotice(&WechatMessage{Message: tt.xml}); got != tt.want {
+				t.Errorf("parseLiveLocationNotice() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNotice(t *testing.T) {
+	tests := []struct {
+		name string
+		xml  string
+		want string
+	}{
+		{"announcement", noticeXML, "本周五下午团建，请大家准时参加"},
+		{"not notice", linkXML, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseNotice(&WechatMessage{Message: tt.xml}); got != tt.want {
+				t.Errorf("parseNotice() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCard(t *testing.T) {
+	want := &common.AppData{
+		Description: "Carol",
+		Source:      "Carol",
+		URL:         "http://wx.qlogo.cn/mmhead/ver_1/carol/0",
+	}
+	if got := parseCard(&WechatMessage{Message: cardXML}); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCard() = %+v, want %+v", got, want)
+	}
+	if got := parseCard(&WechatMessage{Message: "<card"}); got != nil {
+		t.Errorf("parseCard() = %+v, want nil", got)
+	}
+}
+
+func TestParseRevoke(t *testing.T) {
+	tests := []struct {
+		name string
+		xml  string
+		want string
+	}{
+		{"revoke", revokeXML, `"Alice" 撤回了一条消息`},
+		{"not revoke", noticeXML, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRevoke(&WechatMessage{Message: tt.xml}); got != tt.want {
+				t.Errorf("parseRevoke() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRecall(t *testing.T) {
+	tests := []struct {
+		name    string
+		xml     string
+		msgID   string
+		replace string
+		isSelf  bool
+		ok      bool
+	}{
+		{"other", recallXML, "7285924331924569382", `"Alice" 撤回了一条消息`, false, true},
+		{"self", recallSelfXML, "3842107261928374650", "你撤回了一条消息", true, true},
+		{"no msgid", `<sysmsg type="revokemsg"><revokemsg><newmsgid>0</newmsgid><replacemsg>x</replacemsg></revokemsg></sysmsg>`, "", "", false, false},
+		{"plain revoke", revokeXML, "", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgID, replace, isSelf := parseRecall(&WechatMessage{Message: tt.xml})
+			ok := len(msgID) > 0
+			if msgID != tt.msgID || replace != tt.replace || isSelf != tt.isSelf || ok != tt.ok {
+				t.Errorf("parseRecall() = %q, %q, %v, want %q, %q, %v", msgID, replace, isSelf, tt.msgID, tt.replace, tt.isSelf)
+			}
+		})
+	}
+}
+
+func TestParsePrivateVoIP(t *testing.T) {
+	tests := []struct {
+		name string
+		xml  string
+		want string
+	}{
+		{"started", voipInviteXML("1"), "[发起通话]"},
+		{"ended", voipInviteXML("2"), "[通话结束]"},
+		{"unknown", voipInviteXML("3"), "[未知通话状态: 3]"},
+		{"duration", voipBubbleXML("通话时长 00:42"), "[通话] 通话时长 00:42"},
+		{"cancelled", voipBubbleXML("已取消"), "[通话] 已取消"},
+		{"declined", voipBubbleXML("对方已拒绝"), "[通话] 对方已拒绝"},
+		{"missed", voipBubbleXML("对方无应答"), "[通话] 对方无应答"},
+		{"busy", voipBubbleXML("对方忙线中"), "[通话] 对方忙线中"},
+		{"not voip", revokeXML, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parsePrivateVoIP(&WechatMessage{Message: tt.xml}); got != tt.want {
+				t.Errorf("parsePrivateVoIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+const voiceXML = `<msg><voicemsg endflag="1" cancelflag="0" forwardflag="0" voiceformat="4" voicelength="2450" length="3920" bufid="0" aeskey="6b2d2f1e1c3a4b5d" voiceurl="3052020100044b30490201000204" voicemd5="" clientmsgid="41363335373637633532313063353600111510121622a9e93e6b8b1101" fromusername="wxid_alice" /></msg>`
+
+func newVoiceTest(t *testing.T, queries *atomic.Int32, buf []byte) (*Service, *WechatMessage, *Client) {
+	t.Helper()
+
+	config := &common.Configure{}
+	config.Wechat.MediaTimeout = 100 * time.Millisecond
+	s := &Service{config: config, workdir: t.TempDir()}
+	msg := &WechatMessage{MsgID: 8101, Self: "wxid_self", Message: voiceXML}
+	client := newFakeRobot(t, func(api int, body []byte) any {
+		if api != WECHAT_DATABASE_QUERY {
+			return nil
+		}
+		queries.Add(1)
+		if buf == nil {
+			return queryResult()
+		}
+		return queryResult([]string{base64.StdEncoding.EncodeToString(buf)})
+	})
+
+	return s, msg, client
+}
+
+func TestDownloadVoiceSkipsEmptyFile(t *testing.T) {
+	var queries atomic.Int32
+	voice := []byte("#!SILK_V3 voice")
+	s, msg, client := newVoiceTest(t, &queries, voice)
+
+	voiceFile := filepath.Join(s.workdir, msg.Self, "41363335373637633532313063353600111510121622a9e93e6b8b1101.amr")
+	if err := os.MkdirAll(filepath.Dir(voiceFile), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(voiceFile, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := downloadVoice(context.Background(), s, msg, client)
+	if blob == nil || !bytes.Equal(blob.Binary, voice) {
+		t.Fatalf("downloadVoice() = %+v, want voice from DB", blob)
+	}
+	if data, _ := os.ReadFile(voiceFile); !bytes.Equal(data, voice) {
+		t.Errorf("placeholder not replaced by DB voice, got %q", data)
+	}
+}
+
+func TestDownloadVoiceFromDB(t *testing.T) {
+	var queries atomic.Int32
+	voice := []byte("#!SILK_V3 voice")
+	s, msg, client := newVoiceTest(t, &queries, voice)
+
+	for i := 0; i < 2; i++ {
+		blob := downloadVoice(context.Background(), s, msg, client)
+		if blob == nil || !bytes.Equal(blob.Binary, voice) {
+			t.Fatalf("downloadVoice() = %+v, want voice from DB", blob)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("DB queried %d times, want cached voice to be reused", n)
+	}
+}
+
+func TestDownloadVoiceMissing(t *testing.T) {
+	var queries atomic.Int32
+	s, msg, client := newVoiceTest(t, &queries, nil)
+
+	if blob := downloadVoice(context.Background(), s, msg, client); blob != nil {
+		t.Fatalf("downloadVoice() = %+v, want nil", blob)
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		limit    int
+		truncate bool
+		want     []string
+	}{
+		{"short", "你好", 4, false, []string{"你好"}},
+		{"no limit", "你好世界", 0, false, []string{"你好世界"}},
+		{"cjk by rune", "你好世界再见", 4, false, []string{"你好世界", "再见"}},
+		{"emoji by rune", "😀😃😄😁😆", 2, false, []string{"😀😃", "😄😁", "😆"}},
+		{"prefer newline", "ab\ncdef", 4, false, []string{"ab\n", "cdef"}},
+		{"prefer space", "ab cdef", 4, false, []string{"ab ", "cdef"}},
+		{"truncate", "你好世界再见", 4, true, []string{"你好世…"}},
+		{"truncate emoji", "😀😃😄😁😆", 3, true, []string{"😀😃…"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitText(tt.content, tt.limit, tt.truncate)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("splitText() = %q, want %q", got, tt.want)
+			}
+			for _, chunk := range got {
+				if !utf8.ValidString(chunk) {
+					t.Errorf("chunk %q splits a rune", chunk)
+				}
+			}
+			if !tt.truncate && strings.Join(got, "") != tt.content {
+				t.Errorf("chunks %q don't add up to content", got)
+			}
+		})
+	}
+}
+
+func TestSaveBlobConcurrentSameName(t *testing.T) {
+	store := &LocalStore{dir: t.TempDir()}
+	event := &common.Event{
+		Type: common.EventFile,
+		Data: &common.BlobData{Name: "image.png", Binary: []byte("same content")},
+	}
+
+	first, err := saveBlob(store, "@alice:example.org", event, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := saveBlob(store, "@alice:example.org", event, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second {
+		t.Fatalf("both sends stored at %s", first)
+	}
+	for _, key := range []string{first, second} {
+		if filepath.Base(key) != "image.png" {
+			t.Errorf("stored as %s, want original name kept", key)
+		}
+	}
+
+	if err := store.Release(first); err != nil {
+		t.Fatal(err)
+	}
+	if pathExists(filepath.Dir(first)) {
+		t.Errorf("directory of released media %s left behind", first)
+	}
+	if _, err := store.Fetch(second); err != nil {
+		t.Errorf("media of other send removed: %v", err)
+	}
+}
+
+func TestBuildReplyXML(t *testing.T) {
+	reply := &common.ReplyInfo{ID: "8012345", Sender: "wxid_bob", Content: `<msg><img length="1024" /></msg>`}
+	data := buildReplyXML("24503927881@chatroom", "a < b", reply, 3, nil)
+
+	// exactly one root element
+	decoder := xml.NewDecoder(strings.NewReader(data))
+	roots, depth := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("invalid xml %q: %v", data, err)
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if roots != 1 {
+		t.Errorf("%d root elements in %q", roots, data)
+	}
+
+	msg := &WechatMessage{Message: "<msg>" + data + "</msg>"}
+	content, info := parseReply(msg)
+	if info == nil || info.ID != "8012345" || info.Sender != "wxid_bob" {
+		t.Errorf("parseReply() info = %+v", info)
+	}
+	if !strings.HasSuffix(content, "a < b") {
+		t.Errorf("parseReply() content = %q", content)
+	}
+	if got := getReferPlaceholder("3"); !strings.HasPrefix(content, got) {
+		t.Errorf("parseReply() content = %q, want quoted type 3 placeholder %q", content, got)
+	}
+}
+
+func TestFetchBlob(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 1024)...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+		case "/large.png":
+			w.Write(bytes.Repeat([]byte{0}, 2*1024*1024))
+		default:
+			http.Error(w, "<html>404 Not Found</html>", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		want    []byte
+		wantErr bool
+	}{
+		{"image", server.URL + "/image.png", png, false},
+		{"not found", server.URL + "/missing.png", nil, true},
+		{"too large", server.URL + "/large.png", nil, true},
+		{"scheme", "file:///etc/passwd", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fetchBlob(tt.url, 1)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchBlob() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("fetchBlob() = %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+
+	store := &LocalStore{dir: t.TempDir()}
+	event := &common.Event{
+		Type: common.EventPhoto,
+		Data: []*common.BlobData{{URL: server.URL + "/image.png"}},
+	}
+	key, err := saveBlob(store, "@alice:example.org", event, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(key); !bytes.Equal(data, png) || filepath.Base(key) != "image.png" {
+		t.Errorf("saved %s with %d bytes, want image.png from URL", key, len(data))
+	}
+}
+
+func TestParseReaction(t *testing.T) {
+	tests := []struct {
+		name string
+		xml  string
+		want *common.ReactionData
+	}{
+		{"reaction", `<sysmsg type="msgreaction">
+	<msgreaction>
+		<msgsvrid>1234567890123456789</msgsvrid>
+		<fromusername>wxid_bob</fromusername>
+		<emoji>[Thumbs Up]</emoji>
+		<count>2</count>
+	</msgreaction>
+</sysmsg>`, &common.ReactionData{MsgID: "1234567890123456789", Reactor: "wxid_bob", Emoji: "[Thumbs Up]", Count: 2}},
+		{"without count", `<sysmsg type="msgreaction"><msgreaction><msgsvrid>1</msgsvrid><fromusername>wxid_bob</fromusername><emoji>[OK]</emoji></msgreaction></sysmsg>`,
+			&common.ReactionData{MsgID: "1", Reactor: "wxid_bob", Emoji: "[OK]"}},
+		{"without msgid", `<sysmsg type="msgreaction"><msgreaction><fromusername>wxid_bob</fromusername><emoji>[OK]</emoji></msgreaction></sysmsg>`, nil},
+		{"without emoji", `<sysmsg type="msgreaction"><msgreaction><msgsvrid>1</msgsvrid><emoji></emoji></msgreaction></sysmsg>`, nil},
+		{"other sysmsg", recallXML, nil},
+		{"not xml", "[Thumbs Up]", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseReaction(&WechatMessage{Message: tt.xml}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseReaction() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSystemMessage(t *testing.T) {
+	const (
+		patXML = `<sysmsg type="pat">
+	<pat>
+		<fromusername>wxid_alice</fromusername>
+		<chatusername>24503927881@chatroom</chatusername>
+		<pattedusername>wxid_bob</pattedusername>
+		<template><![CDATA["${wxid_alice}" 拍了拍 "${wxid_bob}"]]></template>
+	</pat>
+</sysmsg>`
+		joinXML = `<sysmsg type="sysmsgtemplate">
+	<sysmsgtemplate>
+		<content_template type="tmpl_type_profile">
+			<plain><![CDATA[]]></plain>
+			<template><![CDATA["$username$"邀请"$names$"加入了群聊]]></template>
+			<link_list>
+				<link name="username" type="link_profile">
+					<memberlist>
+						<member><username><![CDATA[wxid_alice]]></username><nickname><![CDATA[Alice]]></nickname></member>
+					</memberlist>
+				</link>
+				<link name="names" type="link_profile">
+					<memberlist>
+						<member><username><![CDATA[wxid_bob]]></username><nickname><![CDATA[Bob]]></nickname></member>
+						<member><username><![CDATA[wxid_carol]]></username><nickname><![CDATA[Carol]]></nickname></member>
+					</memberlist>
+					<separator><![CDATA[、]]></separator>
+				</link>
+			</link_list>
+		</content_template>
+	</sysmsgtemplate>
+</sysmsg>`
+		leaveXML = `<sysmsg type="sysmsgtemplate">
+	<sysmsgtemplate>
+		<content_template type="tmpl_type_profile">
+			<template><![CDATA[你将"$kickoutname$"移出了群聊]]></template>
+			<link_list>
+				<link name="kickoutname" type="link_profile">
+					<memberlist>
+						<member><username><![CDATA[wxid_dave]]></username></member>
+					</memberlist>
+				</link>
+			</link_list>
+		</content_template>
+	</sysmsgtemplate>
+</sysmsg>`
+		noTemplateXML = `<sysmsg type="sysmsgtemplate"><sysmsgtemplate><content_template type="tmpl_type_profile"></content_template></sysmsgtemplate></sysmsg>`
+		unknownXML    = `<sysmsg type="ilinkvoip"><content><![CDATA[语音通话已结束]]></content></sysmsg>`
+		emptyXML      = `<sysmsg type="functionmsg"><functionmsg><cgi>/cgi-bin/micromsg-bin/pullfunctionmsg</cgi></functionmsg></sysmsg>`
+	)
+
+	tests := []struct {
+		name    string
+		xml     string
+		verbose bool
+		want    string
+	}{
+		{"pat", patXML, false, `"wxid_alice" 拍了拍 "wxid_bob"`},
+		{"join", joinXML, false, `"Alice"邀请"Bob、Carol"加入了群聊`},
+		{"leave without nickname", leaveXML, false, `你将"wxid_dave"移出了群聊`},
+		{"template missing", noTemplateXML, false, ""},
+		{"template missing verbose", noTemplateXML, true, "[系统消息: sysmsgtemplate]"},
+		{"unknown", unknownXML, false, ""},
+		{"unknown verbose", unknownXML, true, "语音通话已结束"},
+		{"unknown without text verbose", emptyXML, true, "[系统消息: functionmsg]"},
+		{"not sysmsg verbose", linkXML, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSystemMessage(&WechatMessage{Message: tt.xml}, tt.verbose); got != tt.want {
+				t.Errorf("parseSystemMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTodoAndPin(t *testing.T) {
+	const (
+		todoXML = `<sysmsg type="roomtoolstips">
+	<todo>
+		<op>0</op>
+		<todoid><![CDATA[roomannouncement@app_todo_1658212345]]></todoid>
+		<username><![CDATA[wxid_alice]]></username>
+		<creator><![CDATA[Alice]]></creator>
+		<title><![CDATA[周五前提交周报]]></title>
+		<related_msgid><![CDATA[6846829281516485302]]></related_msgid>
+	</todo>
+</sysmsg>`
+		todoRemovedXML = `<sysmsg type="roomtoolstips">
+	<todo>
+		<op>1</op>
+		<username><![CDATA[wxid_alice]]></username>
+		<title><![CDATA[周五前提交周报]]></title>
+		<related_msgid><![CDATA[0]]></related_msgid>
+	</todo>
+</sysmsg>`
+		pinXML = `<sysmsg type="mmchattopmsg">
+	<mmchattopmsg>
+		<fromusr><![CDATA[wxid_bob]]></fromusr>
+		<displayname><![CDATA[Bob]]></displayname>
+		<srvid><![CDATA[2387620283914723710]]></srvid>
+		<optype>1</optype>
+	</mmchattopmsg>
+</sysmsg>`
+		unpinXML = `<sysmsg type="mmchattopmsg">
+	<mmchattopmsg>
+		<fromusr><![CDATA[wxid_bob]]></fromusr>
+		<srvid><![CDATA[0]]></srvid>
+		<optype>2</optype>
+	</mmchattopmsg>
+</sysmsg>`
+	)
+
+	tests := []struct {
+		name string
+		xml  string
+		want string
+	}{
+		{"todo", todoXML, "Alice set group todo: 周五前提交周报 (msgid 6846829281516485302)"},
+		{"todo removed", todoRemovedXML, "wxid_alice removed group todo: 周五前提交周报"},
+		{"pin", pinXML, "Bob pinned a message (msgid 2387620283914723710)"},
+		{"unpin", unpinXML, "wxid_bob unpinned a message"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSystemMessage(&WechatMessage{Message: tt.xml}, false); got != tt.want {
+				t.Errorf("parseSystemMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLinkNotice(t *testing.T) {
+	const securityXML = `<sysmsg type="sysmsgtemplate">
+	<sysmsgtemplate>
+		<content_template type="tmpl_type_wxappnotifywithview">
+			<plain><![CDATA[]]></plain>
+			<template><![CDATA[你的微信帐号于 2022-07-19 21:03 在新设备上登录，如非本人操作，请$security$。]]></template>
+			<link_list>
+				<link name="security" type="link_url">
+					<title><![CDATA[立即冻结帐号]]></title>
+					<url><![CDATA[https://weixin110.qq.com/security/readtemplate?t=w_security_center_website/freeze]]></url>
+				</link>
+			</link_list>
+		</content_template>
+	</sysmsgtemplate>
+</sysmsg>`
+
+	tests := []struct {
+		name string
+		xml  string
+		want string
+	}{
+		{"security warning", securityXML, "你的微信帐号于 2022-07-19 21:03 在新设备上登录，如非本人操作，请立即冻结帐号。\nhttps://weixin110.qq.com/security/readtemplate?t=w_security_center_website/freeze"},
+		// member templates carry no url, they are rendered as system message
+		{"without url", `<sysmsg type="sysmsgtemplate"><sysmsgtemplate><content_template><template><![CDATA["$username$"加入了群聊]]></template><link_list><link name="username"><memberlist><member><nickname>Bob</nickname></member></memberlist></link></link_list></content_template></sysmsgtemplate></sysmsg>`, ""},
+		{"not a template", recallXML, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseLinkNotice(&WechatMessage{Message: tt.xml}); got != tt.want {
+				t.Errorf("parseLinkNotice() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetTimestamp(t *testing.T) {
+	shanghai := time.FixedZone("CST", 8*60*60)
+
+	tests := []struct {
+		name string
+		msg  *WechatMessage
+		want int64
+	}{
+		{"unix timestamp", &WechatMessage{Timestamp: 1658235780, Time: "2000-01-01 00:00:00"}, 1658235780000},
+		{"textual time in location", &WechatMessage{Time: "2022-07-19 21:03:00"}, time.Date(2022, 7, 19, 13, 3, 0, 0, time.UTC).UnixMilli()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getTimestamp(tt.msg, shanghai); got != tt.want {
+				t.Errorf("getTimestamp() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	for _, value := range []string{"", "2022/07/19 21:03", "yesterday"} {
+		t.Run("unparsable "+value, func(t *testing.T) {
+			before := time.Now().UnixMilli()
+			got := getTimestamp(&WechatMessage{Time: value}, shanghai)
+			if after := time.Now().UnixMilli(); got < before || got > after {
+				t.Errorf("getTimestamp() = %d, want now", got)
+			}
+		})
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+	transport := httpClient.Transport.(*http.Transport)
+	original := transport.Proxy
+	t.Cleanup(func() { transport.Proxy = original })
+
+	tests := []struct {
+		proxy   string
+		want    string
+		wantErr bool
+	}{
+		{"http://127.0.0.1:3128", "http://127.0.0.1:3128", false},
+		{"socks5://127.0.0.1:1080", "socks5://127.0.0.1:1080", false},
+		{"ftp://127.0.0.1:21", "", true},
+		{"://missing-scheme", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proxy, func(t *testing.T) {
+			transport.Proxy = nil
+			if err := SetProxy(tt.proxy); (err != nil) != tt.wantErr {
+				t.Fatalf("SetProxy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if transport.Proxy != nil {
+					t.Error("proxy set for invalid value")
+				}
+				return
+			}
+			req, _ := http.NewRequest("GET", "https://mmbiz.qpic.cn/a.png", nil)
+			if u, err := transport.Proxy(req); err != nil || u.String() != tt.want {
+				t.Errorf("proxy = %v, want %s", u, tt.want)
+			}
+		})
+	}
+
+	// empty keeps the transport untouched
+	transport.Proxy = nil
+	if err := SetProxy(""); err != nil || transport.Proxy != nil {
+		t.Errorf("SetProxy(\"\") error = %v, proxy set %v", err, transport.Proxy != nil)
+	}
+
+	// media is fetched through the proxy
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.String()))
+	}))
+	defer proxy.Close()
+	if err := SetProxy(proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := HTTPGetReadCloser("http://cdn.example.invalid/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if data, _ := io.ReadAll(reader); string(data) != "http://cdn.example.invalid/a.png" {
+		t.Errorf("proxy got %q", data)
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	userAgent, headers := UserAgent, Headers
+	t.Cleanup(func() { UserAgent, Headers = userAgent, headers })
+
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		userAgent string
+		headers   map[string]string
+		want      map[string]string
+	}{
+		{"default", "", nil, map[string]string{"User-Agent": userAgent}},
+		{"user agent", "WeChat/8.0.25", nil, map[string]string{"User-Agent": "WeChat/8.0.25"}},
+		{"referer", "", map[string]string{"Referer": "https://mp.weixin.qq.com/"}, map[string]string{"User-Agent": userAgent, "Referer": "https://mp.weixin.qq.com/"}},
+		// configured headers take precedence over the user agent
+		{"header overrides user agent", "WeChat/8.0.25", map[string]string{"user-agent": "curl/7.84"}, map[string]string{"User-Agent": "curl/7.84"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			UserAgent, Headers = userAgent, map[string]string{}
+			SetHeaders(tt.userAgent, tt.headers)
+
+			reader, err := HTTPGetReadCloser(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader.Close()
+			for k, v := range tt.want {
+				if got.Get(k) != v {
+					t.Errorf("header %s = %q, want %q", k, got.Get(k), v)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		stripControl bool
+		want         string
+	}{
+		{"nfc", "cafe\u0301", false, "caf\u00e9"},
+		{"control kept", "a\x07b", false, "a\x07b"},
+		{"control stripped", "a\x07b\x00c", true, "abc"},
+		{"newline and tab kept", "a\nb\tc", true, "a\nb\tc"},
+		{"bom and bidi stripped", "\ufeffabc\u202edef\u2066", true, "abcdef"},
+		{"zwj sequence", "👨\u200d👩\u200d👧", true, "👨\u200d👩\u200d👧"},
+		{"variation selector", "❤\ufe0f", true, "❤\ufe0f"},
+		{"skin tone", "👍🏽", true, "👍🏽"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeText(tt.text, tt.stripControl); got != tt.want {
+				t.Errorf("normalizeText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsGIF(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"gif89a.png", []byte("GIF89a\x01\x00\x01\x00"), true},
+		{"gif87a", []byte("GIF87a\x01\x00\x01\x00"), true},
+		{"image.gif", []byte("\x89PNG\r\n\x1a\n"), false},
+		{"short", []byte("GIF"), false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if got := isGIF(path); got != tt.want {
+				t.Errorf("isGIF() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if isGIF(filepath.Join(dir, "missing.gif")) {
+		t.Error("isGIF() of missing file = true")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "blocker")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		data    string
+		wantErr bool
+	}{
+		{"new file in new directory", filepath.Join(dir, "wxid_self", "voice.amr"), "#!AMR\n1", false},
+		{"overwrite", filepath.Join(dir, "wxid_self", "voice.amr"), "#!AMR\n2", false},
+		{"parent is a file", filepath.Join(blocker, "voice.amr"), "#!AMR\n3", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := writeFileAtomic(tt.path, []byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeFileAtomic() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if data, _ := os.ReadFile(tt.path); string(data) != tt.data {
+				t.Errorf("file = %q, want %q", data, tt.data)
+			}
+		})
+	}
+
+	// no temp file is left behind
+	entries, err := os.ReadDir(filepath.Join(dir, "wxid_self"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in directory, want 1", len(entries))
+	}
+}
+
+func TestDecodeName(t *testing.T) {
+	t.Cleanup(func() { nameEncoding = NAME_ENCODING_AUTO })
+
+	gbk, err := simplifiedchinese.GBK.NewEncoder().String("张三")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		encoding string
+		name     string
+		want     string
+		wantErr  bool
+	}{
+		{"", "张三", "张三", false},
+		{"auto", gbk, "张三", false},
+		{"auto", "张三", "张三", false},
+		{"UTF-8", gbk, gbk, false},
+		{"utf8", "张三", "张三", false},
+		{"gbk", gbk, "张三", false},
+		{"big5", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			nameEncoding = NAME_ENCODING_AUTO
+			if err := SetNameEncoding(tt.encoding); (err != nil) != tt.wantErr {
+				t.Fatalf("SetNameEncoding() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if nameEncoding != NAME_ENCODING_AUTO {
+					t.Errorf("encoding changed to %s", nameEncoding)
+				}
+				return
+			}
+			if got := decodeName(tt.name); got != tt.want {
+				t.Errorf("decodeName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMediaPathCandidates(t *testing.T) {
+	docdir := filepath.Join(t.TempDir(), "WeChat Files")
+	file := filepath.Join("FileStorage", "File", "2022-07", "report.pdf")
+	absolute := filepath.Join(t.TempDir(), file)
+
+	tests := []struct {
+		name string
+		self string
+		path string
+		want []string
+	}{
+		{"absolute", "wxid_self", absolute, []string{absolute}},
+		{"relative to account", "wxid_self", filepath.Join("wxid_self", file), []string{
+			filepath.Join(docdir, "wxid_self", file),
+			filepath.Join(docdir, "wxid_self", "wxid_self", file),
+			filepath.Join(docdir, "WeChat Files", "wxid_self", file),
+			filepath.Join(docdir, "WeChat Files", "wxid_self", "wxid_self", file),
+		}},
+		{"alias folder", "wxid_self", filepath.Join("alice2022", file), []string{
+			filepath.Join(docdir, "alice2022", file),
+			filepath.Join(docdir, "wxid_self", "alice2022", file),
+			filepath.Join(docdir, "wxid_self", file),
+			filepath.Join(docdir, "WeChat Files", "alice2022", file),
+			filepath.Join(docdir, "WeChat Files", "wxid_self", "alice2022", file),
+		}},
+		{"self unknown", "", `\` + file, []string{
+			filepath.Join(docdir, file),
+			filepath.Join(docdir, "WeChat Files", file),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mediaPathCandidates(docdir, tt.self, tt.path)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mediaPathCandidates() = %q, want %q", got, tt.want)
+			}
+			if len(got) > maxMediaCandidates {
+				t.Errorf("%d candidates, want at most %d", len(got), maxMediaCandidates)
+			}
+		})
+	}
+}
+
+func TestNormalizeQRCode(t *testing.T) {
+	qr := image.NewGray(image.Rect(0, 0, 8, 8))
+	var pngData, jpegData bytes.Buffer
+	if err := png.Encode(&pngData, qr); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpegData, qr, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"png", pngData.Bytes(), false},
+		{"jpeg", jpegData.Bytes(), false},
+		{"not an image", []byte("<html>login expired</html>"), true},
+		{"empty", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// expiry is in milliseconds
+			before := time.Now().Truncate(time.Millisecond)
+			got, err := normalizeQRCode(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeQRCode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if _, format, err := image.Decode(bytes.NewReader(got.PNG)); err != nil || format != "png" {
+				t.Errorf("normalizeQRCode() = %s image, %v, want png", format, err)
+			}
+			if expires := time.UnixMilli(got.ExpiresAt); expires.Before(before.Add(qrCodeLifetime)) || expires.After(time.Now().Add(qrCodeLifetime)) {
+				t.Errorf("expires at %v, want %v later", expires, qrCodeLifetime)
+			}
+		})
+	}
+
+	// png is passed as is
+	if got, _ := normalizeQRCode(pngData.Bytes()); !bytes.Equal(got.PNG, pngData.Bytes()) {
+		t.Error("png QR code was re-encoded")
+	}
+}
+
+func TestGetContactCategory(t *testing.T) {
+	// UserName, NickName, big and small avatar, Remark, Alias, Type, VerifyFlag
+	tests := []struct {
+		name    string
+		contact WxContact
+		want    common.ContactType
+	}{
+		{"friend", WxContact{"wxid_bob", "Bob", "", "", "Bobby", "", "3", "0"}, common.ContactFriend},
+		{"stranger", WxContact{"wxid_carol", "Carol", "", "", "", "", "0", "0"}, common.ContactStranger},
+		{"blocked friend", WxContact{"wxid_dave", "Dave", "", "", "", "", "11", "0"}, common.ContactBlocked},
+		{"group", WxContact{"24503927881@chatroom", "Gophers", "", "", "", "", "2", "0"}, common.ContactGroup},
+		{"official by verify flag", WxContact{"wxid_service", "Service", "", "", "", "", "3", "8"}, common.ContactOfficial},
+		{"official by prefix", WxContact{"gh_3dfda90e39d6", "Gopher 日报", "", "", "", "", "3", "0"}, common.ContactOfficial},
+		{"system", WxContact{"filehelper", "文件传输助手", "", "", "", "", "3", "0"}, common.ContactSystem},
+		{"malformed flags", WxContact{"wxid_erin", "Erin", "", "", "", "", "", ""}, common.ContactStranger},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getContactCategory(tt.contact); got != tt.want {
+				t.Errorf("getContactCategory() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSystemContact(t *testing.T) {
+	tests := []struct {
+		wxid string
+		want bool
+	}{
+		{"filehelper", true},
+		{"fmessage", true},
+		{"weixin", true},
+		{"medianote", true},
+		{"wxid_bob", false},
+		{"gh_3dfda90e39d6", false},
+		{"24503927881@chatroom", false},
+		{"FileHelper", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wxid, func(t *testing.T) {
+			if got := isSystemContact(tt.wxid); got != tt.want {
+				t.Errorf("isSystemContact(%q) = %v, want %v", tt.wxid, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIgnoreTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		names    []string
+		types    []int
+		appTypes []int
+		wantErr  bool
+	}{
+		{"empty", nil, nil, nil, false},
+		{"symbolic", []string{"voice", " Sticker "}, []int{34, 47}, nil, false},
+		{"number", []string{"10000"}, []int{10000}, nil, false},
+		{"app name", []string{"mini_program", "transfer"}, nil, []int{33, 36, 2000}, false},
+		{"app number", []string{"app:19"}, nil, []int{19}, false},
+		{"mixed", []string{"card", "link", "app:51"}, []int{42}, []int{5, 51}, false},
+		{"invalid app", []string{"app:abc"}, nil, nil, true},
+		{"unknown", []string{"voice", "hologram"}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			types, appTypes, err := parseIgnoreTypes(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIgnoreTypes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for _, check := range []struct {
+				got  map[int]struct{}
+				want []int
+			}{{types, tt.types}, {appTypes, tt.appTypes}} {
+				want := map[int]struct{}{}
+				for _, typ := range check.want {
+					want[typ] = struct{}{}
+				}
+				if !reflect.DeepEqual(check.got, want) {
+					t.Errorf("parseIgnoreTypes() = %v, want %v", check.got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIsMentioned(t *testing.T) {
+	tests := []struct {
+		name     string
+		mentions []string
+		want     bool
+	}{
+		{"self", []string{"wxid_bob", "wxid_self"}, true},
+		{"everyone", []string{"notify@all"}, true},
+		{"others", []string{"wxid_bob", "wxid_carol"}, false},
+		{"prefix only", []string{"wxid_self2"}, false},
+		{"none", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isMentioned(tt.mentions, "wxid_self"); got != tt.want {
+				t.Errorf("isMentioned(%v) = %v, want %v", tt.mentions, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSweepOutgoing(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+
+	write := func(name string, modTime time.Time) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("media"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	stale := write("owner_a/0011223344556677/cat.png", old)
+	kept := write("owner_a/8899aabbccddeeff/dog.png", time.Now())
+	alone := write("owner_b/0123456789abcdef/report.pdf", old)
+	if err := os.MkdirAll(filepath.Join(dir, "owner_b", "fedcba9876543210"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	sweepOutgoing(dir, 24*time.Hour)
+
+	tests := []struct {
+		path   string
+		exists bool
+	}{
+		{stale, false},
+		{filepath.Dir(stale), false},
+		{kept, true},
+		{filepath.Join(dir, "owner_a"), true},
+		{alone, false},
+		{filepath.Join(dir, "owner_b", "fedcba9876543210"), false},
+		{filepath.Join(dir, "owner_b"), false},
+		{dir, true},
+	}
+	for _, tt := range tests {
+		if got := pathExists(tt.path); got != tt.exists {
+			t.Errorf("%s exists = %v, want %v", tt.path, got, tt.exists)
+		}
+	}
+}
+
+func TestParseAppText(t *testing.T) {
+	tests := []struct {
+		name string
+		xml  string
+		want string
+	}{
+		{"all", `<msg><appmsg><title>年终总结</title><des>点击查看</des><url>https://example.com/a</url></appmsg></msg>`,
+			"年终总结\n点击查看\nhttps://example.com/a"},
+		{"blank parts skipped", `<msg><appmsg><title> </title><des>点击查看</des></appmsg></msg>`, "点击查看"},
+		{"trimmed", "<msg><appmsg><title>\n  年终总结\n</title></appmsg></msg>", "年终总结"},
+		{"nothing", `<msg><appmsg><type>2001</type></appmsg></msg>`, ""},
+		{"not xml", "<msg><appmsg>", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseAppText(&WechatMessage{Message: tt.xml}); got != tt.want {
+				t.Errorf("parseAppText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	_ "time/tzdata"
 
 	"github.com/duo/matrix-wechat-agent/internal/common"
 	"github.com/duo/matrix-wechat-agent/internal/wechat"
@@ -13,28 +15,46 @@ import (
 )
 
 func main() {
+	check := flag.Bool("check", false, "validate config and test bridge connection, then exit")
+	flag.Parse()
+
 	config, err := common.LoadConfig("configure.yaml")
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *check {
+		if !wechat.Check(config, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	logLevel, err := log.ParseLevel(config.Log.Level)
 	if err == nil {
 		log.SetLevel(logLevel)
 	}
 	log.SetFormatter(&log.TextFormatter{TimestampFormat: "2006-01-02 15:04:05", FullTimestamp: true})
 
-	driver := wechat.LoadDriver()
-	defer syscall.FreeLibrary(driver)
+	if !config.Wechat.Mock {
+		release, err := wechat.LoadDriver(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer release()
+	}
 
 	service := wechat.NewService(config)
 	go service.Start()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
-
-	fmt.Printf("\n")
+	select {
+	case <-c:
+		fmt.Printf("\n")
+	case <-service.Done():
+		log.Errorln("Service stopped, shutting down")
+	}
 
 	service.Stop()
 }